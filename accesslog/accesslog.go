@@ -0,0 +1,258 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package accesslog writes a line for every gRPC call and HTTP request a
+// server handles, in JSON or, for HTTP, the Common or Combined Log Format,
+// to standard output or a rotating file. The combined+ format extends the
+// Combined Log Format with the request ID, the duration and the versions
+// of the downstream services, which breaks parsers that expect CLF.
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kelseyhightower/ping/internal/random"
+
+	"golang.org/x/net/context"
+)
+
+// Formats of the access log.
+const (
+	JSON         = "json"
+	Common       = "common"
+	Combined     = "combined"
+	CombinedPlus = "combined+"
+)
+
+// Entry is a line of the access log.
+type Entry struct {
+	Time     time.Time
+	Duration time.Duration
+
+	// Protocol is "grpc" or "http".
+	Protocol string
+	// Method is the full gRPC method, or the HTTP method.
+	Method string
+	// Path and Proto are the path with query and the protocol version of
+	// an HTTP request.
+	Path  string
+	Proto string
+	// Status is the HTTP status code, or for gRPC the HTTP equivalent of
+	// Code.
+	Status int
+	Code   string
+
+	// Bytes is the size of the response body, or of the response
+	// messages of a gRPC call.
+	Bytes     int64
+	Peer      string
+	UserAgent string
+	Referer   string
+	RequestID string
+	TraceID   string
+
+	mu       sync.Mutex
+	versions map[string]string
+}
+
+// SetVersion records the version a downstream service returned while
+// handling the request of ctx. It does nothing if ctx has no entry.
+func SetVersion(ctx context.Context, downstream, version string) {
+	e, ok := ctx.Value(entryKey{}).(*Entry)
+	if !ok {
+		return
+	}
+	e.mu.Lock()
+	if e.versions == nil {
+		e.versions = make(map[string]string)
+	}
+	e.versions[downstream] = version
+	e.mu.Unlock()
+}
+
+type entryKey struct{}
+
+func newContext(ctx context.Context, e *Entry) context.Context {
+	return context.WithValue(ctx, entryKey{}, e)
+}
+
+// Config configures a Logger.
+type Config struct {
+	// Path is "stdout" or the file the log is written to.
+	Path   string
+	Format string
+	// SampleRate is the fraction of successful requests that are logged.
+	// Failed requests are always logged.
+	SampleRate float64
+	// MaxSize is the size in bytes at which the file is rotated, and
+	// MaxBackups the number of rotated files that are kept.
+	MaxSize    int64
+	MaxBackups int
+}
+
+// Logger writes the access log.
+type Logger struct {
+	format     string
+	sampleRate float64
+
+	mu  sync.Mutex
+	w   io.Writer
+	rnd *rand.Rand
+}
+
+// New returns a logger configured by cfg.
+func New(cfg Config) (*Logger, error) {
+	switch cfg.Format {
+	case JSON, Common, Combined, CombinedPlus:
+	default:
+		return nil, fmt.Errorf("unknown access log format %q; use %s, %s, %s or %s", cfg.Format, JSON, Common, Combined, CombinedPlus)
+	}
+	var w io.Writer = os.Stdout
+	if cfg.Path != "stdout" {
+		f, err := NewRotatingFile(cfg.Path, cfg.MaxSize, cfg.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	return &Logger{
+		format:     cfg.Format,
+		sampleRate: cfg.SampleRate,
+		w:          w,
+		rnd:        random.New(),
+	}, nil
+}
+
+// Log writes e, unless it is dropped by sampling. Failed requests are
+// always written.
+func (l *Logger) Log(e *Entry, failed bool) {
+	if !failed && !l.sample() {
+		return
+	}
+
+	var buf bytes.Buffer
+	e.mu.Lock()
+	switch l.format {
+	case JSON:
+		writeJSON(&buf, e)
+	case Common:
+		writeCommon(&buf, e)
+	case Combined:
+		writeCommon(&buf, e)
+		fmt.Fprintf(&buf, " %s %s", quote(e.Referer), quote(e.UserAgent))
+	case CombinedPlus:
+		writeCommon(&buf, e)
+		fmt.Fprintf(&buf, " %s %s", quote(e.Referer), quote(e.UserAgent))
+		fmt.Fprintf(&buf, " request_id=%s duration=%.6f", quote(e.RequestID), e.Duration.Seconds())
+		for _, k := range e.sortedVersions() {
+			fmt.Fprintf(&buf, " %s_version=%s", k, quote(e.versions[k]))
+		}
+	}
+	e.mu.Unlock()
+	buf.WriteByte('\n')
+
+	l.mu.Lock()
+	l.w.Write(buf.Bytes())
+	l.mu.Unlock()
+}
+
+func (l *Logger) sample() bool {
+	if l.sampleRate >= 1 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rnd.Float64() < l.sampleRate
+}
+
+func (e *Entry) sortedVersions() []string {
+	keys := make([]string, 0, len(e.versions))
+	for k := range e.versions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeCommon writes e in the Common Log Format. gRPC calls are written
+// as POST requests of their method over HTTP/2.
+func writeCommon(buf *bytes.Buffer, e *Entry) {
+	method, path, proto := e.Method, e.Path, e.Proto
+	if e.Protocol == "grpc" {
+		method, path, proto = "POST", e.Method, "HTTP/2.0"
+	}
+	host := e.Peer
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "" {
+		host = "-"
+	}
+	fmt.Fprintf(buf, "%s - - [%s] %s %d %d", host, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(method+" "+path+" "+proto), e.Status, e.Bytes)
+}
+
+// quote returns s quoted, or "-" if it is empty.
+func quote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
+
+type jsonEntry struct {
+	Time      string            `json:"time"`
+	Protocol  string            `json:"protocol"`
+	Method    string            `json:"method"`
+	Path      string            `json:"path,omitempty"`
+	Status    int               `json:"status"`
+	Code      string            `json:"grpc_code,omitempty"`
+	Duration  float64           `json:"duration"`
+	Bytes     int64             `json:"bytes"`
+	Peer      string            `json:"peer"`
+	UserAgent string            `json:"user_agent,omitempty"`
+	Referer   string            `json:"referer,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+	TraceID   string            `json:"trace_id,omitempty"`
+	Versions  map[string]string `json:"versions,omitempty"`
+}
+
+func writeJSON(buf *bytes.Buffer, e *Entry) {
+	data, _ := json.Marshal(&jsonEntry{
+		Time:      e.Time.UTC().Format(time.RFC3339Nano),
+		Protocol:  e.Protocol,
+		Method:    e.Method,
+		Path:      e.Path,
+		Status:    e.Status,
+		Code:      e.Code,
+		Duration:  e.Duration.Seconds(),
+		Bytes:     e.Bytes,
+		Peer:      e.Peer,
+		UserAgent: e.UserAgent,
+		Referer:   e.Referer,
+		RequestID: e.RequestID,
+		TraceID:   e.TraceID,
+		Versions:  e.versions,
+	})
+	buf.Write(data)
+}
@@ -0,0 +1,125 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accesslog
+
+import (
+	"time"
+
+	"github.com/kelseyhightower/ping/middleware"
+	"github.com/kelseyhightower/ping/propagation"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// httpStatus maps gRPC codes to HTTP status codes, as grpc-gateway does.
+var httpStatus = map[codes.Code]int{
+	codes.OK:                 200,
+	codes.Canceled:           499,
+	codes.Unknown:            500,
+	codes.InvalidArgument:    400,
+	codes.DeadlineExceeded:   504,
+	codes.NotFound:           404,
+	codes.AlreadyExists:      409,
+	codes.PermissionDenied:   403,
+	codes.Unauthenticated:    401,
+	codes.ResourceExhausted:  429,
+	codes.FailedPrecondition: 400,
+	codes.Aborted:            409,
+	codes.OutOfRange:         400,
+	codes.Unimplemented:      501,
+	codes.Internal:           500,
+	codes.Unavailable:        503,
+	codes.DataLoss:           500,
+}
+
+// startCall returns the entry of a call, without its outcome.
+func startCall(ctx context.Context, method string) *Entry {
+	e := &Entry{Time: time.Now(), Protocol: "grpc", Method: method}
+	if p, ok := peer.FromContext(ctx); ok {
+		e.Peer = p.Addr.String()
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md["user-agent"]; len(v) > 0 {
+			e.UserAgent = v[0]
+		}
+	}
+	if c := propagation.FromContext(ctx); c != nil {
+		e.RequestID = c.RequestID
+		e.TraceID = c.TraceID
+	}
+	return e
+}
+
+func (l *Logger) finishCall(e *Entry, err error) {
+	code := grpc.Code(err)
+	e.Duration = time.Since(e.Time)
+	e.Code = code.String()
+	e.Status = httpStatus[code]
+	if e.Status == 0 {
+		e.Status = 500
+	}
+	l.Log(e, err != nil)
+}
+
+func size(m interface{}) int64 {
+	if pm, ok := m.(proto.Message); ok {
+		return int64(proto.Size(pm))
+	}
+	return 0
+}
+
+// UnaryServerInterceptor returns an interceptor that logs every unary
+// call. It must come after the propagation interceptor.
+func (l *Logger) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		e := startCall(ctx, info.FullMethod)
+		resp, err := handler(newContext(ctx, e), req)
+		if err == nil {
+			e.Bytes = size(resp)
+		}
+		l.finishCall(e, err)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor returns an interceptor that logs every streaming
+// call. It must come after the propagation interceptor.
+func (l *Logger) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		e := startCall(ss.Context(), info.FullMethod)
+		s := &countingStream{middleware.WrapServerStream(ss, newContext(ss.Context(), e)), e}
+		err := handler(srv, s)
+		l.finishCall(e, err)
+		return err
+	}
+}
+
+// countingStream adds the size of the messages sent to an entry.
+type countingStream struct {
+	grpc.ServerStream
+	e *Entry
+}
+
+func (s *countingStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.e.Bytes += size(m)
+	}
+	return err
+}
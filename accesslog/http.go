@@ -0,0 +1,51 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accesslog
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/kelseyhightower/ping/middleware"
+	"github.com/kelseyhightower/ping/propagation"
+)
+
+// Handler returns h wrapped so that every request is logged. It must be
+// wrapped by propagation.Handler.
+func (l *Logger) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := &Entry{
+			Time:      time.Now(),
+			Protocol:  "http",
+			Method:    r.Method,
+			Path:      r.URL.RequestURI(),
+			Proto:     r.Proto,
+			Peer:      r.RemoteAddr,
+			UserAgent: r.UserAgent(),
+			Referer:   r.Referer(),
+		}
+		if c := propagation.FromContext(r.Context()); c != nil {
+			e.RequestID = c.RequestID
+			e.TraceID = c.TraceID
+		}
+
+		rec := middleware.NewResponseRecorder(w)
+		h.ServeHTTP(rec, r.WithContext(newContext(r.Context(), e)))
+
+		e.Duration = time.Since(e.Time)
+		e.Status = rec.Status
+		e.Bytes = rec.Bytes
+		l.Log(e, rec.Status >= 400)
+	})
+}
@@ -0,0 +1,97 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package admin serves debugging pages on an opt-in admin port: the
+// request traces and event logs of golang.org/x/net/trace on
+// /debug/requests and /debug/events, the client connections of package
+// channelz on /debug/channels, and the profiles of net/http/pprof on
+// /debug/pprof. It also serves the log level of the default logger on
+// /loglevel, where it can be changed.
+//
+// The pages reveal the traffic of the service, so the admin server should
+// listen on a private address and may require a token, sent as a bearer
+// token or, from a browser, as the password of basic authentication.
+package admin
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/kelseyhightower/ping/channelz"
+	"github.com/kelseyhightower/ping/logging"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/trace"
+	"google.golang.org/grpc"
+)
+
+// Handler returns the handler of the admin server. If token is not empty
+// requests must present it.
+func Handler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/requests", func(w http.ResponseWriter, r *http.Request) {
+		trace.Render(w, r, true)
+	})
+	mux.HandleFunc("/debug/events", func(w http.ResponseWriter, r *http.Request) {
+		trace.RenderEvents(w, r, true)
+	})
+	mux.Handle("/debug/channels", channelz.Handler())
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/loglevel", logging.LevelHandler(logging.Default()))
+	if token == "" {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+			http.Error(w, "admin: a valid token is required", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func authorized(r *http.Request, token string) bool {
+	presented := ""
+	if _, password, ok := r.BasicAuth(); ok {
+		presented = password
+	} else if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		presented = strings.TrimPrefix(h, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1
+}
+
+// NewEventLog returns the event log of the long-lived connection to the
+// downstream service name at target, shown on /debug/events under the
+// downstream family.
+func NewEventLog(name, target string) trace.EventLog {
+	return trace.NewEventLog("downstream", name+" "+target)
+}
+
+// UnaryClientInterceptor returns an interceptor that records failed calls
+// in events.
+func UnaryClientInterceptor(events trace.EventLog) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if err != nil {
+			events.Errorf("%s failed: %v", method, err)
+		}
+		return err
+	}
+}
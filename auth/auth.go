@@ -0,0 +1,248 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package auth authenticates gRPC calls by the bearer token in their
+// authorization metadata.
+//
+// A token is either a static API key listed in a key file or a JWT signed
+// with a shared HMAC secret (HS256, HS384 or HS512). JWTs must not be
+// expired and, if configured, must carry the expected issuer and audience.
+//
+// A key file has one key per line, optionally followed by the name of the
+// caller it identifies. Blank lines and lines starting with # are ignored.
+//
+//	# key                              name
+//	3a1f0c4e8b7d4e2f9c6a5b0d1e2f3a4b  load-tester
+//	9f8e7d6c5b4a39281706f5e4d3c2b1a0
+//
+// Calls to the gRPC health service are not authenticated, so health
+// checkers keep working without credentials.
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/ping/middleware"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// healthService is the prefix of the methods that are never authenticated.
+const healthService = "/grpc.health.v1.Health/"
+
+// Authenticator checks the bearer tokens of incoming calls.
+type Authenticator struct {
+	keys     []apiKey
+	secret   []byte
+	issuer   string
+	audience string
+}
+
+type apiKey struct {
+	key  string
+	name string
+}
+
+// Config configures an Authenticator. At least one of KeyFile and
+// JWTSecretFile must be set.
+type Config struct {
+	// KeyFile lists the accepted API keys.
+	KeyFile string
+	// JWTSecretFile holds the HMAC secret that JWTs are signed with.
+	JWTSecretFile string
+	// Issuer, if set, must match the iss claim of JWTs.
+	Issuer string
+	// Audience, if set, must be in the aud claim of JWTs.
+	Audience string
+}
+
+// NewAuthenticator loads the key and secret files named in cfg.
+func NewAuthenticator(cfg Config) (*Authenticator, error) {
+	if cfg.KeyFile == "" && cfg.JWTSecretFile == "" {
+		return nil, errors.New("auth: an API key file or a JWT secret is required")
+	}
+	a := &Authenticator{issuer: cfg.Issuer, audience: cfg.Audience}
+	if cfg.KeyFile != "" {
+		keys, err := loadKeys(cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		a.keys = keys
+	}
+	if cfg.JWTSecretFile != "" {
+		secret, err := LoadSecret(cfg.JWTSecretFile)
+		if err != nil {
+			return nil, err
+		}
+		a.secret = secret
+	}
+	return a, nil
+}
+
+// LoadSecret reads an HMAC secret from path. Surrounding whitespace, such
+// as a trailing newline, is not part of the secret.
+func LoadSecret(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret := bytes.TrimSpace(data)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("auth: %s is empty", path)
+	}
+	return secret, nil
+}
+
+func loadKeys(path string) ([]apiKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []apiKey
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("auth: %s:%d: want a key and an optional name", path, n)
+		}
+		k := apiKey{key: fields[0], name: "api-key"}
+		if len(fields) == 2 {
+			k.name = fields[1]
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("auth: no API keys found in %s", path)
+	}
+	return keys, nil
+}
+
+// Principal is an authenticated caller.
+type Principal struct {
+	// Subject is the name of an API key or the sub claim of a JWT.
+	Subject string
+	// Method is how the caller authenticated: api-key or jwt.
+	Method string
+}
+
+func (p *Principal) String() string {
+	return p.Method + ":" + p.Subject
+}
+
+type principalKey struct{}
+
+// NewContext returns a context that carries p.
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the authenticated caller in ctx, if any.
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+// TokenFromContext returns the bearer token in the incoming metadata of
+// ctx, or an empty string if there is none.
+func TokenFromContext(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	for _, v := range md["authorization"] {
+		if len(v) > 7 && strings.EqualFold(v[:7], "bearer ") {
+			return strings.TrimSpace(v[7:])
+		}
+	}
+	return ""
+}
+
+// Authenticate returns the caller that token identifies.
+func (a *Authenticator) Authenticate(token string) (*Principal, error) {
+	for _, k := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(k.key), []byte(token)) == 1 {
+			return &Principal{Subject: k.name, Method: "api-key"}, nil
+		}
+	}
+	if a.secret == nil || strings.Count(token, ".") != 2 {
+		return nil, errors.New("invalid API key")
+	}
+
+	claims, err := verifyJWT(token, a.secret, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if a.issuer != "" && claims.Issuer != a.issuer {
+		return nil, fmt.Errorf("token issuer %q is not %q", claims.Issuer, a.issuer)
+	}
+	if a.audience != "" && !claims.Audience.contains(a.audience) {
+		return nil, fmt.Errorf("token audience %q does not include %q", strings.Join(claims.Audience, ","), a.audience)
+	}
+	return &Principal{Subject: claims.Subject, Method: "jwt"}, nil
+}
+
+// authenticate returns a context carrying the caller of method, or an
+// UNAUTHENTICATED error.
+func (a *Authenticator) authenticate(ctx context.Context, method string) (context.Context, error) {
+	if strings.HasPrefix(method, healthService) {
+		return ctx, nil
+	}
+	token := TokenFromContext(ctx)
+	if token == "" {
+		return nil, status.Errorf(codes.Unauthenticated, "%s requires a bearer token in the authorization metadata", method)
+	}
+	p, err := a.Authenticate(token)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "%s: %v", method, err)
+	}
+	return NewContext(ctx, p), nil
+}
+
+// UnaryServerInterceptor returns an interceptor that authenticates unary
+// calls.
+func (a *Authenticator) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := a.authenticate(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor returns an interceptor that authenticates
+// streaming calls.
+func (a *Authenticator) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := a.authenticate(ss.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, middleware.WrapServerStream(ss, ctx))
+	}
+}
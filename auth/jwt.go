@@ -0,0 +1,176 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+)
+
+// leeway is the clock skew allowed when checking the exp and nbf claims.
+const leeway = 30 * time.Second
+
+// Claims are the registered JWT claims this package understands.
+type Claims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+}
+
+// audience is a JWT audience, which is either a string or a list of
+// strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.New("aud must be a string or a list of strings")
+	}
+	*a = list
+	return nil
+}
+
+func (a audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+var algorithms = map[string]func() hash.Hash{
+	"HS256": sha256.New,
+	"HS384": sha512.New384,
+	"HS512": sha512.New,
+}
+
+var encoding = base64.RawURLEncoding
+
+// SignJWT returns a JWT with claims, signed with HS256 and secret.
+func SignJWT(claims *Claims, secret []byte) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := encoding.EncodeToString(header) + "." + encoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + encoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifyJWT checks the signature and the time based claims of token and
+// returns its claims. Only HMAC signatures are accepted, and tokens must
+// carry an exp claim.
+func verifyJWT(token string, secret []byte, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	data, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	newHash, ok := algorithms[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", header.Alg)
+	}
+
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	mac := hmac.New(newHash, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errors.New("invalid token signature")
+	}
+
+	data, err = encoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed token payload")
+	}
+	claims := &Claims{}
+	if err := json.Unmarshal(data, claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %v", err)
+	}
+	if claims.ExpiresAt == 0 {
+		return nil, errors.New("token has no expiration time")
+	}
+	if now.After(time.Unix(claims.ExpiresAt, 0).Add(leeway)) {
+		return nil, errors.New("token has expired")
+	}
+	if claims.NotBefore != 0 && now.Add(leeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, errors.New("token is not valid yet")
+	}
+	return claims, nil
+}
+
+// Minter mints short-lived JWTs, for example for calls to downstream
+// services.
+type Minter struct {
+	Secret   []byte
+	Issuer   string
+	Audience string
+	TTL      time.Duration
+}
+
+// Mint returns a token for subject.
+func (m *Minter) Mint(subject string) (string, error) {
+	now := time.Now()
+	claims := &Claims{
+		Issuer:    m.Issuer,
+		Subject:   subject,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(m.TTL).Unix(),
+	}
+	if m.Audience != "" {
+		claims.Audience = audience{m.Audience}
+	}
+	return SignJWT(claims, m.Secret)
+}
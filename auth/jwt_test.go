@@ -0,0 +1,160 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("secret")
+
+// makeJWT returns a token with a header of alg and claims, signed with the
+// HMAC algorithm alg names and secret. Other algorithms get an empty
+// signature.
+func makeJWT(t *testing.T, alg string, claims interface{}, secret []byte) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingInput := encoding.EncodeToString(header) + "." + encoding.EncodeToString(payload)
+	newHash, ok := algorithms[alg]
+	if !ok {
+		return signingInput + "."
+	}
+	mac := hmac.New(newHash, secret)
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + encoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyJWT(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	exp := now.Add(time.Hour).Unix()
+	valid := &Claims{Subject: "frontend", ExpiresAt: exp}
+
+	// tamper replaces the payload of a token, keeping its signature.
+	tamper := func(token string, claims *Claims) string {
+		parts := strings.Split(token, ".")
+		payload, _ := json.Marshal(claims)
+		parts[1] = encoding.EncodeToString(payload)
+		return strings.Join(parts, ".")
+	}
+	signed := makeJWT(t, "HS256", valid, testSecret)
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{"HS256", signed, ""},
+		{"HS384", makeJWT(t, "HS384", valid, testSecret), ""},
+		{"HS512", makeJWT(t, "HS512", valid, testSecret), ""},
+		{"alg none", makeJWT(t, "none", valid, testSecret), `unsupported signing algorithm "none"`},
+		{"alg RS256", makeJWT(t, "RS256", valid, testSecret), `unsupported signing algorithm "RS256"`},
+		{"no alg", makeJWT(t, "", valid, testSecret), `unsupported signing algorithm ""`},
+		{"wrong secret", makeJWT(t, "HS256", valid, []byte("other")), "invalid token signature"},
+		{"tampered signature", signed[:len(signed)-2] + "AA", "invalid token signature"},
+		{"tampered payload", tamper(signed, &Claims{Subject: "admin", ExpiresAt: exp}), "invalid token signature"},
+		{"no signature", strings.Join(strings.Split(signed, ".")[:2], ".") + ".", "invalid token signature"},
+		{"two parts", strings.Join(strings.Split(signed, ".")[:2], "."), "malformed token"},
+		{"no exp", makeJWT(t, "HS256", &Claims{Subject: "frontend"}, testSecret), "token has no expiration time"},
+		{"exp within leeway", makeJWT(t, "HS256", &Claims{ExpiresAt: now.Add(-leeway).Unix()}, testSecret), ""},
+		{"exp past leeway", makeJWT(t, "HS256", &Claims{ExpiresAt: now.Add(-leeway - time.Second).Unix()}, testSecret), "token has expired"},
+		{"nbf within leeway", makeJWT(t, "HS256", &Claims{ExpiresAt: exp, NotBefore: now.Add(leeway).Unix()}, testSecret), ""},
+		{"nbf past leeway", makeJWT(t, "HS256", &Claims{ExpiresAt: exp, NotBefore: now.Add(leeway + time.Second).Unix()}, testSecret), "token is not valid yet"},
+		{"bad aud", makeJWT(t, "HS256", map[string]interface{}{"exp": exp, "aud": 1}, testSecret), "malformed token claims"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := verifyJWT(tt.token, testSecret, now)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("got error %v, want none", err)
+			case tt.wantErr != "" && err == nil:
+				t.Errorf("got no error, want %q", tt.wantErr)
+			case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+				t.Errorf("got error %q, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuthenticateJWT(t *testing.T) {
+	a := &Authenticator{secret: testSecret, issuer: "ping", audience: "backend"}
+	exp := time.Now().Add(time.Hour).Unix()
+	tests := []struct {
+		name    string
+		claims  *Claims
+		wantErr string
+	}{
+		{"valid", &Claims{Issuer: "ping", Audience: audience{"backend"}, Subject: "frontend", ExpiresAt: exp}, ""},
+		{"audience list", &Claims{Issuer: "ping", Audience: audience{"other", "backend"}, ExpiresAt: exp}, ""},
+		{"wrong issuer", &Claims{Issuer: "evil", Audience: audience{"backend"}, ExpiresAt: exp}, `token issuer "evil" is not "ping"`},
+		{"no issuer", &Claims{Audience: audience{"backend"}, ExpiresAt: exp}, `token issuer "" is not "ping"`},
+		{"wrong audience", &Claims{Issuer: "ping", Audience: audience{"frontend"}, ExpiresAt: exp}, `token audience "frontend" does not include "backend"`},
+		{"no audience", &Claims{Issuer: "ping", ExpiresAt: exp}, `does not include "backend"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := a.Authenticate(makeJWT(t, "HS256", tt.claims, testSecret))
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("got error %v, want none", err)
+			case tt.wantErr == "" && (p.Subject != tt.claims.Subject || p.Method != "jwt"):
+				t.Errorf("got principal %+v, want subject %q with method jwt", p, tt.claims.Subject)
+			case tt.wantErr != "" && err == nil:
+				t.Errorf("got no error, want %q", tt.wantErr)
+			case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+				t.Errorf("got error %q, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMint(t *testing.T) {
+	m := &Minter{Secret: testSecret, Issuer: "ping", Audience: "backend", TTL: time.Minute}
+	token, err := m.Mint("frontend")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := verifyJWT(token, testSecret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Issuer != "ping" || claims.Subject != "frontend" || !claims.Audience.contains("backend") {
+		t.Errorf("got claims %+v", claims)
+	}
+	if ttl := claims.ExpiresAt - claims.IssuedAt; ttl != 60 {
+		t.Errorf("got exp - iat = %ds, want 60s", ttl)
+	}
+
+	a := &Authenticator{secret: testSecret, issuer: "ping", audience: "backend"}
+	if p, err := a.Authenticate(token); err != nil || p.Subject != "frontend" {
+		t.Errorf("Authenticate = %+v, %v, want subject frontend", p, err)
+	}
+	if _, err := verifyJWT(token, testSecret, time.Now().Add(time.Minute+leeway+time.Second)); err == nil {
+		t.Error("minted token is still valid after its TTL and the leeway")
+	}
+	if _, err := verifyJWT(token, []byte("other"), time.Now()); err == nil {
+		t.Error("minted token verified with another secret")
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package authz authorizes gRPC calls by the identity in the verified
+// client certificate of the caller, using a policy file.
+//
+// A policy lists rules that match methods and name the identities allowed
+// to call them. An identity starting with spiffe:// is compared with the
+// URI SANs of the client certificate, any other identity with its common
+// name, and * allows every caller with a verified certificate. Methods are
+// written as /package.Service/Method, /package.Service/* or *.
+//
+//	# Only the frontend may call ping.Ping.
+//	default: allow
+//	rules:
+//	- methods: ["/ping.Ping/*"]
+//	  allow:
+//	  - spiffe://cluster.local/ns/default/sa/frontend
+//
+// A call is allowed if any rule that matches its method allows the caller.
+// Calls to methods that no rule matches get the default action, allow or
+// deny. Calls to the gRPC health service are always allowed, so health
+// checkers keep working under a default deny policy.
+package authz
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/kelseyhightower/ping/internal/yaml"
+	"github.com/kelseyhightower/ping/middleware"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// healthService is the prefix of the methods that are never denied.
+const healthService = "/grpc.health.v1.Health/"
+
+// Policy is a list of authorization rules.
+type Policy struct {
+	// Default is the action for methods that no rule matches: allow or
+	// deny.
+	Default string `json:"default"`
+	Rules   []Rule `json:"rules"`
+}
+
+// Rule allows the listed identities to call the matching methods.
+type Rule struct {
+	Methods []string `json:"methods"`
+	Allow   []string `json:"allow"`
+}
+
+// LoadPolicy reads a policy file.
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{}
+	if err := yaml.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	switch p.Default {
+	case "":
+		p.Default = "deny"
+	case "allow", "deny":
+	default:
+		return nil, fmt.Errorf("%s: default must be allow or deny, got %q", path, p.Default)
+	}
+	for i, r := range p.Rules {
+		if len(r.Methods) == 0 {
+			return nil, fmt.Errorf("%s: rule %d matches no methods", path, i+1)
+		}
+		for _, m := range r.Methods {
+			if m != "*" && !strings.HasPrefix(m, "/") {
+				return nil, fmt.Errorf("%s: rule %d: method %q must start with /", path, i+1, m)
+			}
+		}
+	}
+	return p, nil
+}
+
+// Identity is the verified identity of a caller.
+type Identity struct {
+	CommonName string
+	SPIFFEIDs  []string
+}
+
+func (id *Identity) String() string {
+	parts := []string{"CN=" + id.CommonName}
+	parts = append(parts, id.SPIFFEIDs...)
+	return strings.Join(parts, ", ")
+}
+
+// matches reports whether the identity is the one named by principal.
+func (id *Identity) matches(principal string) bool {
+	if principal == "*" {
+		return true
+	}
+	if strings.HasPrefix(principal, "spiffe://") {
+		for _, s := range id.SPIFFEIDs {
+			if s == principal {
+				return true
+			}
+		}
+		return false
+	}
+	return id.CommonName == principal
+}
+
+// PeerIdentity returns the identity in the verified client certificate of
+// the caller, or nil if the caller did not present one.
+func PeerIdentity(ctx context.Context) *Identity {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return identityOf(info.State.VerifiedChains[0][0])
+}
+
+func identityOf(cert *x509.Certificate) *Identity {
+	id := &Identity{CommonName: cert.Subject.CommonName}
+	for _, u := range cert.URIs {
+		if u.Scheme == "spiffe" {
+			id.SPIFFEIDs = append(id.SPIFFEIDs, u.String())
+		}
+	}
+	return id
+}
+
+// Authorize returns a PERMISSION_DENIED error if the caller in ctx may not
+// call method.
+func (p *Policy) Authorize(ctx context.Context, method string) error {
+	if strings.HasPrefix(method, healthService) {
+		return nil
+	}
+	id := PeerIdentity(ctx)
+
+	var matched []int
+	for i, r := range p.Rules {
+		for _, m := range r.Methods {
+			if !middleware.MatchMethod(m, method) {
+				continue
+			}
+			matched = append(matched, i+1)
+			if id == nil {
+				break
+			}
+			for _, principal := range r.Allow {
+				if id.matches(principal) {
+					return nil
+				}
+			}
+			break
+		}
+	}
+
+	if len(matched) == 0 {
+		if p.Default == "allow" {
+			return nil
+		}
+		return status.Errorf(codes.PermissionDenied, "%s is denied by default: no authorization rule allows it", method)
+	}
+	if id == nil {
+		return status.Errorf(codes.PermissionDenied, "%s requires a verified client certificate, but the caller did not present one", method)
+	}
+	return status.Errorf(codes.PermissionDenied, "caller %s is not allowed to call %s by %s",
+		id, method, describeRules(matched))
+}
+
+func describeRules(rules []int) string {
+	s := make([]string, len(rules))
+	for i, n := range rules {
+		s[i] = fmt.Sprint(n)
+	}
+	if len(s) == 1 {
+		return "authorization rule " + s[0]
+	}
+	return "authorization rules " + strings.Join(s, ", ")
+}
+
+// UnaryServerInterceptor returns an interceptor that authorizes unary
+// calls.
+func (p *Policy) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := p.Authorize(ctx, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor returns an interceptor that authorizes streaming
+// calls.
+func (p *Policy) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := p.Authorize(ss.Context(), info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
@@ -15,9 +15,10 @@ package main
 
 import (
 	"context"
-	"log"
 	"net/http"
 
+	"github.com/kelseyhightower/ping/logging"
+
 	"google.golang.org/grpc/health"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
@@ -33,7 +34,7 @@ func httpHealthServer(server *health.Server) http.Handler {
 func (h *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	hcr, err := h.healthServer.Check(context.Background(), &healthpb.HealthCheckRequest{""})
 	if err != nil {
-		log.Println("Error checking gRPC server health", err)
+		logging.FromContext(r.Context()).Errorf("Error checking gRPC server health: %v", err)
 		w.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
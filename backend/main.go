@@ -16,16 +16,28 @@ package main
 import (
 	"context"
 	"flag"
-	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/kelseyhightower/ping"
+	"github.com/kelseyhightower/ping/accesslog"
+	"github.com/kelseyhightower/ping/auth"
+	"github.com/kelseyhightower/ping/authz"
+	"github.com/kelseyhightower/ping/internal/service"
+	"github.com/kelseyhightower/ping/logging"
+	"github.com/kelseyhightower/ping/metrics"
+	"github.com/kelseyhightower/ping/middleware"
+	"github.com/kelseyhightower/ping/propagation"
+	"github.com/kelseyhightower/ping/ratelimit"
+	"github.com/kelseyhightower/ping/rules"
+	"github.com/kelseyhightower/ping/tlsutil"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/grpclog"
 	"google.golang.org/grpc/health"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/reflection"
@@ -33,35 +45,213 @@ import (
 
 const (
 	version = "v2"
+
+	// tlsReloadInterval is how often the TLS files are checked for changes.
+	tlsReloadInterval = 10 * time.Second
+
+	// rulesReloadInterval is how often the rules file is checked for
+	// changes.
+	rulesReloadInterval = 5 * time.Second
 )
 
 var (
-	grpcAddr   string
-	healthAddr string
-	region     string
+	accessLog           string
+	accessLogFormat     string
+	accessLogMaxBackups int
+	accessLogMaxSize    int
+	accessLogSampleRate float64
+	adminAddr           string
+	adminTokenFile      string
+	authAPIKeys         string
+	authJWTSecret       string
+	authJWTIssuer       string
+	authJWTAudience     string
+	authzPolicy         string
+	grpcAddr            string
+	healthAddr          string
+	logFormat           string
+	logLevel            string
+	rateLimits          string
+	region              string
+	rulesFile           string
+	serviceName         string
+	tlsCert             string
+	tlsKey              string
+	tlsCA               string
+	tlsClientAuth       bool
+	traceFile           string
+	traceSampleRate     float64
+	zipkinURL           string
 )
 
 func main() {
+	flag.StringVar(&accessLog, "access-log", "", "Write an access log to stdout or to this file; disabled if empty")
+	flag.StringVar(&accessLogFormat, "access-log-format", accesslog.JSON, "The format of the access log: json, common, combined or combined+")
+	flag.IntVar(&accessLogMaxBackups, "access-log-max-backups", 3, "The number of rotated access log files that are kept")
+	flag.IntVar(&accessLogMaxSize, "access-log-max-size", 100, "The size in MB at which the access log file is rotated")
+	flag.Float64Var(&accessLogSampleRate, "access-log-sample-rate", 1, "The fraction of successful requests that are logged; failures are always logged")
+	flag.StringVar(&adminAddr, "admin", "", "The listen address of the admin server with /debug/requests, /debug/events, /debug/pprof and /loglevel; disabled if empty")
+	flag.StringVar(&adminTokenFile, "admin-token-file", "", "The file holding the token the admin server requires")
+	flag.StringVar(&authAPIKeys, "auth-api-keys", "", "The file of API keys accepted as bearer tokens; enables token authentication")
+	flag.StringVar(&authJWTSecret, "auth-jwt-secret", "", "The file holding the HMAC secret of accepted JWTs; enables token authentication")
+	flag.StringVar(&authJWTIssuer, "auth-jwt-issuer", "", "The required issuer (iss) of JWTs")
+	flag.StringVar(&authJWTAudience, "auth-jwt-audience", "", "The required audience (aud) of JWTs")
+	flag.StringVar(&authzPolicy, "authz-policy", "", "The policy file used to authorize callers by their client certificate")
 	flag.StringVar(&grpcAddr, "grpc", "127.0.0.1:8080", "The gRPC listen address")
 	flag.StringVar(&healthAddr, "health", "127.0.0.1:8008", "The health listen address")
+	flag.StringVar(&logFormat, "log-format", logging.Logfmt, "The format of log lines: logfmt or json")
+	flag.StringVar(&logLevel, "log-level", "info", "The minimum level of log lines: debug, info, warn or error")
+	flag.StringVar(&rateLimits, "rate-limits", "", "The file of per-caller rate limits")
 	flag.StringVar(&region, "region", "", "The compute region")
+	flag.StringVar(&rulesFile, "rules", "", "The file of rules that allow, deny or rate limit calls by their attributes")
+	flag.StringVar(&tlsCert, "tls-cert", "", "The PEM encoded TLS certificate; enables TLS")
+	flag.StringVar(&tlsKey, "tls-key", "", "The PEM encoded TLS private key")
+	flag.StringVar(&tlsCA, "tls-ca", "", "The PEM encoded CA bundle used to verify client certificates")
+	flag.StringVar(&serviceName, "service-name", "backend", "The service name reported in traces and logs")
+	flag.BoolVar(&tlsClientAuth, "tls-client-auth", false, "Require client certificates signed by -tls-ca (mTLS)")
+	flag.StringVar(&traceFile, "trace-file", "", "Append spans to this file in Zipkin v2 JSON; enables tracing")
+	flag.Float64Var(&traceSampleRate, "trace-sample-rate", 1, "The fraction of new traces that are sampled")
+	flag.StringVar(&zipkinURL, "zipkin-url", "", "The Zipkin v2 collector URL spans are sent to, e.g. http://zipkin:9411/api/v2/spans; enables tracing")
 	flag.Parse()
 
+	level, err := logging.ParseLevel(logLevel)
+	if err != nil {
+		logging.Fatalf("%v", err)
+	}
+	logger, err := logging.New(os.Stderr, logFormat, level)
+	if err != nil {
+		logging.Fatalf("%v", err)
+	}
+	logging.SetDefault(logger.With("service", serviceName))
+	grpclog.SetLogger(logging.GRPCLogger())
+
+	// gRPC records the traces shown on /debug/requests only for the admin
+	// server.
+	grpc.EnableTracing = adminAddr != ""
+
 	hostname, err := os.Hostname()
 	if err != nil {
-		log.Fatal("Error getting hostname:", err)
+		logging.Fatalf("Error getting hostname: %v", err)
 	}
 
-	log.Println("Starting backend service ...")
-	log.Printf("gRPC server listening on: %s", grpcAddr)
-	log.Printf("Health server listening on: %s", healthAddr)
+	logging.Infof("Starting backend service ...")
+	logging.Infof("gRPC server listening on: %s", grpcAddr)
+	logging.Infof("Health server listening on: %s", healthAddr)
 
 	ln, err := net.Listen("tcp", grpcAddr)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatalf("%v", err)
+	}
+
+	var serverOpts []grpc.ServerOption
+	if tlsCert != "" || tlsKey != "" || tlsCA != "" {
+		certs, err := tlsutil.NewReloader(tlsCert, tlsKey, tlsCA)
+		if err != nil {
+			logging.Fatalf("%v", err)
+		}
+		go certs.Watch(tlsReloadInterval)
+
+		creds, err := certs.ServerCredentials(tlsClientAuth)
+		if err != nil {
+			logging.Fatalf("%v", err)
+		}
+		serverOpts = append(serverOpts, grpc.Creds(creds))
+		logging.Infof("TLS enabled, client certificates required: %t", tlsClientAuth)
+	} else if tlsClientAuth {
+		logging.Fatalf("-tls-client-auth requires -tls-cert, -tls-key and -tls-ca")
+	}
+
+	// Every call carries a trace context, extracted or generated.
+	unaryInterceptors := []grpc.UnaryServerInterceptor{
+		propagation.UnaryServerInterceptor(),
+		logging.UnaryServerInterceptor(),
+	}
+	streamInterceptors := []grpc.StreamServerInterceptor{
+		propagation.StreamServerInterceptor(),
+		logging.StreamServerInterceptor(),
+	}
+	accessLogger, err := service.NewAccessLogger(accesslog.Config{
+		Path:       accessLog,
+		Format:     accessLogFormat,
+		SampleRate: accessLogSampleRate,
+		MaxSize:    int64(accessLogMaxSize) << 20,
+		MaxBackups: accessLogMaxBackups,
+	})
+	if err != nil {
+		logging.Fatalf("%v", err)
+	}
+	if accessLogger != nil {
+		unaryInterceptors = append(unaryInterceptors, accessLogger.UnaryServerInterceptor())
+		streamInterceptors = append(streamInterceptors, accessLogger.StreamServerInterceptor())
+	}
+	tracer, err := service.NewTracer(service.TracingConfig{
+		ServiceName: serviceName,
+		Addr:        grpcAddr,
+		ZipkinURL:   zipkinURL,
+		File:        traceFile,
+		SampleRate:  traceSampleRate,
+	})
+	if err != nil {
+		logging.Fatalf("%v", err)
+	}
+	if tracer != nil {
+		unaryInterceptors = append(unaryInterceptors, tracer.UnaryServerInterceptor())
+		streamInterceptors = append(streamInterceptors, tracer.StreamServerInterceptor())
+	}
+	if authAPIKeys != "" || authJWTSecret != "" {
+		authenticator, err := auth.NewAuthenticator(auth.Config{
+			KeyFile:       authAPIKeys,
+			JWTSecretFile: authJWTSecret,
+			Issuer:        authJWTIssuer,
+			Audience:      authJWTAudience,
+		})
+		if err != nil {
+			logging.Fatalf("%v", err)
+		}
+		unaryInterceptors = append(unaryInterceptors, authenticator.UnaryServerInterceptor())
+		streamInterceptors = append(streamInterceptors, authenticator.StreamServerInterceptor())
+		logging.Infof("Bearer token authentication enabled")
+	}
+	if authzPolicy != "" {
+		if tlsCA == "" {
+			logging.Fatalf("-authz-policy requires -tls-cert, -tls-key and -tls-ca to verify client certificates")
+		}
+		policy, err := authz.LoadPolicy(authzPolicy)
+		if err != nil {
+			logging.Fatalf("%v", err)
+		}
+		unaryInterceptors = append(unaryInterceptors, policy.UnaryServerInterceptor())
+		streamInterceptors = append(streamInterceptors, policy.StreamServerInterceptor())
+		logging.Infof("Authorizing callers with policy %s", authzPolicy)
+	}
+	if rulesFile != "" {
+		engine, err := rules.Load(rulesFile)
+		if err != nil {
+			logging.Fatalf("%v", err)
+		}
+		go engine.Watch(rulesReloadInterval)
+		unaryInterceptors = append(unaryInterceptors, engine.UnaryServerInterceptor())
+		streamInterceptors = append(streamInterceptors, engine.StreamServerInterceptor())
+		logging.Infof("Applying rules from %s", rulesFile)
 	}
+	if rateLimits != "" {
+		limiter, err := ratelimit.Load(rateLimits)
+		if err != nil {
+			logging.Fatalf("%v", err)
+		}
+		unaryInterceptors = append(unaryInterceptors, limiter.UnaryServerInterceptor())
+		streamInterceptors = append(streamInterceptors, limiter.StreamServerInterceptor())
+		logging.Infof("Rate limiting callers with %s", rateLimits)
+	}
+	registry := metrics.NewRegistry()
+	metrics.RegisterProcessMetrics(registry)
+	serverOpts = append(serverOpts,
+		grpc.StatsHandler(metrics.NewServerMetrics(registry)),
+		grpc.UnaryInterceptor(middleware.ChainUnaryServer(unaryInterceptors...)),
+		grpc.StreamInterceptor(middleware.ChainStreamServer(streamInterceptors...)),
+	)
 
-	grpcServer := grpc.NewServer()
+	grpcServer := grpc.NewServer(serverOpts...)
 	ping.RegisterPingServer(grpcServer, &server{hostname, region, version})
 	reflection.Register(grpcServer)
 
@@ -70,26 +260,48 @@ func main() {
 	healthpb.RegisterHealthServer(grpcServer, grpcHealthServer)
 
 	go func() {
-		log.Fatal(grpcServer.Serve(ln))
+		logging.Fatalf("%v", grpcServer.Serve(ln))
 	}()
 
 	// Setup a HTTP server for health checks.
 	healthMux := http.NewServeMux()
 	healthMux.Handle("/health", httpHealthServer(grpcHealthServer))
+	healthMux.Handle("/metrics", registry)
 	healthServer := http.Server{Addr: healthAddr, Handler: healthMux}
 
 	go func() {
-		log.Fatal(healthServer.ListenAndServe())
+		if err := healthServer.ListenAndServe(); err != http.ErrServerClosed {
+			logging.Fatalf("%v", err)
+		}
 	}()
 
+	// Setup the opt-in admin HTTP server.
+	adminServer, err := service.NewAdminServer(adminAddr, adminTokenFile)
+	if err != nil {
+		logging.Fatalf("%v", err)
+	}
+	if adminServer != nil {
+		go func() {
+			if err := adminServer.ListenAndServe(); err != http.ErrServerClosed {
+				logging.Fatalf("%v", err)
+			}
+		}()
+	}
+
 	grpcHealthServer.SetServingStatus("ping.Ping", 1)
 
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 	<-signalChan
 
-	log.Printf("Shutdown signal received shutting down gracefully...")
+	logging.Infof("Shutdown signal received shutting down gracefully...")
 
 	grpcServer.GracefulStop()
 	healthServer.Shutdown(context.Background())
+	if adminServer != nil {
+		adminServer.Shutdown(context.Background())
+	}
+	if tracer != nil {
+		tracer.Close()
+	}
 }
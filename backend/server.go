@@ -14,9 +14,8 @@
 package main
 
 import (
-	"log"
-
 	"github.com/kelseyhightower/ping"
+	"github.com/kelseyhightower/ping/logging"
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
@@ -38,7 +37,7 @@ func (s *server) Ping(ctx context.Context, in *ping.Request) (*ping.Response, er
 	})
 
 	if err := grpc.SetTrailer(ctx, md); err != nil {
-		log.Printf("Error setting the response metadata: %v", err)
+		logging.FromContext(ctx).Errorf("Error setting the response metadata: %v", err)
 	}
 
 	return &ping.Response{Message: "pong"}, nil
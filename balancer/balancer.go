@@ -0,0 +1,346 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package balancer balances the calls of a gRPC client connection across
+// every endpoint of its target, rather than sending them all over the one
+// HTTP/2 connection to the first address the target resolves to.
+//
+// A Resolver resolves the target through DNS A and AAAA records, the SRV
+// records of a headless Kubernetes service or a static list, and resolves
+// it again on a schedule. A Balancer, installed with grpc.WithBalancer,
+// keeps a connection to every endpoint and picks one for every call with
+// its policy. Over TLS, its Credentials verify every endpoint against the
+// host it was resolved from.
+package balancer
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+
+	"github.com/kelseyhightower/ping/internal/random"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/naming"
+)
+
+// Policy is how a Balancer picks the endpoint of a call.
+type Policy string
+
+// The policies of a Balancer.
+const (
+	// RoundRobin picks the connected endpoints in turn.
+	RoundRobin Policy = "round-robin"
+	// Random picks a connected endpoint at random.
+	Random Policy = "random"
+	// LeastRequest picks the connected endpoint with the fewest calls in
+	// flight.
+	LeastRequest Policy = "least-request"
+	// P2C picks two connected endpoints at random and keeps the one with
+	// fewer calls in flight.
+	P2C Policy = "p2c"
+)
+
+// ParsePolicy returns the policy named s.
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case RoundRobin, Random, LeastRequest, P2C:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown load balancing policy %q, must be %s, %s, %s or %s", s, RoundRobin, Random, LeastRequest, P2C)
+}
+
+// Filter may reject the endpoint at addr picked for the call of ctx, such
+// as one whose circuit breaker is open. The Balancer then picks another
+// endpoint.
+type Filter func(ctx context.Context, addr string) error
+
+// endpoint is an address of the target.
+type endpoint struct {
+	addr      grpc.Address
+	connected bool
+	inFlight  int
+}
+
+// Balancer is a grpc.Balancer that balances calls across the addresses of
+// the target with a policy. It is modelled on grpc.RoundRobin.
+type Balancer struct {
+	r      naming.Resolver
+	policy Policy
+	filter Filter
+
+	mu        sync.Mutex
+	w         naming.Watcher
+	endpoints []*endpoint
+	addrCh    chan []grpc.Address
+	// next is the round-robin counter.
+	next int
+	// waitCh is closed when an endpoint connects, to wake up the calls
+	// that wait for one.
+	waitCh chan struct{}
+	done   bool
+	rnd    *rand.Rand
+}
+
+// New returns a balancer that watches the addresses of the target with r
+// and picks them with policy. filter may be nil.
+func New(r naming.Resolver, policy Policy, filter Filter) *Balancer {
+	return &Balancer{
+		r:      r,
+		policy: policy,
+		filter: filter,
+		rnd:    random.New(),
+	}
+}
+
+// Start starts watching the addresses of target.
+func (b *Balancer) Start(target string, config grpc.BalancerConfig) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done {
+		return grpc.ErrClientConnClosing
+	}
+	w, err := b.r.Resolve(target)
+	if err != nil {
+		return err
+	}
+	b.w = w
+	b.addrCh = make(chan []grpc.Address)
+	go func() {
+		for {
+			if err := b.watchAddrUpdates(); err != nil {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// watchAddrUpdates applies the next updates of the watcher and sends the
+// new addresses to gRPC, which connects to them.
+func (b *Balancer) watchAddrUpdates() error {
+	updates, err := b.w.Next()
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, u := range updates {
+		addr := grpc.Address{Addr: u.Addr, Metadata: u.Metadata}
+		switch u.Op {
+		case naming.Add:
+			if b.find(addr) < 0 {
+				b.endpoints = append(b.endpoints, &endpoint{addr: addr})
+			}
+		case naming.Delete:
+			if i := b.find(addr); i >= 0 {
+				b.endpoints = append(b.endpoints[:i], b.endpoints[i+1:]...)
+			}
+		}
+	}
+	if b.done {
+		return grpc.ErrClientConnClosing
+	}
+	addrs := make([]grpc.Address, len(b.endpoints))
+	for i, e := range b.endpoints {
+		addrs[i] = e.addr
+	}
+	b.addrCh <- addrs
+	return nil
+}
+
+// find returns the index of the endpoint of addr, or -1. b.mu must be
+// held.
+func (b *Balancer) find(addr grpc.Address) int {
+	for i, e := range b.endpoints {
+		if e.addr == addr {
+			return i
+		}
+	}
+	return -1
+}
+
+// host returns the host the endpoint at addr was resolved from.
+func (b *Balancer) host(addr string) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, e := range b.endpoints {
+		if e.addr.Addr == addr {
+			host, ok := e.addr.Metadata.(string)
+			return host, ok && host != ""
+		}
+	}
+	return "", false
+}
+
+// Up marks addr connected and wakes up the calls waiting for an endpoint.
+func (b *Balancer) Up(addr grpc.Address) func(error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i := b.find(addr)
+	if i < 0 || b.endpoints[i].connected {
+		return nil
+	}
+	b.endpoints[i].connected = true
+	if b.waitCh != nil {
+		close(b.waitCh)
+		b.waitCh = nil
+	}
+	return func(error) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if i := b.find(addr); i >= 0 {
+			b.endpoints[i].connected = false
+		}
+	}
+}
+
+// Get picks the endpoint of a call among the connected ones. If there is
+// none, a fail-fast call gets the next address in turn, which fails it
+// unless the address has just connected, and other calls wait for an
+// endpoint to connect.
+func (b *Balancer) Get(ctx context.Context, opts grpc.BalancerGetOptions) (addr grpc.Address, put func(), err error) {
+	rejected := make(map[*endpoint]bool)
+	var rejectErr error
+	b.mu.Lock()
+	for {
+		if b.done {
+			b.mu.Unlock()
+			return grpc.Address{}, nil, grpc.ErrClientConnClosing
+		}
+
+		var candidates []*endpoint
+		for _, e := range b.endpoints {
+			if e.connected && !rejected[e] {
+				candidates = append(candidates, e)
+			}
+		}
+		if len(candidates) > 0 {
+			e := b.pick(candidates)
+			e.inFlight++
+			b.mu.Unlock()
+			put := func() {
+				b.mu.Lock()
+				e.inFlight--
+				b.mu.Unlock()
+			}
+			if b.filter == nil {
+				return e.addr, put, nil
+			}
+			if err := b.filter(ctx, e.addr.Addr); err != nil {
+				put()
+				rejected[e] = true
+				rejectErr = err
+				b.mu.Lock()
+				continue
+			}
+			return e.addr, put, nil
+		}
+		if rejectErr != nil {
+			// Every connected endpoint rejected the call.
+			b.mu.Unlock()
+			return grpc.Address{}, nil, rejectErr
+		}
+
+		if !opts.BlockingWait {
+			defer b.mu.Unlock()
+			if len(b.endpoints) == 0 {
+				return grpc.Address{}, nil, grpc.Errorf(codes.Unavailable, "there is no address available")
+			}
+			b.next++
+			return b.endpoints[b.next%len(b.endpoints)].addr, nil, nil
+		}
+
+		if b.waitCh == nil {
+			b.waitCh = make(chan struct{})
+		}
+		ch := b.waitCh
+		b.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return grpc.Address{}, nil, ctx.Err()
+		case <-ch:
+		}
+		b.mu.Lock()
+	}
+}
+
+// pick picks one of candidates with the policy. b.mu must be held.
+func (b *Balancer) pick(candidates []*endpoint) *endpoint {
+	n := len(candidates)
+	switch b.policy {
+	case Random:
+		return candidates[b.rnd.Intn(n)]
+	case LeastRequest:
+		// Ties are broken at random, so that idle endpoints share the
+		// calls.
+		var best *endpoint
+		ties := 0
+		for _, e := range candidates {
+			switch {
+			case best == nil || e.inFlight < best.inFlight:
+				best, ties = e, 1
+			case e.inFlight == best.inFlight:
+				ties++
+				if b.rnd.Intn(ties) == 0 {
+					best = e
+				}
+			}
+		}
+		return best
+	case P2C:
+		if n == 1 {
+			return candidates[0]
+		}
+		i := b.rnd.Intn(n)
+		j := b.rnd.Intn(n - 1)
+		if j >= i {
+			j++
+		}
+		if candidates[j].inFlight < candidates[i].inFlight {
+			return candidates[j]
+		}
+		return candidates[i]
+	}
+	b.next++
+	return candidates[b.next%n]
+}
+
+// Notify returns the channel on which gRPC receives the addresses to
+// connect to.
+func (b *Balancer) Notify() <-chan []grpc.Address {
+	return b.addrCh
+}
+
+// Close stops watching the addresses and fails the waiting calls.
+func (b *Balancer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done {
+		return nil
+	}
+	b.done = true
+	if b.w != nil {
+		b.w.Close()
+	}
+	if b.waitCh != nil {
+		close(b.waitCh)
+		b.waitCh = nil
+	}
+	if b.addrCh != nil {
+		close(b.addrCh)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package balancer
+
+import (
+	"net"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/credentials"
+)
+
+// Credentials returns creds for the connections of the balancer. The
+// balancer dials the IP addresses of the endpoints, which the TLS
+// credentials of gRPC would verify the server certificates against:
+// instead, the certificate of every endpoint is verified against the host
+// it was resolved from, and the calls carry authority as their :authority.
+// creds must not name a server.
+func (b *Balancer) Credentials(creds credentials.TransportCredentials, authority string) credentials.TransportCredentials {
+	return &endpointCredentials{TransportCredentials: creds, b: b, authority: authority}
+}
+
+type endpointCredentials struct {
+	credentials.TransportCredentials
+	b         *Balancer
+	authority string
+}
+
+// ClientHandshake performs the handshake with the endpoint at addr as if it
+// was dialed by the name of its host, which the TLS credentials verify the
+// server certificate against. An address the balancer no longer knows is
+// verified as is, and fails unless the certificate is issued for it.
+func (c *endpointCredentials) ClientHandshake(ctx context.Context, addr string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	if host, ok := c.b.host(addr); ok {
+		if _, port, err := net.SplitHostPort(addr); err == nil {
+			addr = net.JoinHostPort(host, port)
+		}
+	}
+	return c.TransportCredentials.ClientHandshake(ctx, addr, rawConn)
+}
+
+// Info returns the protocol information of the wrapped credentials. gRPC
+// uses its server name as the :authority of the calls.
+func (c *endpointCredentials) Info() credentials.ProtocolInfo {
+	info := c.TransportCredentials.Info()
+	info.ServerName = c.authority
+	return info
+}
+
+func (c *endpointCredentials) Clone() credentials.TransportCredentials {
+	return &endpointCredentials{TransportCredentials: c.TransportCredentials.Clone(), b: c.b, authority: c.authority}
+}
+
+func (c *endpointCredentials) OverrideServerName(serverName string) error {
+	c.authority = serverName
+	return nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package balancer
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Resolve modes.
+const (
+	// Auto resolves a comma-separated list as List and anything else as
+	// DNS.
+	Auto = "auto"
+	// DNS resolves the host of a host:port target with A and AAAA
+	// lookups.
+	DNS = "dns"
+	// SRV resolves the name of an SRV record, such as
+	// _grpc._tcp.bar.default.svc.cluster.local, whose targets are
+	// resolved in turn.
+	SRV = "srv"
+	// List uses a comma-separated list of addresses as is.
+	List = "list"
+)
+
+// Endpoint is a single address behind a target.
+type Endpoint struct {
+	// Addr is the ip:port that is dialed.
+	Addr string
+	// Host is the name Addr was resolved from. It is used to verify the
+	// server certificate.
+	Host string
+}
+
+// Resolve expands target into the endpoints behind it, sorted by address
+// and without duplicates, using one of the resolve modes.
+func Resolve(target, mode string) ([]Endpoint, error) {
+	if mode == Auto {
+		mode = DNS
+		if strings.Contains(target, ",") {
+			mode = List
+		}
+	}
+
+	var endpoints []Endpoint
+	switch mode {
+	case List:
+		for _, addr := range strings.Split(target, ",") {
+			addr = strings.TrimSpace(addr)
+			if addr == "" {
+				continue
+			}
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			endpoints = append(endpoints, Endpoint{addr, host})
+		}
+	case DNS:
+		host, port, err := net.SplitHostPort(target)
+		if err != nil {
+			return nil, err
+		}
+		endpoints, err = lookupHost(host, port)
+		if err != nil {
+			return nil, err
+		}
+	case SRV:
+		_, records, err := net.LookupSRV("", "", target)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range records {
+			host := strings.TrimSuffix(srv.Target, ".")
+			e, err := lookupHost(host, strconv.Itoa(int(srv.Port)))
+			if err != nil {
+				return nil, err
+			}
+			endpoints = append(endpoints, e...)
+		}
+	default:
+		return nil, checkMode(mode)
+	}
+
+	// The same address may be listed twice, or returned by several SRV
+	// records.
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].Addr < endpoints[j].Addr })
+	unique := endpoints[:0]
+	for i, e := range endpoints {
+		if i > 0 && e.Addr == endpoints[i-1].Addr {
+			continue
+		}
+		unique = append(unique, e)
+	}
+	if len(unique) == 0 {
+		return nil, fmt.Errorf("%s did not resolve to any endpoints", target)
+	}
+	return unique, nil
+}
+
+// Authority returns the :authority of the calls to the endpoints of
+// target: the target itself, or the first address of a list, which is a
+// single endpoint the calls may go to.
+func Authority(target, mode string) string {
+	if mode == List || mode == Auto && strings.Contains(target, ",") {
+		for _, addr := range strings.Split(target, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				return addr
+			}
+		}
+	}
+	return target
+}
+
+// checkMode returns an error if mode is not a resolve mode.
+func checkMode(mode string) error {
+	switch mode {
+	case Auto, DNS, SRV, List:
+		return nil
+	}
+	return fmt.Errorf("unknown resolve mode %q, must be %s, %s, %s or %s", mode, Auto, DNS, SRV, List)
+}
+
+func lookupHost(host, port string) ([]Endpoint, error) {
+	if net.ParseIP(host) != nil {
+		return []Endpoint{{net.JoinHostPort(host, port), host}}, nil
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []Endpoint
+	for _, ip := range ips {
+		endpoints = append(endpoints, Endpoint{net.JoinHostPort(ip.String(), port), host})
+	}
+	return endpoints, nil
+}
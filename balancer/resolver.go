@@ -0,0 +1,156 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package balancer
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kelseyhightower/ping/logging"
+
+	"google.golang.org/grpc/naming"
+)
+
+// retryInterval is how long a watcher waits before resolving again when
+// its target has not resolved yet.
+const retryInterval = time.Second
+
+var errWatcherClosed = errors.New("balancer: the watcher is closed")
+
+// Resolver resolves targets with Resolve and resolves them again every
+// Interval. It is a naming.Resolver.
+type Resolver struct {
+	// Mode is the resolve mode: Auto, DNS, SRV or List.
+	Mode string
+	// Interval is how often a target is resolved again. It must be
+	// positive.
+	Interval time.Duration
+	// Notify, if not nil, is called with the addresses of a target every
+	// time they change.
+	Notify func(addrs []string)
+}
+
+// Resolve returns a watcher of the addresses of target.
+func (r *Resolver) Resolve(target string) (naming.Watcher, error) {
+	if err := checkMode(r.Mode); err != nil {
+		return nil, err
+	}
+	return &watcher{
+		r:      r,
+		target: target,
+		addrs:  make(map[string]string),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// watcher resolves a target on a schedule and reports the addresses that
+// were added and deleted. A failed resolution keeps the previous
+// addresses. The metadata of an address is the host it was resolved from,
+// see Credentials.
+type watcher struct {
+	r      *Resolver
+	target string
+
+	// addrs, the hosts by address, and resolved are only used by the
+	// goroutine that calls Next.
+	addrs    map[string]string
+	resolved bool
+
+	done chan struct{}
+	once sync.Once
+}
+
+// Next blocks until the addresses of the target change. The first call
+// resolves the target right away.
+func (w *watcher) Next() ([]*naming.Update, error) {
+	var delay time.Duration
+	if w.resolved {
+		delay = w.r.Interval
+	}
+	for {
+		if delay > 0 {
+			t := time.NewTimer(delay)
+			select {
+			case <-w.done:
+				t.Stop()
+				return nil, errWatcherClosed
+			case <-t.C:
+			}
+		}
+		select {
+		case <-w.done:
+			return nil, errWatcherClosed
+		default:
+		}
+
+		endpoints, err := Resolve(w.target, w.r.Mode)
+		if err != nil {
+			delay = w.r.Interval
+			if !w.resolved {
+				delay = retryInterval
+			}
+			logging.Warnf("Error resolving %s, retrying in %s: %v", w.target, delay, err)
+			continue
+		}
+		w.resolved = true
+		delay = w.r.Interval
+		if updates := w.update(endpoints); len(updates) > 0 {
+			return updates, nil
+		}
+	}
+}
+
+// update replaces the addresses of the watcher with those of endpoints,
+// and returns the differences.
+func (w *watcher) update(endpoints []Endpoint) []*naming.Update {
+	var updates []*naming.Update
+	addrs := make(map[string]string, len(endpoints))
+	for _, e := range endpoints {
+		addrs[e.Addr] = e.Host
+	}
+	// An address whose host changed is deleted and added again, as gRPC
+	// tells addresses apart by their metadata too.
+	for addr, host := range w.addrs {
+		if h, ok := addrs[addr]; !ok || h != host {
+			updates = append(updates, &naming.Update{Op: naming.Delete, Addr: addr, Metadata: host})
+		}
+	}
+	for _, e := range endpoints {
+		if h, ok := w.addrs[e.Addr]; !ok || h != e.Host {
+			updates = append(updates, &naming.Update{Op: naming.Add, Addr: e.Addr, Metadata: e.Host})
+		}
+	}
+	w.addrs = addrs
+	if len(updates) == 0 {
+		return nil
+	}
+
+	list := make([]string, 0, len(addrs))
+	for addr := range addrs {
+		list = append(list, addr)
+	}
+	sort.Strings(list)
+	logging.Infof("Resolved %s to %v", w.target, list)
+	if w.r.Notify != nil {
+		w.r.Notify(list)
+	}
+	return updates
+}
+
+// Close stops the watcher. A pending Next returns an error.
+func (w *watcher) Close() {
+	w.once.Do(func() { close(w.done) })
+}
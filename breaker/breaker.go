@@ -0,0 +1,441 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package breaker implements client-side circuit breakers for the calls of
+// the frontend to its downstream services, equivalent to the simpleCb
+// circuit breaker of the Istio destination policies.
+//
+// Every endpoint of a downstream has a breaker. It opens after a number of
+// consecutive server errors and then fails calls fast with UNAVAILABLE for
+// a sleep window. After the window it is half-open and lets a single trial
+// call through: if it succeeds the breaker closes, otherwise it opens for
+// another window. At most a percentage of the endpoints of a downstream,
+// but always at least one, may be open at once.
+//
+// Without load balancing a downstream has a single endpoint, its target.
+// When its calls are balanced by the balancer package, every address of
+// the target is an endpoint, and Allow is the filter of the balancer so
+// that calls skip the endpoints whose breaker is open.
+//
+// The calls a breaker rejects were not sent, and retrying them only hits
+// the same breaker, so their errors are marked: see IsRejected.
+package breaker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kelseyhightower/ping/logging"
+	"github.com/kelseyhightower/ping/metrics"
+
+	"github.com/golang/protobuf/ptypes"
+	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// State is the state of a breaker.
+type State int
+
+// The states of a breaker. The values are those of the
+// grpc_client_circuit_breaker_state metric.
+const (
+	Closed State = iota
+	Open
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// MarshalText encodes s as its name.
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// errorCodes are the codes of server errors, which count towards opening a
+// breaker. Other codes, such as CANCELLED for the losers of hedged
+// requests, are the caller's doing.
+var errorCodes = map[codes.Code]bool{
+	codes.Unknown:          true,
+	codes.DeadlineExceeded: true,
+	codes.Internal:         true,
+	codes.Unavailable:      true,
+	codes.DataLoss:         true,
+}
+
+// Config configures the breakers of a downstream.
+type Config struct {
+	// ConsecutiveErrors is the number of consecutive server errors that
+	// opens a breaker. Breakers are disabled if it is 0.
+	ConsecutiveErrors int
+	// SleepWindow is how long an open breaker fails calls before it lets
+	// a trial call through.
+	SleepWindow time.Duration
+	// MaxEjectionPercent is the percentage of the endpoints that may be
+	// open at once.
+	MaxEjectionPercent int
+	// Balanced is set when the calls are balanced across the addresses of
+	// the target, which then have a breaker each.
+	Balanced bool
+}
+
+// Group holds the breakers of the endpoints of a downstream.
+type Group struct {
+	name    string
+	target  string
+	cfg     Config
+	metrics *metrics.ClientMetrics
+
+	mu       sync.Mutex
+	breakers map[string]*Breaker
+}
+
+// NewGroup returns the breakers of the downstream name at target. m, if
+// not nil, records their states and the calls they reject.
+func NewGroup(name, target string, cfg Config, m *metrics.ClientMetrics) *Group {
+	g := &Group{
+		name:     name,
+		target:   target,
+		cfg:      cfg,
+		metrics:  m,
+		breakers: make(map[string]*Breaker),
+	}
+	if !cfg.Balanced {
+		g.Breaker(target)
+	}
+	return g
+}
+
+// Name returns the name of the downstream.
+func (g *Group) Name() string {
+	return g.name
+}
+
+// Breaker returns the breaker of endpoint, creating it if needed.
+func (g *Group) Breaker(endpoint string) *Breaker {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	b, ok := g.breakers[endpoint]
+	if !ok {
+		b = &Breaker{group: g, endpoint: endpoint}
+		g.breakers[endpoint] = b
+		if g.metrics != nil {
+			g.metrics.SetBreakerState(g.name, endpoint, int(Closed))
+		}
+	}
+	return b
+}
+
+// SetEndpoints sets the endpoints of a balanced downstream, adding and
+// removing breakers as the addresses of its target change.
+func (g *Group) SetEndpoints(endpoints []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	keep := make(map[string]bool, len(endpoints))
+	for _, endpoint := range endpoints {
+		keep[endpoint] = true
+		if _, ok := g.breakers[endpoint]; !ok {
+			g.breakers[endpoint] = &Breaker{group: g, endpoint: endpoint}
+			if g.metrics != nil {
+				g.metrics.SetBreakerState(g.name, endpoint, int(Closed))
+			}
+		}
+	}
+	for endpoint, b := range g.breakers {
+		if keep[endpoint] {
+			continue
+		}
+		b.mu.Lock()
+		b.removed = true
+		b.mu.Unlock()
+		delete(g.breakers, endpoint)
+		if g.metrics != nil {
+			g.metrics.DeleteBreakerState(g.name, endpoint)
+		}
+	}
+}
+
+// States returns the state of every breaker, keyed by endpoint.
+func (g *Group) States() map[string]State {
+	g.mu.Lock()
+	breakers := make([]*Breaker, 0, len(g.breakers))
+	for _, b := range g.breakers {
+		breakers = append(breakers, b)
+	}
+	g.mu.Unlock()
+
+	states := make(map[string]State, len(breakers))
+	for _, b := range breakers {
+		states[b.endpoint] = b.State()
+	}
+	return states
+}
+
+// mayEject reports whether another breaker may open. It must be called
+// with g.mu held.
+func (g *Group) mayEject() bool {
+	open := 0
+	for _, b := range g.breakers {
+		if b.ejected {
+			open++
+		}
+	}
+	max := len(g.breakers) * g.cfg.MaxEjectionPercent / 100
+	if max < 1 {
+		max = 1
+	}
+	return open < max
+}
+
+// UnaryClientInterceptor returns an interceptor that passes every call
+// through the breaker of the downstream's target. It fails calls fast
+// while the breaker is open. If the downstream is balanced, it records
+// the result of every call with the breaker of the endpoint that Allow
+// let it through.
+func (g *Group) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if g.cfg.Balanced {
+			c := &call{}
+			err := invoker(context.WithValue(ctx, callKey{}, c), method, req, reply, cc, opts...)
+			switch {
+			case c.done != nil:
+				c.done(err)
+			case c.rejected:
+				g.reject()
+			}
+			return err
+		}
+
+		b := g.Breaker(g.target)
+		done, err := b.Allow()
+		if err != nil {
+			return err
+		}
+		err = invoker(ctx, method, req, reply, cc, opts...)
+		done(err)
+		return err
+	}
+}
+
+type callKey struct{}
+
+// call is the breaker a balanced call was let through, as recorded by
+// Allow.
+type call struct {
+	breaker *Breaker
+	done    func(error)
+	// rejected is set if the last endpoint picked for the call rejected
+	// it.
+	rejected bool
+}
+
+// Allow returns an UNAVAILABLE error if the breaker of the endpoint at
+// addr rejects the call of ctx. It is the filter of the balancer of a
+// balanced downstream.
+func (g *Group) Allow(ctx context.Context, addr string) error {
+	b := g.Breaker(addr)
+	done, err := b.allow()
+	c, _ := ctx.Value(callKey{}).(*call)
+	if err != nil {
+		if c != nil {
+			c.rejected = true
+		}
+		return err
+	}
+	if c == nil {
+		// The result of the call cannot be recorded.
+		b.release()
+		return nil
+	}
+	if c.done != nil {
+		// gRPC picks another endpoint when the connection to the first
+		// one was lost before the call was sent.
+		c.breaker.release()
+	}
+	c.breaker, c.done, c.rejected = b, done, false
+	return nil
+}
+
+func (g *Group) reject() {
+	if g.metrics != nil {
+		g.metrics.RecordBreakerRejected(g.name)
+	}
+}
+
+// Breaker is the circuit breaker of an endpoint. Its ejected field is
+// guarded by the mutex of its group, the rest by its own.
+type Breaker struct {
+	group    *Group
+	endpoint string
+	ejected  bool
+
+	mu       sync.Mutex
+	state    State
+	errors   int
+	openedAt time.Time
+	// trial is set while the trial call of a half-open breaker is in
+	// flight.
+	trial bool
+	// removed is set once the endpoint is no longer an address of the
+	// target.
+	removed bool
+}
+
+// State returns the state of b. An open breaker whose sleep window has
+// passed is reported half-open.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == Open && time.Since(b.openedAt) >= b.group.cfg.SleepWindow {
+		return HalfOpen
+	}
+	return b.state
+}
+
+// Allow returns an UNAVAILABLE error if b rejects a call. Otherwise the
+// caller must pass the result of the call to done.
+func (b *Breaker) Allow() (done func(error), err error) {
+	done, err = b.allow()
+	if err != nil {
+		b.group.reject()
+	}
+	return done, err
+}
+
+// allow is Allow without recording the rejected calls.
+func (b *Breaker) allow() (done func(error), err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case Open:
+		wait := b.group.cfg.SleepWindow - time.Since(b.openedAt)
+		if wait > 0 {
+			return nil, b.rejected(
+				"the circuit breaker of %s (%s) is open after %d consecutive errors, next trial call in %s",
+				b.group.name, b.endpoint, b.group.cfg.ConsecutiveErrors, wait.Round(time.Millisecond))
+		}
+		b.setState(HalfOpen)
+		fallthrough
+	case HalfOpen:
+		if b.trial {
+			return nil, b.rejected(
+				"the circuit breaker of %s (%s) is half-open and waiting for its trial call",
+				b.group.name, b.endpoint)
+		}
+		b.trial = true
+	}
+	return b.done, nil
+}
+
+// rejectedType is the resource type of the google.rpc.ResourceInfo detail
+// that marks the errors of rejected calls.
+const rejectedType = "circuit-breaker"
+
+// rejected returns the UNAVAILABLE error of a call that b rejects.
+func (b *Breaker) rejected(format string, args ...interface{}) error {
+	st := status.Newf(codes.Unavailable, format, args...).Proto()
+	detail, err := ptypes.MarshalAny(&errdetails.ResourceInfo{
+		ResourceType: rejectedType,
+		ResourceName: b.endpoint,
+		Owner:        b.group.name,
+	})
+	if err == nil {
+		st.Details = append(st.Details, detail)
+	}
+	return status.ErrorProto(st)
+}
+
+// IsRejected reports whether err is the error of a call that a circuit
+// breaker rejected.
+func IsRejected(err error) bool {
+	s, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+	for _, detail := range s.Proto().GetDetails() {
+		var info errdetails.ResourceInfo
+		if ptypes.UnmarshalAny(detail, &info) == nil && info.GetResourceType() == rejectedType {
+			return true
+		}
+	}
+	return false
+}
+
+// release lets another trial call through, when the result of the one
+// that was allowed will not be recorded.
+func (b *Breaker) release() {
+	b.mu.Lock()
+	b.trial = false
+	b.mu.Unlock()
+}
+
+// done records the result of a call that b allowed.
+func (b *Breaker) done(err error) {
+	b.group.mu.Lock()
+	defer b.group.mu.Unlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	trial := b.trial
+	b.trial = false
+	if grpc.Code(err) == codes.Canceled {
+		// The caller gave up, which says nothing about the endpoint.
+		return
+	}
+	if !errorCodes[grpc.Code(err)] {
+		b.errors = 0
+		if b.state != Closed {
+			logging.Infof("Closed the circuit breaker of %s (%s)", b.group.name, b.endpoint)
+			b.ejected = false
+			b.setState(Closed)
+		}
+		return
+	}
+
+	b.errors++
+	switch {
+	case b.state == HalfOpen && trial:
+		logging.Warnf("Reopened the circuit breaker of %s (%s): the trial call failed: %v", b.group.name, b.endpoint, err)
+		b.openedAt = time.Now()
+		b.setState(Open)
+	case b.state == Closed && b.errors >= b.group.cfg.ConsecutiveErrors:
+		if !b.group.mayEject() {
+			return
+		}
+		logging.Warnf("Opened the circuit breaker of %s (%s) after %d consecutive errors: %v", b.group.name, b.endpoint, b.errors, err)
+		b.ejected = true
+		b.openedAt = time.Now()
+		b.setState(Open)
+	}
+}
+
+func (b *Breaker) setState(s State) {
+	b.state = s
+	if m := b.group.metrics; m != nil && !b.removed {
+		m.SetBreakerState(b.group.name, b.endpoint, int(s))
+	}
+}
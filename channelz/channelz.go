@@ -0,0 +1,335 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package channelz reports the state of the long-lived gRPC client
+// connections of a service, like a lightweight channelz: their target, the
+// addresses it resolves to, the transitions of their connectivity state
+// and the number of calls in flight, succeeded and failed.
+//
+// The vendored gRPC does not expose the state of a connection, so a
+// Channel tracks it through its dialer: a connection is CONNECTING while
+// it is dialed, READY once its TCP connection is established and
+// TRANSIENT_FAILURE when dialing fails or the connection breaks. A
+// load-balanced connection holds a connection to every address of its
+// target: it is READY while any of them is.
+//
+// The dialer replaces the one of gRPC, so it dials like gRPC does: through
+// the proxy named by HTTPS_PROXY, unless NO_PROXY exempts the address, and
+// it gives up when the channel is closed. It adds a little work to every
+// connection, so services only install it when the state is reported.
+package channelz
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// maxTransitions is the number of state transitions a channel keeps.
+const maxTransitions = 32
+
+// Transition is a change of the connectivity state of a channel.
+type Transition struct {
+	Time    time.Time `json:"time"`
+	State   string    `json:"state"`
+	Address string    `json:"address,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// Info is a snapshot of a channel.
+type Info struct {
+	Name        string       `json:"name"`
+	Target      string       `json:"target"`
+	State       string       `json:"state"`
+	Addresses   []string     `json:"addresses"`
+	Connected   []string     `json:"connected,omitempty"`
+	InFlight    int64        `json:"in_flight"`
+	Succeeded   int64        `json:"succeeded"`
+	Failed      int64        `json:"failed"`
+	LastCall    *time.Time   `json:"last_call,omitempty"`
+	Transitions []Transition `json:"transitions"`
+}
+
+// Channel tracks a gRPC client connection. Its Dialer and
+// UnaryClientInterceptor must be installed on the connection.
+type Channel struct {
+	name   string
+	target string
+	// ctx is canceled when the channel is closed, to abort pending dials.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	inFlight  int64
+	succeeded int64
+	failed    int64
+
+	mu        sync.Mutex
+	state     grpc.ConnectivityState
+	addresses []string
+	// resolved is set once the addresses are set by SetAddresses rather
+	// than by the dialer.
+	resolved    bool
+	conns       map[*trackedConn]bool
+	lastCall    time.Time
+	transitions []Transition
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]*Channel)
+)
+
+// NewChannel returns the channel of the connection named name to target,
+// and registers it so that it is reported by Handler.
+func NewChannel(name, target string) *Channel {
+	c := &Channel{name: name, target: target, addresses: []string{}, conns: make(map[*trackedConn]bool)}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.transition(grpc.Idle, "", nil)
+	registryMu.Lock()
+	registry[name] = c
+	registryMu.Unlock()
+	return c
+}
+
+// Channels returns the registered channels, sorted by name.
+func Channels() []*Channel {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	channels := make([]*Channel, 0, len(registry))
+	for _, c := range registry {
+		channels = append(channels, c)
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i].name < channels[j].name })
+	return channels
+}
+
+// transition records a new state of the connection to address. The
+// channel stays READY while it has another connection. c.mu must be held,
+// except by NewChannel.
+func (c *Channel) transition(state grpc.ConnectivityState, address string, err error) {
+	c.state = state
+	if state != grpc.Shutdown && len(c.conns) > 0 {
+		c.state = grpc.Ready
+	}
+	t := Transition{Time: time.Now(), State: state.String(), Address: address}
+	if err != nil {
+		t.Error = err.Error()
+	}
+	c.transitions = append(c.transitions, t)
+	if len(c.transitions) > maxTransitions {
+		c.transitions = c.transitions[len(c.transitions)-maxTransitions:]
+	}
+}
+
+// Dialer returns the dialer of the connection, installed with
+// grpc.WithDialer. Dialing the same channel again adds a connection rather
+// than replacing it, as a balancer dials every address of the target.
+func (c *Channel) Dialer() func(addr string, timeout time.Duration) (net.Conn, error) {
+	return func(addr string, timeout time.Duration) (net.Conn, error) {
+		c.mu.Lock()
+		if c.state == grpc.Shutdown {
+			c.mu.Unlock()
+			return nil, fmt.Errorf("channelz: %s is shut down", c.name)
+		}
+		if !c.resolved {
+			c.addresses = []string{addr}
+		}
+		c.transition(grpc.Connecting, addr, nil)
+		c.mu.Unlock()
+
+		ctx := c.ctx
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		conn, err := dialProxy(ctx, addr)
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if err != nil {
+			if c.state != grpc.Shutdown {
+				c.transition(grpc.TransientFailure, addr, err)
+			}
+			return nil, err
+		}
+		t := &trackedConn{Conn: conn, c: c, addr: addr}
+		c.conns[t] = true
+		c.transition(grpc.Ready, addr, nil)
+		return t, nil
+	}
+}
+
+// SetAddresses sets the addresses the target resolved to, for a
+// connection whose balancer resolves the target itself and dials the
+// addresses one by one.
+func (c *Channel) SetAddresses(addrs []string) {
+	c.mu.Lock()
+	c.addresses = append([]string{}, addrs...)
+	c.resolved = true
+	c.mu.Unlock()
+}
+
+// trackedConn reports the end of a connection to its channel.
+type trackedConn struct {
+	net.Conn
+	c *Channel
+	// addr is the address that was dialed, which is not the remote
+	// address of the connection when it goes through a proxy.
+	addr string
+	once sync.Once
+}
+
+func (t *trackedConn) Read(b []byte) (int, error) {
+	n, err := t.Conn.Read(b)
+	if err != nil {
+		t.end(err)
+	}
+	return n, err
+}
+
+func (t *trackedConn) Close() error {
+	t.end(nil)
+	return t.Conn.Close()
+}
+
+// end records that the connection is no longer usable, unless the channel
+// is shut down.
+func (t *trackedConn) end(err error) {
+	t.once.Do(func() {
+		t.c.mu.Lock()
+		defer t.c.mu.Unlock()
+		if !t.c.conns[t] || t.c.state == grpc.Shutdown {
+			return
+		}
+		if err == nil || err == io.EOF {
+			err = fmt.Errorf("connection closed")
+		}
+		delete(t.c.conns, t)
+		t.c.transition(grpc.TransientFailure, t.addr, err)
+	})
+}
+
+// Close records that the connection was closed.
+func (c *Channel) Close() {
+	c.cancel()
+	c.mu.Lock()
+	c.conns = make(map[*trackedConn]bool)
+	c.transition(grpc.Shutdown, "", nil)
+	c.mu.Unlock()
+}
+
+// UnaryClientInterceptor returns an interceptor that counts the calls of
+// the connection.
+func (c *Channel) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		atomic.AddInt64(&c.inFlight, 1)
+		c.mu.Lock()
+		c.lastCall = time.Now()
+		c.mu.Unlock()
+
+		err := invoker(ctx, method, req, reply, cc, opts...)
+
+		atomic.AddInt64(&c.inFlight, -1)
+		if err != nil {
+			atomic.AddInt64(&c.failed, 1)
+		} else {
+			atomic.AddInt64(&c.succeeded, 1)
+		}
+		return err
+	}
+}
+
+// Info returns a snapshot of the channel.
+func (c *Channel) Info() *Info {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info := &Info{
+		Name:        c.name,
+		Target:      c.target,
+		State:       c.state.String(),
+		Addresses:   append([]string(nil), c.addresses...),
+		InFlight:    atomic.LoadInt64(&c.inFlight),
+		Succeeded:   atomic.LoadInt64(&c.succeeded),
+		Failed:      atomic.LoadInt64(&c.failed),
+		Transitions: append([]Transition(nil), c.transitions...),
+	}
+	for t := range c.conns {
+		info.Connected = append(info.Connected, t.addr)
+	}
+	sort.Strings(info.Connected)
+	if !c.lastCall.IsZero() {
+		t := c.lastCall
+		info.LastCall = &t
+	}
+	return info
+}
+
+// WriteText writes info in a human readable form.
+func (info *Info) WriteText(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Channel:\t%s\n", info.Name)
+	fmt.Fprintf(tw, "Target:\t%s\n", info.Target)
+	fmt.Fprintf(tw, "State:\t%s\n", info.State)
+	fmt.Fprintf(tw, "Addresses:\t%v\n", info.Addresses)
+	if len(info.Connected) > 0 {
+		fmt.Fprintf(tw, "Connected:\t%s\n", strings.Join(info.Connected, ", "))
+	}
+	fmt.Fprintf(tw, "Calls:\t%d in flight, %d succeeded, %d failed\n", info.InFlight, info.Succeeded, info.Failed)
+	if info.LastCall != nil {
+		fmt.Fprintf(tw, "Last call:\t%s\n", info.LastCall.Format(time.RFC3339Nano))
+	}
+	fmt.Fprintln(tw, "Transitions:")
+	for _, t := range info.Transitions {
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", t.Time.Format(time.RFC3339Nano), t.State, t.Address, t.Error)
+	}
+	tw.Flush()
+}
+
+// Handler returns a handler that reports the registered channels as JSON
+// or, with ?format=text, as text.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var infos []*Info
+		for _, c := range Channels() {
+			infos = append(infos, c.Info())
+		}
+		if r.FormValue("format") == "text" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			for i, info := range infos {
+				if i > 0 {
+					fmt.Fprintln(w)
+				}
+				info.WriteText(w)
+			}
+			return
+		}
+		if infos == nil {
+			infos = []*Info{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		data, _ := json.MarshalIndent(infos, "", "  ")
+		w.Write(append(data, '\n'))
+	})
+}
@@ -0,0 +1,300 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	dpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// messageType is a message descriptor together with the syntax of the file
+// it was declared in.
+type messageType struct {
+	name   string
+	desc   *dpb.DescriptorProto
+	syntax string
+	// byNumber and byName index the fields by number and by their proto
+	// and JSON names.
+	byNumber map[int32]*dpb.FieldDescriptorProto
+	byName   map[string]*dpb.FieldDescriptorProto
+}
+
+type enumType struct {
+	name string
+	desc *dpb.EnumDescriptorProto
+}
+
+type serviceType struct {
+	name string
+	desc *dpb.ServiceDescriptorProto
+}
+
+// registry holds the file descriptors fetched from a server and indexes
+// the symbols they declare by their fully-qualified name.
+type registry struct {
+	files    map[string]*dpb.FileDescriptorProto
+	messages map[string]*messageType
+	enums    map[string]*enumType
+	services map[string]*serviceType
+}
+
+func newRegistry() *registry {
+	return &registry{
+		files:    make(map[string]*dpb.FileDescriptorProto),
+		messages: make(map[string]*messageType),
+		enums:    make(map[string]*enumType),
+		services: make(map[string]*serviceType),
+	}
+}
+
+// addFile decodes a serialized FileDescriptorProto and registers its
+// symbols. It returns the file so the caller can load its dependencies.
+func (r *registry) addFile(data []byte) (*dpb.FileDescriptorProto, error) {
+	fd := &dpb.FileDescriptorProto{}
+	if err := proto.Unmarshal(data, fd); err != nil {
+		return nil, err
+	}
+	if _, ok := r.files[fd.GetName()]; ok {
+		return fd, nil
+	}
+	r.files[fd.GetName()] = fd
+
+	prefix := fd.GetPackage()
+	syntax := fd.GetSyntax()
+	if syntax == "" {
+		syntax = "proto2"
+	}
+	for _, m := range fd.GetMessageType() {
+		r.addMessage(qualify(prefix, m.GetName()), m, syntax)
+	}
+	for _, e := range fd.GetEnumType() {
+		name := qualify(prefix, e.GetName())
+		r.enums[name] = &enumType{name, e}
+	}
+	for _, s := range fd.GetService() {
+		name := qualify(prefix, s.GetName())
+		r.services[name] = &serviceType{name, s}
+	}
+	return fd, nil
+}
+
+func (r *registry) addMessage(name string, m *dpb.DescriptorProto, syntax string) {
+	mt := &messageType{
+		name:     name,
+		desc:     m,
+		syntax:   syntax,
+		byNumber: make(map[int32]*dpb.FieldDescriptorProto),
+		byName:   make(map[string]*dpb.FieldDescriptorProto),
+	}
+	for _, f := range m.GetField() {
+		mt.byNumber[f.GetNumber()] = f
+		mt.byName[f.GetName()] = f
+		mt.byName[jsonName(f)] = f
+	}
+	r.messages[name] = mt
+
+	for _, nested := range m.GetNestedType() {
+		r.addMessage(qualify(name, nested.GetName()), nested, syntax)
+	}
+	for _, e := range m.GetEnumType() {
+		en := qualify(name, e.GetName())
+		r.enums[en] = &enumType{en, e}
+	}
+}
+
+func qualify(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+// jsonName returns the JSON name of a field, which protoc sets to the
+// lowerCamelCase form of the field name.
+func jsonName(f *dpb.FieldDescriptorProto) string {
+	if f.JsonName != nil {
+		return f.GetJsonName()
+	}
+	var b strings.Builder
+	upper := false
+	for _, c := range f.GetName() {
+		if c == '_' {
+			upper = true
+			continue
+		}
+		if upper && 'a' <= c && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		upper = false
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (r *registry) message(name string) (*messageType, error) {
+	m, ok := r.messages[strings.TrimPrefix(name, ".")]
+	if !ok {
+		return nil, fmt.Errorf("message type %s not found", name)
+	}
+	return m, nil
+}
+
+func (r *registry) enum(name string) (*enumType, error) {
+	e, ok := r.enums[strings.TrimPrefix(name, ".")]
+	if !ok {
+		return nil, fmt.Errorf("enum type %s not found", name)
+	}
+	return e, nil
+}
+
+// method looks up a method by its full name, in either the
+// package.Service/Method or the package.Service.Method form.
+func (r *registry) method(name string) (*serviceType, *dpb.MethodDescriptorProto, error) {
+	name = strings.TrimPrefix(name, "/")
+	i := strings.LastIndexAny(name, "/.")
+	if i < 0 {
+		return nil, nil, fmt.Errorf("%q is not a fully-qualified method name", name)
+	}
+	serviceName, methodName := name[:i], name[i+1:]
+	s, ok := r.services[serviceName]
+	if !ok {
+		return nil, nil, fmt.Errorf("service %s not found", serviceName)
+	}
+	for _, m := range s.desc.GetMethod() {
+		if m.GetName() == methodName {
+			return s, m, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("method %s not found in service %s", methodName, serviceName)
+}
+
+func (r *registry) isMap(f *dpb.FieldDescriptorProto) bool {
+	if f.GetType() != dpb.FieldDescriptorProto_TYPE_MESSAGE {
+		return false
+	}
+	m, err := r.message(f.GetTypeName())
+	return err == nil && m.desc.GetOptions().GetMapEntry()
+}
+
+// describe writes the definition of a symbol in protobuf syntax.
+func (r *registry) describe(w io.Writer, symbol string) error {
+	symbol = strings.TrimPrefix(symbol, ".")
+	if s, ok := r.services[symbol]; ok {
+		fmt.Fprintf(w, "%s is a service:\n", s.name)
+		fmt.Fprintf(w, "service %s {\n", s.desc.GetName())
+		for _, m := range s.desc.GetMethod() {
+			fmt.Fprintf(w, "  %s\n", methodSignature(m))
+		}
+		fmt.Fprintln(w, "}")
+		return nil
+	}
+	if m, ok := r.messages[symbol]; ok {
+		fmt.Fprintf(w, "%s is a message:\n", m.name)
+		r.describeMessage(w, m.desc, m.syntax, "")
+		return nil
+	}
+	if e, ok := r.enums[symbol]; ok {
+		fmt.Fprintf(w, "%s is an enum:\n", e.name)
+		describeEnum(w, e.desc, "")
+		return nil
+	}
+	if s, m, err := r.method(symbol); err == nil {
+		fmt.Fprintf(w, "%s.%s is a method:\n", s.name, m.GetName())
+		fmt.Fprintln(w, methodSignature(m))
+		return nil
+	}
+	return fmt.Errorf("symbol %s not found", symbol)
+}
+
+func methodSignature(m *dpb.MethodDescriptorProto) string {
+	in, out := strings.TrimPrefix(m.GetInputType(), "."), strings.TrimPrefix(m.GetOutputType(), ".")
+	if m.GetClientStreaming() {
+		in = "stream " + in
+	}
+	if m.GetServerStreaming() {
+		out = "stream " + out
+	}
+	return fmt.Sprintf("rpc %s ( %s ) returns ( %s );", m.GetName(), in, out)
+}
+
+func (r *registry) describeMessage(w io.Writer, m *dpb.DescriptorProto, syntax, indent string) {
+	fmt.Fprintf(w, "%smessage %s {\n", indent, m.GetName())
+	for _, nested := range m.GetNestedType() {
+		if nested.GetOptions().GetMapEntry() {
+			continue
+		}
+		r.describeMessage(w, nested, syntax, indent+"  ")
+	}
+	for _, e := range m.GetEnumType() {
+		describeEnum(w, e, indent+"  ")
+	}
+
+	oneofs := make(map[int32][]*dpb.FieldDescriptorProto)
+	for _, f := range m.GetField() {
+		if f.OneofIndex != nil {
+			oneofs[f.GetOneofIndex()] = append(oneofs[f.GetOneofIndex()], f)
+			continue
+		}
+		fmt.Fprintf(w, "%s  %s\n", indent, r.fieldDefinition(f, syntax))
+	}
+	for i, o := range m.GetOneofDecl() {
+		fmt.Fprintf(w, "%s  oneof %s {\n", indent, o.GetName())
+		for _, f := range oneofs[int32(i)] {
+			fmt.Fprintf(w, "%s    %s %s = %d;\n", indent, fieldType(f), f.GetName(), f.GetNumber())
+		}
+		fmt.Fprintf(w, "%s  }\n", indent)
+	}
+	fmt.Fprintf(w, "%s}\n", indent)
+}
+
+func (r *registry) fieldDefinition(f *dpb.FieldDescriptorProto, syntax string) string {
+	if r.isMap(f) {
+		entry, _ := r.message(f.GetTypeName())
+		key, value := entry.byNumber[1], entry.byNumber[2]
+		return fmt.Sprintf("map<%s, %s> %s = %d;", fieldType(key), fieldType(value), f.GetName(), f.GetNumber())
+	}
+
+	label := ""
+	switch f.GetLabel() {
+	case dpb.FieldDescriptorProto_LABEL_REPEATED:
+		label = "repeated "
+	case dpb.FieldDescriptorProto_LABEL_REQUIRED:
+		label = "required "
+	case dpb.FieldDescriptorProto_LABEL_OPTIONAL:
+		if syntax == "proto2" {
+			label = "optional "
+		}
+	}
+	return fmt.Sprintf("%s%s %s = %d;", label, fieldType(f), f.GetName(), f.GetNumber())
+}
+
+func fieldType(f *dpb.FieldDescriptorProto) string {
+	switch f.GetType() {
+	case dpb.FieldDescriptorProto_TYPE_MESSAGE, dpb.FieldDescriptorProto_TYPE_ENUM, dpb.FieldDescriptorProto_TYPE_GROUP:
+		return strings.TrimPrefix(f.GetTypeName(), ".")
+	}
+	return strings.ToLower(strings.TrimPrefix(f.GetType().String(), "TYPE_"))
+}
+
+func describeEnum(w io.Writer, e *dpb.EnumDescriptorProto, indent string) {
+	fmt.Fprintf(w, "%senum %s {\n", indent, e.GetName())
+	for _, v := range e.GetValue() {
+		fmt.Fprintf(w, "%s  %s = %d;\n", indent, v.GetName(), v.GetNumber())
+	}
+	fmt.Fprintf(w, "%s}\n", indent)
+}
@@ -0,0 +1,666 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+	dpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// Protobuf wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// dynamicMessage is a protobuf message whose type is only known at runtime
+// from a descriptor. It implements proto.Marshaler and proto.Unmarshaler so
+// it can be sent with the default gRPC codec. Requests are built from JSON
+// and responses are converted back to JSON, following the proto3 JSON
+// mapping for scalar, enum, repeated, map and message fields.
+type dynamicMessage struct {
+	reg    *registry
+	typ    *messageType
+	fields map[string]interface{}
+	raw    []byte
+}
+
+func newDynamicMessage(reg *registry, typ *messageType) *dynamicMessage {
+	return &dynamicMessage{reg: reg, typ: typ}
+}
+
+func (m *dynamicMessage) Reset()        { m.fields, m.raw = nil, nil }
+func (m *dynamicMessage) ProtoMessage() {}
+
+func (m *dynamicMessage) String() string {
+	data, err := m.MarshalJSON()
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+// UnmarshalJSON sets the message contents from a JSON object.
+func (m *dynamicMessage) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v map[string]interface{}
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+	m.fields = v
+	return nil
+}
+
+// MarshalJSON converts the wire format received from the server to JSON.
+func (m *dynamicMessage) MarshalJSON() ([]byte, error) {
+	v, err := m.reg.decodeMessage(m.typ, m.raw)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+func (m *dynamicMessage) Marshal() ([]byte, error) {
+	return m.reg.encodeMessage(m.typ, m.fields)
+}
+
+func (m *dynamicMessage) Unmarshal(data []byte) error {
+	m.raw = append([]byte(nil), data...)
+	return nil
+}
+
+func (r *registry) encodeMessage(typ *messageType, fields map[string]interface{}) ([]byte, error) {
+	buf := proto.NewBuffer(nil)
+
+	// Encode in field number order for deterministic output.
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		fi, fj := typ.byName[names[i]], typ.byName[names[j]]
+		if fi == nil || fj == nil {
+			return names[i] < names[j]
+		}
+		return fi.GetNumber() < fj.GetNumber()
+	})
+
+	for _, name := range names {
+		f, ok := typ.byName[name]
+		if !ok {
+			return nil, fmt.Errorf("message %s has no field %q", typ.name, name)
+		}
+		v := fields[name]
+		if v == nil {
+			continue
+		}
+		if err := r.encodeField(buf, f, v); err != nil {
+			return nil, fmt.Errorf("%s.%s: %v", typ.name, f.GetName(), err)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (r *registry) encodeField(buf *proto.Buffer, f *dpb.FieldDescriptorProto, v interface{}) error {
+	if r.isMap(f) {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return errors.New("expected a JSON object for a map field")
+		}
+		entry, _ := r.message(f.GetTypeName())
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			// Map keys are always strings in JSON.
+			var key interface{} = k
+			if entry.byNumber[1].GetType() == dpb.FieldDescriptorProto_TYPE_BOOL {
+				key = k == "true"
+			}
+			b := proto.NewBuffer(nil)
+			if err := r.encodeValue(b, entry.byNumber[1], key); err != nil {
+				return err
+			}
+			if err := r.encodeValue(b, entry.byNumber[2], obj[k]); err != nil {
+				return err
+			}
+			buf.EncodeVarint(uint64(f.GetNumber())<<3 | wireBytes)
+			buf.EncodeRawBytes(b.Bytes())
+		}
+		return nil
+	}
+
+	if f.GetLabel() != dpb.FieldDescriptorProto_LABEL_REPEATED {
+		return r.encodeValue(buf, f, v)
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return errors.New("expected a JSON array for a repeated field")
+	}
+	for _, item := range list {
+		if err := r.encodeValue(buf, f, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeValue writes a single tagged value of field f. Repeated scalars are
+// written unpacked, which every parser accepts.
+func (r *registry) encodeValue(buf *proto.Buffer, f *dpb.FieldDescriptorProto, v interface{}) error {
+	tag := uint64(f.GetNumber()) << 3
+
+	switch f.GetType() {
+	case dpb.FieldDescriptorProto_TYPE_MESSAGE:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return errors.New("expected a JSON object")
+		}
+		typ, err := r.message(f.GetTypeName())
+		if err != nil {
+			return err
+		}
+		b, err := r.encodeMessage(typ, obj)
+		if err != nil {
+			return err
+		}
+		buf.EncodeVarint(tag | wireBytes)
+		return buf.EncodeRawBytes(b)
+
+	case dpb.FieldDescriptorProto_TYPE_STRING:
+		s, ok := v.(string)
+		if !ok {
+			return errors.New("expected a JSON string")
+		}
+		buf.EncodeVarint(tag | wireBytes)
+		return buf.EncodeStringBytes(s)
+
+	case dpb.FieldDescriptorProto_TYPE_BYTES:
+		s, ok := v.(string)
+		if !ok {
+			return errors.New("expected a base64 encoded JSON string")
+		}
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return err
+		}
+		buf.EncodeVarint(tag | wireBytes)
+		return buf.EncodeRawBytes(b)
+
+	case dpb.FieldDescriptorProto_TYPE_BOOL:
+		b, ok := v.(bool)
+		if !ok {
+			return errors.New("expected a JSON boolean")
+		}
+		var x uint64
+		if b {
+			x = 1
+		}
+		buf.EncodeVarint(tag | wireVarint)
+		return buf.EncodeVarint(x)
+
+	case dpb.FieldDescriptorProto_TYPE_ENUM:
+		e, err := r.enum(f.GetTypeName())
+		if err != nil {
+			return err
+		}
+		n, err := enumNumber(e, v)
+		if err != nil {
+			return err
+		}
+		buf.EncodeVarint(tag | wireVarint)
+		return buf.EncodeVarint(uint64(int64(n)))
+
+	case dpb.FieldDescriptorProto_TYPE_DOUBLE, dpb.FieldDescriptorProto_TYPE_FLOAT:
+		x, err := jsonFloat(v)
+		if err != nil {
+			return err
+		}
+		if f.GetType() == dpb.FieldDescriptorProto_TYPE_FLOAT {
+			buf.EncodeVarint(tag | wireFixed32)
+			return buf.EncodeFixed32(uint64(math.Float32bits(float32(x))))
+		}
+		buf.EncodeVarint(tag | wireFixed64)
+		return buf.EncodeFixed64(math.Float64bits(x))
+	}
+
+	// The remaining types are integers.
+	unsigned, bits := false, 64
+	switch f.GetType() {
+	case dpb.FieldDescriptorProto_TYPE_UINT32, dpb.FieldDescriptorProto_TYPE_FIXED32:
+		unsigned, bits = true, 32
+	case dpb.FieldDescriptorProto_TYPE_UINT64, dpb.FieldDescriptorProto_TYPE_FIXED64:
+		unsigned = true
+	case dpb.FieldDescriptorProto_TYPE_INT32, dpb.FieldDescriptorProto_TYPE_SINT32,
+		dpb.FieldDescriptorProto_TYPE_SFIXED32:
+		bits = 32
+	}
+	x, err := jsonInteger(v, unsigned, bits)
+	if err != nil {
+		return err
+	}
+
+	switch f.GetType() {
+	case dpb.FieldDescriptorProto_TYPE_INT32, dpb.FieldDescriptorProto_TYPE_INT64,
+		dpb.FieldDescriptorProto_TYPE_UINT32, dpb.FieldDescriptorProto_TYPE_UINT64:
+		buf.EncodeVarint(tag | wireVarint)
+		return buf.EncodeVarint(x)
+	case dpb.FieldDescriptorProto_TYPE_SINT32:
+		buf.EncodeVarint(tag | wireVarint)
+		return buf.EncodeZigzag32(x)
+	case dpb.FieldDescriptorProto_TYPE_SINT64:
+		buf.EncodeVarint(tag | wireVarint)
+		return buf.EncodeZigzag64(x)
+	case dpb.FieldDescriptorProto_TYPE_FIXED32, dpb.FieldDescriptorProto_TYPE_SFIXED32:
+		buf.EncodeVarint(tag | wireFixed32)
+		return buf.EncodeFixed32(x)
+	case dpb.FieldDescriptorProto_TYPE_FIXED64, dpb.FieldDescriptorProto_TYPE_SFIXED64:
+		buf.EncodeVarint(tag | wireFixed64)
+		return buf.EncodeFixed64(x)
+	}
+	return fmt.Errorf("unsupported field type %s", f.GetType())
+}
+
+func enumNumber(e *enumType, v interface{}) (int32, error) {
+	switch x := v.(type) {
+	case string:
+		for _, ev := range e.desc.GetValue() {
+			if ev.GetName() == x {
+				return ev.GetNumber(), nil
+			}
+		}
+		return 0, fmt.Errorf("enum %s has no value %q", e.name, x)
+	case json.Number:
+		n, err := strconv.ParseInt(string(x), 10, 32)
+		if err != nil {
+			return 0, err
+		}
+		return int32(n), nil
+	}
+	return 0, errors.New("expected an enum name or number")
+}
+
+func jsonFloat(v interface{}) (float64, error) {
+	switch x := v.(type) {
+	case json.Number:
+		return x.Float64()
+	case string:
+		// Infinity, -Infinity and NaN are encoded as strings.
+		return strconv.ParseFloat(x, 64)
+	}
+	return 0, errors.New("expected a JSON number")
+}
+
+// jsonInteger parses an integer of the given size given as a JSON number
+// or, as the proto3 JSON mapping does for 64-bit values, a JSON string.
+// Values out of range are an error rather than truncated.
+func jsonInteger(v interface{}, unsigned bool, bits int) (uint64, error) {
+	var s string
+	switch x := v.(type) {
+	case json.Number:
+		s = string(x)
+	case string:
+		s = x
+	default:
+		return 0, errors.New("expected a JSON number")
+	}
+	if unsigned {
+		return strconv.ParseUint(s, 10, bits)
+	}
+	n, err := strconv.ParseInt(s, 10, bits)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(n), nil
+}
+
+// wireReader reads the protobuf wire format.
+type wireReader struct {
+	buf []byte
+	pos int
+}
+
+var errTruncated = errors.New("truncated message")
+
+func (r *wireReader) done() bool {
+	return r.pos >= len(r.buf)
+}
+
+func (r *wireReader) varint() (uint64, error) {
+	x, n := proto.DecodeVarint(r.buf[r.pos:])
+	if n == 0 {
+		return 0, errTruncated
+	}
+	r.pos += n
+	return x, nil
+}
+
+func (r *wireReader) fixed(size int) (uint64, error) {
+	if r.pos+size > len(r.buf) {
+		return 0, errTruncated
+	}
+	var x uint64
+	for i := size - 1; i >= 0; i-- {
+		x = x<<8 | uint64(r.buf[r.pos+i])
+	}
+	r.pos += size
+	return x, nil
+}
+
+func (r *wireReader) bytes() ([]byte, error) {
+	n, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	// Compare in uint64: a length of 2^63 or more would wrap int(n).
+	if n > uint64(len(r.buf)-r.pos) {
+		return nil, errTruncated
+	}
+	b := r.buf[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b, nil
+}
+
+// skip discards a value of an unknown field.
+func (r *wireReader) skip(wireType uint64) error {
+	var err error
+	switch wireType {
+	case wireVarint:
+		_, err = r.varint()
+	case wireFixed64:
+		_, err = r.fixed(8)
+	case wireBytes:
+		_, err = r.bytes()
+	case wireFixed32:
+		_, err = r.fixed(4)
+	default:
+		err = fmt.Errorf("unsupported wire type %d", wireType)
+	}
+	return err
+}
+
+// jsonObject is a JSON object that keeps its fields in declaration order.
+type jsonObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (o *jsonObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		kb, _ := json.Marshal(k)
+		buf.Write(kb)
+		buf.WriteByte(':')
+		vb, err := json.Marshal(o.values[k])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(vb)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func (r *registry) decodeMessage(typ *messageType, data []byte) (*jsonObject, error) {
+	values := make(map[string]interface{})
+	rd := &wireReader{buf: data}
+	for !rd.done() {
+		key, err := rd.varint()
+		if err != nil {
+			return nil, err
+		}
+		number, wireType := int32(key>>3), key&7
+		f, ok := typ.byNumber[number]
+		if !ok {
+			if err := rd.skip(wireType); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		name := jsonName(f)
+
+		if r.isMap(f) {
+			b, err := rd.bytes()
+			if err != nil {
+				return nil, err
+			}
+			entry, _ := r.message(f.GetTypeName())
+			kv, err := r.decodeMessage(entry, b)
+			if err != nil {
+				return nil, err
+			}
+			m, _ := values[name].(map[string]interface{})
+			if m == nil {
+				m = make(map[string]interface{})
+				values[name] = m
+			}
+			// An entry may omit its key or value when it has the default
+			// value of its type.
+			keyField, valueField := entry.byNumber[1], entry.byNumber[2]
+			key, ok := kv.values[jsonName(keyField)]
+			if !ok {
+				key = r.zeroValue(keyField)
+			}
+			value, ok := kv.values[jsonName(valueField)]
+			if !ok {
+				value = r.zeroValue(valueField)
+			}
+			m[fmt.Sprint(key)] = value
+			continue
+		}
+
+		var decoded []interface{}
+		if wireType == wireBytes && isPackable(f) {
+			b, err := rd.bytes()
+			if err != nil {
+				return nil, err
+			}
+			packed := &wireReader{buf: b}
+			for !packed.done() {
+				v, err := r.decodeValue(packed, f, scalarWireType(f))
+				if err != nil {
+					return nil, err
+				}
+				decoded = append(decoded, v)
+			}
+		} else {
+			v, err := r.decodeValue(rd, f, wireType)
+			if err != nil {
+				return nil, err
+			}
+			decoded = append(decoded, v)
+		}
+
+		if f.GetLabel() == dpb.FieldDescriptorProto_LABEL_REPEATED {
+			list, _ := values[name].([]interface{})
+			values[name] = append(list, decoded...)
+		} else {
+			values[name] = decoded[len(decoded)-1]
+		}
+	}
+
+	obj := &jsonObject{values: values}
+	for _, f := range typ.desc.GetField() {
+		if _, ok := values[jsonName(f)]; ok {
+			obj.keys = append(obj.keys, jsonName(f))
+		}
+	}
+	return obj, nil
+}
+
+// zeroValue returns the JSON value of a scalar, enum or message field that
+// was not sent.
+func (r *registry) zeroValue(f *dpb.FieldDescriptorProto) interface{} {
+	switch f.GetType() {
+	case dpb.FieldDescriptorProto_TYPE_STRING, dpb.FieldDescriptorProto_TYPE_BYTES:
+		return ""
+	case dpb.FieldDescriptorProto_TYPE_BOOL:
+		return false
+	case dpb.FieldDescriptorProto_TYPE_INT64, dpb.FieldDescriptorProto_TYPE_UINT64,
+		dpb.FieldDescriptorProto_TYPE_SINT64, dpb.FieldDescriptorProto_TYPE_FIXED64,
+		dpb.FieldDescriptorProto_TYPE_SFIXED64:
+		return "0"
+	case dpb.FieldDescriptorProto_TYPE_MESSAGE:
+		return &jsonObject{values: map[string]interface{}{}}
+	case dpb.FieldDescriptorProto_TYPE_ENUM:
+		if e, err := r.enum(f.GetTypeName()); err == nil {
+			for _, ev := range e.desc.GetValue() {
+				if ev.GetNumber() == 0 {
+					return ev.GetName()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func isPackable(f *dpb.FieldDescriptorProto) bool {
+	if f.GetLabel() != dpb.FieldDescriptorProto_LABEL_REPEATED {
+		return false
+	}
+	switch f.GetType() {
+	case dpb.FieldDescriptorProto_TYPE_STRING, dpb.FieldDescriptorProto_TYPE_BYTES,
+		dpb.FieldDescriptorProto_TYPE_MESSAGE, dpb.FieldDescriptorProto_TYPE_GROUP:
+		return false
+	}
+	return true
+}
+
+func scalarWireType(f *dpb.FieldDescriptorProto) uint64 {
+	switch f.GetType() {
+	case dpb.FieldDescriptorProto_TYPE_DOUBLE, dpb.FieldDescriptorProto_TYPE_FIXED64,
+		dpb.FieldDescriptorProto_TYPE_SFIXED64:
+		return wireFixed64
+	case dpb.FieldDescriptorProto_TYPE_FLOAT, dpb.FieldDescriptorProto_TYPE_FIXED32,
+		dpb.FieldDescriptorProto_TYPE_SFIXED32:
+		return wireFixed32
+	}
+	return wireVarint
+}
+
+func (r *registry) decodeValue(rd *wireReader, f *dpb.FieldDescriptorProto, wireType uint64) (interface{}, error) {
+	switch wireType {
+	case wireBytes:
+		b, err := rd.bytes()
+		if err != nil {
+			return nil, err
+		}
+		switch f.GetType() {
+		case dpb.FieldDescriptorProto_TYPE_STRING:
+			return string(b), nil
+		case dpb.FieldDescriptorProto_TYPE_BYTES:
+			return base64.StdEncoding.EncodeToString(b), nil
+		case dpb.FieldDescriptorProto_TYPE_MESSAGE:
+			typ, err := r.message(f.GetTypeName())
+			if err != nil {
+				return nil, err
+			}
+			return r.decodeMessage(typ, b)
+		}
+		return nil, fmt.Errorf("field %s: unexpected length-delimited value", f.GetName())
+
+	case wireFixed32:
+		x, err := rd.fixed(4)
+		if err != nil {
+			return nil, err
+		}
+		switch f.GetType() {
+		case dpb.FieldDescriptorProto_TYPE_FLOAT:
+			return jsonSafeFloat(float64(math.Float32frombits(uint32(x)))), nil
+		case dpb.FieldDescriptorProto_TYPE_SFIXED32:
+			return int32(x), nil
+		}
+		return uint32(x), nil
+
+	case wireFixed64:
+		x, err := rd.fixed(8)
+		if err != nil {
+			return nil, err
+		}
+		switch f.GetType() {
+		case dpb.FieldDescriptorProto_TYPE_DOUBLE:
+			return jsonSafeFloat(math.Float64frombits(x)), nil
+		case dpb.FieldDescriptorProto_TYPE_SFIXED64:
+			return strconv.FormatInt(int64(x), 10), nil
+		}
+		return strconv.FormatUint(x, 10), nil
+
+	case wireVarint:
+		x, err := rd.varint()
+		if err != nil {
+			return nil, err
+		}
+		switch f.GetType() {
+		case dpb.FieldDescriptorProto_TYPE_BOOL:
+			return x != 0, nil
+		case dpb.FieldDescriptorProto_TYPE_INT32:
+			return int32(x), nil
+		case dpb.FieldDescriptorProto_TYPE_UINT32:
+			return uint32(x), nil
+		case dpb.FieldDescriptorProto_TYPE_SINT32:
+			return int32(uint32(x>>1) ^ -uint32(x&1)), nil
+		case dpb.FieldDescriptorProto_TYPE_INT64:
+			// 64-bit integers are strings in the proto3 JSON mapping.
+			return strconv.FormatInt(int64(x), 10), nil
+		case dpb.FieldDescriptorProto_TYPE_UINT64:
+			return strconv.FormatUint(x, 10), nil
+		case dpb.FieldDescriptorProto_TYPE_SINT64:
+			return strconv.FormatInt(int64(x>>1)^-int64(x&1), 10), nil
+		case dpb.FieldDescriptorProto_TYPE_ENUM:
+			e, err := r.enum(f.GetTypeName())
+			if err != nil {
+				return nil, err
+			}
+			for _, ev := range e.desc.GetValue() {
+				if int64(ev.GetNumber()) == int64(int32(x)) {
+					return ev.GetName(), nil
+				}
+			}
+			return int32(x), nil
+		}
+	}
+	return nil, fmt.Errorf("field %s: unexpected wire type %d", f.GetName(), wireType)
+}
+
+// jsonSafeFloat returns the JSON representation of special float values,
+// which encoding/json refuses to marshal.
+func jsonSafeFloat(f float64) interface{} {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+	return f
+}
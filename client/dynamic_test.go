@@ -0,0 +1,317 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/jsonpb"
+	pb "github.com/golang/protobuf/jsonpb/jsonpb_test_proto"
+	"github.com/golang/protobuf/proto"
+	p3 "github.com/golang/protobuf/proto/proto3_proto"
+)
+
+// testFiles are the descriptors registered by the generated packages the
+// tests compare the codec with.
+var testFiles = []string{
+	"test_objects.proto",
+	"more_test_objects.proto",
+	"proto3_proto/proto3.proto",
+	"test.proto",
+	"github.com/golang/protobuf/ptypes/any/any.proto",
+}
+
+func newTestRegistry(t *testing.T) *registry {
+	reg := newRegistry()
+	for _, name := range testFiles {
+		gz := proto.FileDescriptor(name)
+		if gz == nil {
+			t.Fatalf("descriptor of %s not registered", name)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(gz))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := reg.addFile(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return reg
+}
+
+// jsonValue unmarshals data into a generic value for comparisons.
+func jsonValue(t *testing.T, data []byte) interface{} {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatalf("invalid JSON %s: %v", data, err)
+	}
+	return v
+}
+
+func TestRoundTrip(t *testing.T) {
+	reg := newTestRegistry(t)
+	tests := []struct {
+		name    string
+		typ     string
+		message proto.Message
+		// want is the expected JSON where jsonpb does not follow the
+		// proto3 JSON mapping.
+		want string
+	}{
+		{"scalars", "jsonpb.Simple", &pb.Simple{
+			OBool:   proto.Bool(true),
+			OInt32:  proto.Int32(-32),
+			OInt64:  proto.Int64(-1 << 40),
+			OUint32: proto.Uint32(1<<32 - 1),
+			OUint64: proto.Uint64(1<<64 - 1),
+			OSint32: proto.Int32(-7),
+			OSint64: proto.Int64(-1 << 50),
+			OFloat:  proto.Float32(1.5),
+			ODouble: proto.Float64(-2.25),
+			OString: proto.String("ping"),
+			OBytes:  []byte{0, 1, 0xfe, 0xff},
+		}, ""},
+		{"zero scalars", "jsonpb.Simple", &pb.Simple{
+			OBool:  proto.Bool(false),
+			OInt32: proto.Int32(0),
+		}, ""},
+		{"repeated", "jsonpb.Repeats", &pb.Repeats{
+			RBool:   []bool{true, false},
+			RInt32:  []int32{-1, 0, 1},
+			RInt64:  []int64{-1 << 40, 1 << 40},
+			RUint32: []uint32{0, 1<<32 - 1},
+			RUint64: []uint64{1<<64 - 1},
+			RSint32: []int32{-5, 5},
+			RSint64: []int64{-1 << 50},
+			RFloat:  []float32{0.5, -0.25},
+			RDouble: []float64{3.5},
+			RString: []string{"a", "", "c"},
+			RBytes:  [][]byte{{1}, {}},
+		}, ""},
+		{"packed", "proto3_proto.Message", &p3.Message{
+			Name:     "packed",
+			Hilarity: p3.Message_PUNS,
+			Key:      []uint64{1, 300, 1<<64 - 1},
+			ShortKey: []int32{-1, 0, 70000},
+			RFunny:   []p3.Message_Humour{p3.Message_SLAPSTICK, p3.Message_BILL_BAILEY},
+			Score:    0.75,
+		}, ""},
+		{"maps", "jsonpb.Mappy", &pb.Mappy{
+			Nummy:    map[int64]int32{-1: 1, 1 << 40: -2},
+			Strry:    map[string]string{"a": "b", "": "empty key"},
+			Objjy:    map[int32]*pb.Simple3{1: {Dub: 1.5}, 2: {}},
+			Buggy:    map[int64]string{5: "five"},
+			Booly:    map[bool]bool{true: false, false: true},
+			S32Booly: map[int32]bool{-3: true},
+			S64Booly: map[int64]bool{-1 << 40: true},
+			U32Booly: map[uint32]bool{1<<32 - 1: true},
+			U64Booly: map[uint64]bool{1<<64 - 1: true},
+		}, ""},
+		// jsonpb writes the enum values of maps as numbers.
+		{"map of enums", "jsonpb.Mappy", &pb.Mappy{
+			Enumy: map[string]pb.Numeral{"x": pb.Numeral_ROMAN, "y": pb.Numeral_UNKNOWN},
+		}, `{"enumy":{"x":"ROMAN","y":"UNKNOWN"}}`},
+		{"map of messages", "jsonpb.Maps", &pb.Maps{
+			MInt64Str:   map[int64]string{1: "one"},
+			MBoolSimple: map[bool]*pb.Simple{true: {OString: proto.String("yes")}},
+		}, ""},
+		{"oneof string", "jsonpb.MsgWithOneof", &pb.MsgWithOneof{
+			Union: &pb.MsgWithOneof_Country{Country: "NL"},
+		}, ""},
+		{"oneof int64", "jsonpb.MsgWithOneof", &pb.MsgWithOneof{
+			Union: &pb.MsgWithOneof_Salary{Salary: 31000},
+		}, ""},
+		{"nested", "jsonpb.Widget", &pb.Widget{
+			Color:   pb.Widget_BLUE.Enum(),
+			RColor:  []pb.Widget_Color{pb.Widget_RED, pb.Widget_GREEN},
+			Simple:  &pb.Simple{OString: proto.String("inner")},
+			RSimple: []*pb.Simple{{OInt32: proto.Int32(1)}, {}},
+			Repeats: &pb.Repeats{RString: []string{"deep"}},
+			RRepeats: []*pb.Repeats{
+				{RInt64: []int64{1, 2}},
+			},
+		}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			typ, err := reg.message(tt.typ)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Decode what golang/protobuf encodes, and compare the JSON with
+			// its proto3 JSON mapping.
+			data, err := proto.Marshal(tt.message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := newDynamicMessage(reg, typ)
+			if err := m.Unmarshal(data); err != nil {
+				t.Fatal(err)
+			}
+			got, err := m.MarshalJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.want
+			if want == "" {
+				want, err = (&jsonpb.Marshaler{}).MarshalToString(tt.message)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !reflect.DeepEqual(jsonValue(t, got), jsonValue(t, []byte(want))) {
+				t.Errorf("decoded JSON\n got %s\nwant %s", got, want)
+			}
+
+			// Encode that JSON again, and check that golang/protobuf decodes
+			// the original message.
+			m = newDynamicMessage(reg, typ)
+			if err := m.UnmarshalJSON(got); err != nil {
+				t.Fatal(err)
+			}
+			encoded, err := m.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded := reflect.New(reflect.TypeOf(tt.message).Elem()).Interface().(proto.Message)
+			if err := proto.Unmarshal(encoded, decoded); err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(decoded, tt.message) {
+				t.Errorf("round trip\n got %v\nwant %v", decoded, tt.message)
+			}
+		})
+	}
+}
+
+func TestDecodeMapEntryDefaults(t *testing.T) {
+	reg := newTestRegistry(t)
+	tests := []struct {
+		name string
+		typ  string
+		data []byte
+		want string
+	}{
+		// stringy entry with only its value, "v".
+		{"string key", "jsonpb.SimpleMap3", []byte{0x0a, 0x03, 0x12, 0x01, 'v'}, `{"stringy":{"":"v"}}`},
+		// stringy entry with only its key, "k".
+		{"string value", "jsonpb.SimpleMap3", []byte{0x0a, 0x03, 0x0a, 0x01, 'k'}, `{"stringy":{"k":""}}`},
+		// Empty nummy, booly and objjy entries.
+		{"int key", "jsonpb.Mappy", []byte{0x0a, 0x00}, `{"nummy":{"0":0}}`},
+		{"bool key", "jsonpb.Mappy", []byte{0x2a, 0x00}, `{"booly":{"false":false}}`},
+		{"message value", "jsonpb.Mappy", []byte{0x1a, 0x00}, `{"objjy":{"0":{}}}`},
+		{"enum value", "jsonpb.Mappy", []byte{0x32, 0x00}, `{"enumy":{"":"UNKNOWN"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			typ, err := reg.message(tt.typ)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := newDynamicMessage(reg, typ)
+			m.Unmarshal(tt.data)
+			got, err := m.MarshalJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeRange(t *testing.T) {
+	reg := newTestRegistry(t)
+	tests := []struct {
+		typ  string
+		json string
+		ok   bool
+	}{
+		{"jsonpb.Simple", `{"oInt32": 2147483647}`, true},
+		{"jsonpb.Simple", `{"oInt32": -2147483648}`, true},
+		{"jsonpb.Simple", `{"oInt32": 2147483648}`, false},
+		{"jsonpb.Simple", `{"oInt32": -2147483649}`, false},
+		{"jsonpb.Simple", `{"oSint32": 2147483648}`, false},
+		{"jsonpb.Simple", `{"oUint32": 4294967295}`, true},
+		{"jsonpb.Simple", `{"oUint32": 4294967296}`, false},
+		{"jsonpb.Simple", `{"oUint32": -1}`, false},
+		{"jsonpb.Simple", `{"oInt64": "9223372036854775807"}`, true},
+		{"jsonpb.Simple", `{"oInt64": "9223372036854775808"}`, false},
+		{"jsonpb.Simple", `{"oUint64": "18446744073709551615"}`, true},
+		{"jsonpb.Simple", `{"oInt32": 1.5}`, false},
+		{"jsonpb.Widget", `{"color": 2}`, true},
+		{"jsonpb.Widget", `{"color": 2147483648}`, false},
+		{"jsonpb.Widget", `{"color": "PURPLE"}`, false},
+		{"jsonpb.Mappy", `{"s32booly": {"2147483648": true}}`, false},
+		{"jsonpb.Mappy", `{"u32booly": {"4294967295": true}}`, true},
+	}
+	for _, tt := range tests {
+		typ, err := reg.message(tt.typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := newDynamicMessage(reg, typ)
+		if err := m.UnmarshalJSON([]byte(tt.json)); err != nil {
+			t.Fatal(err)
+		}
+		_, err = m.Marshal()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s %s: got error %v, want ok %t", tt.typ, tt.json, err, tt.ok)
+		}
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	reg := newTestRegistry(t)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		// stringy entry (field 1) whose length is past the end.
+		{"short", []byte{0x0a, 0x05, 0x12, 0x01}},
+		// stringy entry whose length is 2^63, which wraps int.
+		{"length 2^63", []byte{0x0a, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01}},
+		// stringy entry whose length is 2^64-1.
+		{"length 2^64-1", []byte{0x0a, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		// Unknown field 99 whose length is 2^63, skipped.
+		{"unknown field", []byte{0x9a, 0x06, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01}},
+		// Tag whose varint never ends.
+		{"varint", []byte{0x80, 0x80}},
+	}
+	typ, err := reg.message("jsonpb.SimpleMap3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newDynamicMessage(reg, typ)
+			m.Unmarshal(tt.data)
+			if got, err := m.MarshalJSON(); err == nil {
+				t.Errorf("got %s, want an error", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,395 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kelseyhightower/ping"
+	"github.com/kelseyhightower/ping/balancer"
+
+	"google.golang.org/grpc"
+)
+
+// endpointStats aggregates the pings sent to one endpoint.
+type endpointStats struct {
+	addr      string
+	sent      int64
+	lost      int64
+	latency   *histogram
+	codes     map[string]int64
+	hostnames map[string]int64
+}
+
+// hostnameStats aggregates the responses that reported the same hostname,
+// which may have come from several endpoints.
+type hostnameStats struct {
+	hostname  string
+	responses int64
+	latency   *histogram
+	endpoints map[string]bool
+}
+
+// endpointReport holds the results of pinging every endpoint of a target.
+type endpointReport struct {
+	target    string
+	duration  time.Duration
+	endpoints []*endpointStats
+	hostnames map[string]*hostnameStats
+}
+
+func (r *endpointReport) record(e *endpointStats, res *result) {
+	e.sent++
+	e.codes[res.Code]++
+	if res.Error != "" {
+		e.lost++
+		return
+	}
+	e.latency.Record(res.Latency)
+
+	hostname := dash(res.Hostname)
+	e.hostnames[hostname]++
+	h, ok := r.hostnames[hostname]
+	if !ok {
+		h = &hostnameStats{hostname: hostname, latency: newHistogram(), endpoints: make(map[string]bool)}
+		r.hostnames[hostname] = h
+	}
+	h.responses++
+	h.latency.Record(res.Latency)
+	h.endpoints[e.addr] = true
+}
+
+func (r *endpointReport) sortedHostnames() []*hostnameStats {
+	hostnames := make([]*hostnameStats, 0, len(r.hostnames))
+	for _, h := range r.hostnames {
+		hostnames = append(hostnames, h)
+	}
+	sort.Slice(hostnames, func(i, j int) bool { return hostnames[i].hostname < hostnames[j].hostname })
+	return hostnames
+}
+
+func runEndpoints(args []string) {
+	var (
+		serverAddr string
+		resolve    string
+		count      int64
+		interval   time.Duration
+		timeout    time.Duration
+		output     string
+		md         metadataFlags
+		tlsOpts    tlsFlags
+	)
+
+	fs := flag.NewFlagSet("endpoints", flag.ExitOnError)
+	fs.StringVar(&serverAddr, "server", "127.0.0.1:8080", "The target: host:port, an SRV record name, or a comma-separated list of addresses")
+	fs.StringVar(&resolve, "resolve", "auto", "How to resolve the target: auto, dns (A/AAAA), srv or list")
+	fs.Int64Var(&count, "count", 10, "The number of pings to send to each endpoint; 0 pings until interrupted")
+	fs.DurationVar(&interval, "interval", time.Second, "The time to wait between rounds of pings")
+	fs.DurationVar(&timeout, "timeout", 5*time.Second, "The per ping timeout")
+	fs.StringVar(&output, "o", "table", "The output format: table, json, jsonl or csv")
+	md.register(fs)
+	tlsOpts.register(fs)
+	fs.Parse(args)
+
+	out, err := newResultWriter(output, os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	endpoints, err := balancer.Resolve(serverAddr, resolve)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	report := &endpointReport{target: serverAddr, hostnames: make(map[string]*hostnameStats)}
+	pingers := make([]*pinger, len(endpoints))
+	for i, e := range endpoints {
+		securityOpt, err := tlsOpts.dialOptionFor(e.Host)
+		if err != nil {
+			log.Fatal(err)
+		}
+		conn, err := grpc.Dial(e.Addr, securityOpt)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer conn.Close()
+
+		pingers[i] = &pinger{
+			client:  ping.NewPingClient(conn),
+			target:  e.Addr,
+			timeout: timeout,
+			md:      md.metadata(),
+		}
+		report.endpoints = append(report.endpoints, &endpointStats{
+			addr:      e.Addr,
+			latency:   newHistogram(),
+			codes:     make(map[string]int64),
+			hostnames: make(map[string]int64),
+		})
+	}
+	if output == "table" {
+		fmt.Printf("Pinging %d endpoints of %s\n\n", len(endpoints), serverAddr)
+	}
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	start := time.Now()
+
+loop:
+	for seq := int64(1); count == 0 || seq <= count; seq++ {
+		if seq > 1 {
+			select {
+			case <-time.After(interval):
+			case <-signalChan:
+				break loop
+			}
+		}
+
+		// Ping every endpoint at the same time so a slow endpoint does not
+		// delay the others.
+		results := make([]*result, len(pingers))
+		var wg sync.WaitGroup
+		for i, p := range pingers {
+			wg.Add(1)
+			go func(i int, p *pinger) {
+				defer wg.Done()
+				results[i], _ = p.send(seq)
+			}(i, p)
+		}
+		wg.Wait()
+		for i, r := range results {
+			report.record(report.endpoints[i], r)
+		}
+	}
+	report.duration = time.Since(start)
+
+	if err := out.WriteEndpointReport(report); err != nil {
+		log.Fatal(err)
+	}
+	if err := out.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	for _, e := range report.endpoints {
+		if e.lost > 0 {
+			os.Exit(1)
+		}
+	}
+}
+
+func formatLoss(lost, sent int64) string {
+	if sent == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(lost)/float64(sent))
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WriteEndpointReport writes the report as two tables, grouped by endpoint
+// and by the hostname the endpoints reported.
+func (t *tableWriter) WriteEndpointReport(r *endpointReport) error {
+	tw := tabwriter.NewWriter(t.w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ENDPOINT\tSENT\tLOST\tLOSS\tMIN\tP50\tP99\tMAX\tHOSTNAMES")
+	for _, e := range r.endpoints {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.addr, e.sent, e.lost, formatLoss(e.lost, e.sent),
+			e.latency.Min(), e.latency.Quantile(0.5), e.latency.Quantile(0.99), e.latency.Max(),
+			dash(strings.Join(sortedKeys(e.hostnames), ",")))
+	}
+	fmt.Fprintln(tw)
+
+	fmt.Fprintln(tw, "HOSTNAME\tRESPONSES\tMIN\tP50\tP99\tMAX\tENDPOINTS")
+	for _, h := range r.sortedHostnames() {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\t%s\n",
+			h.hostname, h.responses,
+			h.latency.Min(), h.latency.Quantile(0.5), h.latency.Quantile(0.99), h.latency.Max(),
+			strings.Join(h.sortedEndpoints(), ","))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	for _, e := range r.endpoints {
+		if e.lost > 0 {
+			fmt.Fprintf(t.w, "\nErrors from %s: %s\n", e.addr, formatCodes(e.codes, ", "))
+		}
+	}
+	return nil
+}
+
+func (h *hostnameStats) sortedEndpoints() []string {
+	addrs := make([]string, 0, len(h.endpoints))
+	for addr := range h.endpoints {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func lossRatio(lost, sent int64) float64 {
+	if sent == 0 {
+		return 0
+	}
+	return float64(lost) / float64(sent)
+}
+
+type jsonEndpoint struct {
+	Type      string             `json:"type,omitempty"`
+	Address   string             `json:"address"`
+	Sent      int64              `json:"sent"`
+	Lost      int64              `json:"lost"`
+	Loss      float64            `json:"loss"`
+	LatencyMs map[string]float64 `json:"latency_ms"`
+	Codes     map[string]int64   `json:"codes"`
+	Hostnames map[string]int64   `json:"hostnames"`
+}
+
+type jsonHostname struct {
+	Type      string             `json:"type,omitempty"`
+	Hostname  string             `json:"hostname"`
+	Responses int64              `json:"responses"`
+	LatencyMs map[string]float64 `json:"latency_ms"`
+	Endpoints []string           `json:"endpoints"`
+}
+
+type jsonEndpointReport struct {
+	Target     string          `json:"target"`
+	DurationMs float64         `json:"duration_ms"`
+	Endpoints  []*jsonEndpoint `json:"endpoints"`
+	Hostnames  []*jsonHostname `json:"hostnames"`
+}
+
+func newJSONEndpointReport(r *endpointReport) *jsonEndpointReport {
+	doc := &jsonEndpointReport{
+		Target:     r.target,
+		DurationMs: milliseconds(r.duration),
+		Endpoints:  []*jsonEndpoint{},
+		Hostnames:  []*jsonHostname{},
+	}
+	for _, e := range r.endpoints {
+		doc.Endpoints = append(doc.Endpoints, &jsonEndpoint{
+			Address:   e.addr,
+			Sent:      e.sent,
+			Lost:      e.lost,
+			Loss:      lossRatio(e.lost, e.sent),
+			LatencyMs: latencySummary(e.latency),
+			Codes:     e.codes,
+			Hostnames: e.hostnames,
+		})
+	}
+	for _, h := range r.sortedHostnames() {
+		doc.Hostnames = append(doc.Hostnames, &jsonHostname{
+			Hostname:  h.hostname,
+			Responses: h.responses,
+			LatencyMs: latencySummary(h.latency),
+			Endpoints: h.sortedEndpoints(),
+		})
+	}
+	return doc
+}
+
+// WriteEndpointReport replaces the results with the report, written as a
+// single JSON document on Flush.
+func (j *jsonWriter) WriteEndpointReport(r *endpointReport) error {
+	j.report = newJSONEndpointReport(r)
+	return nil
+}
+
+// WriteEndpointReport writes a line for every endpoint and every hostname.
+func (j *jsonlWriter) WriteEndpointReport(r *endpointReport) error {
+	doc := newJSONEndpointReport(r)
+	for _, e := range doc.Endpoints {
+		e.Type = "endpoint"
+		if err := j.enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	for _, h := range doc.Hostnames {
+		h.Type = "hostname"
+		if err := j.enc.Encode(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var csvEndpointHeader = []string{
+	"target", "endpoint", "sent", "lost", "loss", "latency_min_ms",
+	"latency_p50_ms", "latency_p99_ms", "latency_max_ms", "codes", "hostnames",
+}
+
+var csvHostnameHeader = []string{
+	"hostname", "responses", "latency_min_ms", "latency_p50_ms",
+	"latency_p99_ms", "latency_max_ms", "endpoints",
+}
+
+// WriteEndpointReport writes the endpoints and the hostnames as two
+// tables, separated by an empty line.
+func (c *csvWriter) WriteEndpointReport(r *endpointReport) error {
+	if c.wroteTable {
+		c.w.Flush()
+		c.w.Write(nil)
+	}
+	c.w.Write(csvEndpointHeader)
+	for _, e := range r.endpoints {
+		c.w.Write([]string{
+			r.target,
+			e.addr,
+			strconv.FormatInt(e.sent, 10),
+			strconv.FormatInt(e.lost, 10),
+			formatFloat(lossRatio(e.lost, e.sent)),
+			formatFloat(milliseconds(e.latency.Min())),
+			formatFloat(milliseconds(e.latency.Quantile(0.5))),
+			formatFloat(milliseconds(e.latency.Quantile(0.99))),
+			formatFloat(milliseconds(e.latency.Max())),
+			formatCodes(e.codes, ";"),
+			strings.Join(sortedKeys(e.hostnames), ";"),
+		})
+	}
+	c.w.Flush()
+	c.w.Write(nil)
+	c.w.Write(csvHostnameHeader)
+	for _, h := range r.sortedHostnames() {
+		c.w.Write([]string{
+			h.hostname,
+			strconv.FormatInt(h.responses, 10),
+			formatFloat(milliseconds(h.latency.Min())),
+			formatFloat(milliseconds(h.latency.Quantile(0.5))),
+			formatFloat(milliseconds(h.latency.Quantile(0.99))),
+			formatFloat(milliseconds(h.latency.Max())),
+			strings.Join(h.sortedEndpoints(), ";"),
+		})
+	}
+	c.wroteTable = true
+	c.w.Flush()
+	return c.w.Error()
+}
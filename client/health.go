@@ -0,0 +1,166 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Exit codes of the health command. Each outcome has its own code so the
+// command can be used as an exec probe or in rollout scripts. 2 is skipped
+// because the flag package uses it for usage errors.
+const (
+	exitServing           = 0
+	exitNotServing        = 1
+	exitUnknown           = 3
+	exitConnectionFailure = 4
+	exitTimeout           = 5
+	exitAuthFailure       = 6
+)
+
+// healthResult is the outcome of a single health check.
+type healthResult struct {
+	status   string
+	exitCode int
+	err      error
+}
+
+func runHealth(args []string) {
+	var (
+		serverAddr string
+		service    string
+		httpURL    string
+		timeout    time.Duration
+		wait       time.Duration
+		interval   time.Duration
+		tlsOpts    tlsFlags
+	)
+
+	fs := flag.NewFlagSet("health", flag.ExitOnError)
+	fs.StringVar(&serverAddr, "server", "127.0.0.1:8080", "The gRPC server address")
+	fs.StringVar(&service, "service", "", "The service to check; empty checks the overall server health")
+	fs.StringVar(&httpURL, "http", "", "Check an HTTP health endpoint such as http://127.0.0.1:8008/health instead of gRPC")
+	fs.DurationVar(&timeout, "timeout", 5*time.Second, "The timeout of a single check")
+	fs.DurationVar(&wait, "wait", 0, "Keep checking until the target is serving or this much time has passed")
+	fs.DurationVar(&interval, "interval", time.Second, "The time between checks when -wait is set")
+	tlsOpts.register(fs)
+	fs.Parse(args)
+
+	var check func() healthResult
+	if httpURL != "" {
+		tlsConfig, err := tlsOpts.config()
+		if err != nil {
+			log.Fatal(err)
+		}
+		client := &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		}
+		check = func() healthResult {
+			return checkHTTPHealth(client, httpURL)
+		}
+	} else {
+		securityOpt, err := tlsOpts.dialOption()
+		if err != nil {
+			log.Fatal(err)
+		}
+		conn, err := grpc.Dial(serverAddr, securityOpt)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer conn.Close()
+		client := healthpb.NewHealthClient(conn)
+		check = func() healthResult {
+			return checkGRPCHealth(client, service, timeout)
+		}
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		r := check()
+		if r.exitCode == exitServing || !time.Now().Add(interval).Before(deadline) {
+			if r.err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", r.status, r.err)
+			} else {
+				fmt.Println(r.status)
+			}
+			os.Exit(r.exitCode)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func checkGRPCHealth(client healthpb.HealthClient, service string, timeout time.Duration) healthResult {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+	if err != nil {
+		switch grpc.Code(err) {
+		case codes.DeadlineExceeded:
+			return healthResult{"TIMEOUT", exitTimeout, err}
+		case codes.NotFound:
+			// The health server does not know about the service.
+			return healthResult{"UNKNOWN", exitUnknown, err}
+		case codes.Unauthenticated, codes.PermissionDenied:
+			// The server is up but refused the caller, which retrying will
+			// not change.
+			return healthResult{"AUTH_FAILURE", exitAuthFailure, err}
+		}
+		return healthResult{"CONNECTION_FAILURE", exitConnectionFailure, err}
+	}
+
+	switch resp.Status {
+	case healthpb.HealthCheckResponse_SERVING:
+		return healthResult{"SERVING", exitServing, nil}
+	case healthpb.HealthCheckResponse_NOT_SERVING:
+		return healthResult{"NOT_SERVING", exitNotServing, nil}
+	}
+	return healthResult{"UNKNOWN", exitUnknown, nil}
+}
+
+// checkHTTPHealth checks one of the /health endpoints, which answer 200 when
+// serving and 503 otherwise.
+func checkHTTPHealth(client *http.Client, url string) healthResult {
+	resp, err := client.Get(url)
+	if err != nil {
+		if e, ok := err.(interface {
+			Timeout() bool
+		}); ok && e.Timeout() {
+			return healthResult{"TIMEOUT", exitTimeout, err}
+		}
+		return healthResult{"CONNECTION_FAILURE", exitConnectionFailure, err}
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return healthResult{"SERVING", exitServing, nil}
+	case http.StatusServiceUnavailable:
+		return healthResult{"NOT_SERVING", exitNotServing, nil}
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return healthResult{"AUTH_FAILURE", exitAuthFailure, fmt.Errorf("unexpected HTTP status %s", resp.Status)}
+	}
+	return healthResult{"UNKNOWN", exitUnknown, fmt.Errorf("unexpected HTTP status %s", resp.Status)}
+}
@@ -0,0 +1,153 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+// subBucketBits controls the precision of the histogram. Each power of two
+// range is split into 2^(subBucketBits-1) linear buckets, which keeps the
+// relative error of a recorded value below 1%.
+const subBucketBits = 8
+
+// histogram is a log-linear latency histogram with microsecond resolution.
+// It uses a fixed amount of memory regardless of how many values are
+// recorded.
+type histogram struct {
+	counts []int64
+	count  int64
+	sum    int64
+	min    int64
+	max    int64
+}
+
+func newHistogram() *histogram {
+	return &histogram{min: math.MaxInt64}
+}
+
+func bucketIndex(v int64) int {
+	if v < 1<<subBucketBits {
+		return int(v)
+	}
+	shift := bits.Len64(uint64(v)) - subBucketBits
+	half := int64(1) << (subBucketBits - 1)
+	return int(1<<subBucketBits + int64(shift-1)*half + (v >> uint(shift)) - half)
+}
+
+// bucketUpperBound returns the largest value that maps to bucket i.
+func bucketUpperBound(i int) int64 {
+	if i < 1<<subBucketBits {
+		return int64(i)
+	}
+	half := 1 << (subBucketBits - 1)
+	shift := uint((i-1<<subBucketBits)/half + 1)
+	m := int64((i-1<<subBucketBits)%half + half)
+	return (m+1)<<shift - 1
+}
+
+// Record adds a single latency to the histogram.
+func (h *histogram) Record(d time.Duration) {
+	v := int64(d / time.Microsecond)
+	if v < 0 {
+		v = 0
+	}
+	i := bucketIndex(v)
+	if i >= len(h.counts) {
+		counts := make([]int64, i+1)
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+	h.counts[i]++
+	h.count++
+	h.sum += v
+	if v < h.min {
+		h.min = v
+	}
+	if v > h.max {
+		h.max = v
+	}
+}
+
+// Merge adds all values recorded in o to h.
+func (h *histogram) Merge(o *histogram) {
+	if len(o.counts) > len(h.counts) {
+		counts := make([]int64, len(o.counts))
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	h.count += o.count
+	h.sum += o.sum
+	if o.min < h.min {
+		h.min = o.min
+	}
+	if o.max > h.max {
+		h.max = o.max
+	}
+}
+
+// Count returns the number of recorded values.
+func (h *histogram) Count() int64 {
+	return h.count
+}
+
+// Min returns the smallest recorded value.
+func (h *histogram) Min() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return time.Duration(h.min) * time.Microsecond
+}
+
+// Max returns the largest recorded value.
+func (h *histogram) Max() time.Duration {
+	return time.Duration(h.max) * time.Microsecond
+}
+
+// Mean returns the average of the recorded values.
+func (h *histogram) Mean() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return time.Duration(h.sum/h.count) * time.Microsecond
+}
+
+// Quantile returns the value below which the fraction q of the recorded
+// values fall, e.g. Quantile(0.99) returns the p99 latency.
+func (h *histogram) Quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(h.count)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			v := bucketUpperBound(i)
+			if v > h.max {
+				v = h.max
+			}
+			return time.Duration(v) * time.Microsecond
+		}
+	}
+	return h.Max()
+}
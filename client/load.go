@@ -0,0 +1,374 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kelseyhightower/ping"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// requester sends a single request to the target under test.
+type requester interface {
+	Do(ctx context.Context) error
+}
+
+type grpcRequester struct {
+	client ping.PingClient
+	md     *metadataFlags
+}
+
+func (r *grpcRequester) Do(ctx context.Context) error {
+	_, err := r.client.Ping(r.md.newContext(ctx), &ping.Request{})
+	return err
+}
+
+type httpRequester struct {
+	client *http.Client
+	url    string
+	md     *metadataFlags
+}
+
+// httpStatusError is returned for HTTP responses other than 200 OK.
+type httpStatusError struct {
+	code int
+}
+
+func (e httpStatusError) Error() string {
+	return fmt.Sprintf("HTTP %d %s", e.code, http.StatusText(e.code))
+}
+
+func (r *httpRequester) Do(ctx context.Context) error {
+	req, err := http.NewRequest("GET", r.url, nil)
+	if err != nil {
+		return err
+	}
+	r.md.setHTTPHeaders(req.Header)
+	resp, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return &httpTransportError{err}
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return httpStatusError{resp.StatusCode}
+	}
+	return nil
+}
+
+// errorCode classifies err for the error breakdown. gRPC errors are keyed by
+// their status code, HTTP errors by their response status.
+func errorCode(err error) string {
+	if err == nil {
+		return codes.OK.String()
+	}
+	switch e := err.(type) {
+	case httpStatusError:
+		return fmt.Sprintf("HTTP %d", e.code)
+	case *httpTransportError:
+		return codes.Unavailable.String()
+	}
+	if err == context.DeadlineExceeded {
+		return codes.DeadlineExceeded.String()
+	}
+	return grpc.Code(err).String()
+}
+
+// httpTransportError wraps errors returned by the HTTP client before a
+// response was received.
+type httpTransportError struct {
+	err error
+}
+
+func (e *httpTransportError) Error() string {
+	return e.err.Error()
+}
+
+// loadStats collects the results of a load run.
+type loadStats struct {
+	mu       sync.Mutex
+	latency  *histogram
+	codes    map[string]int64
+	requests int64
+	errors   int64
+}
+
+func newLoadStats() *loadStats {
+	return &loadStats{
+		latency: newHistogram(),
+		codes:   make(map[string]int64),
+	}
+}
+
+func (s *loadStats) record(d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	s.codes[errorCode(err)]++
+	if err != nil {
+		s.errors++
+		return
+	}
+	s.latency.Record(d)
+}
+
+// loadConfig holds the settings of a load run.
+type loadConfig struct {
+	concurrency int
+	qps         float64
+	openLoop    bool
+	duration    time.Duration
+	warmup      time.Duration
+	timeout     time.Duration
+}
+
+func runLoad(args []string) {
+	var (
+		serverAddr string
+		url        string
+		protocol   string
+		mode       string
+		output     string
+		md         metadataFlags
+		tlsOpts    tlsFlags
+		cfg        loadConfig
+	)
+
+	fs := flag.NewFlagSet("load", flag.ExitOnError)
+	fs.StringVar(&serverAddr, "server", "127.0.0.1:8080", "The ping server address")
+	fs.StringVar(&url, "url", "http://127.0.0.1/ping", "The HTTP ping endpoint, used when -protocol is http")
+	fs.StringVar(&protocol, "protocol", "grpc", "The protocol to load test: grpc or http")
+	fs.StringVar(&mode, "mode", "closed", "The load model: closed (wait for responses) or open (fixed arrival rate)")
+	fs.IntVar(&cfg.concurrency, "c", 10, "The number of concurrent workers in closed mode")
+	fs.Float64Var(&cfg.qps, "qps", 0, "The target requests per second across all workers; 0 means as fast as possible in closed mode")
+	fs.DurationVar(&cfg.duration, "duration", 10*time.Second, "How long to measure for after the warm-up")
+	fs.DurationVar(&cfg.warmup, "warmup", 2*time.Second, "How long to send requests before measuring")
+	fs.DurationVar(&cfg.timeout, "timeout", 5*time.Second, "The per request timeout")
+	fs.StringVar(&output, "o", "table", "The output format: table, json, jsonl or csv")
+	md.register(fs)
+	tlsOpts.register(fs)
+	fs.Parse(args)
+
+	out, err := newResultWriter(output, os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg.concurrency < 1 {
+		log.Fatal("-c must be at least 1")
+	}
+	switch mode {
+	case "closed":
+	case "open":
+		if cfg.qps <= 0 {
+			log.Fatal("-qps is required in open mode")
+		}
+		cfg.openLoop = true
+	default:
+		log.Fatalf("Unknown load mode %q", mode)
+	}
+
+	var (
+		r      requester
+		target string
+	)
+	switch protocol {
+	case "grpc":
+		securityOpt, err := tlsOpts.dialOption()
+		if err != nil {
+			log.Fatal(err)
+		}
+		conn, err := grpc.Dial(serverAddr, securityOpt)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer conn.Close()
+		r = &grpcRequester{ping.NewPingClient(conn), &md}
+		target = serverAddr
+	case "http":
+		tlsConfig, err := tlsOpts.config()
+		if err != nil {
+			log.Fatal(err)
+		}
+		transport := &http.Transport{
+			MaxIdleConnsPerHost: cfg.concurrency,
+			TLSClientConfig:     tlsConfig,
+		}
+		r = &httpRequester{&http.Client{Transport: transport}, url, &md}
+		target = url
+	default:
+		log.Fatalf("Unknown protocol %q", protocol)
+	}
+
+	s := generateLoad(r, cfg)
+	s.Target = target
+	out.WriteSummary(s)
+	if err := out.Flush(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// generateLoad drives r according to cfg and returns the measured results.
+//
+// In closed mode each of cfg.concurrency workers sends its next request
+// only after the previous one completed, optionally throttled to cfg.qps.
+// In open mode requests are sent at a fixed rate regardless of how fast
+// the target responds, each from its own goroutine so that slow responses
+// do not delay the next request, and latency is measured from the
+// scheduled start time so queueing delay is not hidden (coordinated
+// omission).
+//
+// A request is measured if it was started during the measurement window.
+// The run waits for the requests still in flight when the window closes,
+// so that the slowest responses are not left out of the results.
+func generateLoad(r requester, cfg loadConfig) *summary {
+	var (
+		mu       sync.Mutex
+		stats    = newLoadStats()
+		measured bool
+		start    time.Time
+	)
+
+	// Requests started during the warm-up are not measured.
+	current := func() *loadStats {
+		mu.Lock()
+		defer mu.Unlock()
+		if !measured {
+			return nil
+		}
+		return stats
+	}
+
+	send := func(begin time.Time, s *loadStats) {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.timeout)
+		err := r.Do(ctx)
+		cancel()
+		if s != nil {
+			s.record(time.Since(begin), err)
+		}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	if cfg.openLoop {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			interval := time.Duration(float64(time.Second) / cfg.qps)
+			next := time.Now()
+			for {
+				if d := time.Until(next); d > 0 {
+					select {
+					case <-time.After(d):
+					case <-done:
+						return
+					}
+				}
+				select {
+				case <-done:
+					return
+				default:
+				}
+				wg.Add(1)
+				go func(scheduled time.Time, s *loadStats) {
+					defer wg.Done()
+					send(scheduled, s)
+				}(next, current())
+				next = next.Add(interval)
+			}
+		}()
+	} else {
+		schedule := make(chan struct{}, cfg.concurrency)
+		go func() {
+			defer close(schedule)
+			if cfg.qps <= 0 {
+				for {
+					select {
+					case schedule <- struct{}{}:
+					case <-done:
+						return
+					}
+				}
+			}
+
+			ticker := time.NewTicker(time.Duration(float64(time.Second) / cfg.qps))
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					select {
+					case schedule <- struct{}{}:
+					default:
+						// All workers are busy; drop the tick.
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+
+		for i := 0; i < cfg.concurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range schedule {
+					send(time.Now(), current())
+				}
+			}()
+		}
+	}
+
+	time.Sleep(cfg.warmup)
+	mu.Lock()
+	measured = true
+	start = time.Now()
+	mu.Unlock()
+
+	time.Sleep(cfg.duration)
+	mu.Lock()
+	measured = false
+	elapsed := time.Since(start)
+	mu.Unlock()
+
+	close(done)
+	wg.Wait()
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	return &summary{
+		Duration:   elapsed,
+		Requests:   stats.requests,
+		Errors:     stats.errors,
+		Throughput: float64(stats.requests) / elapsed.Seconds(),
+		Latency:    stats.latency,
+		Codes:      stats.codes,
+	}
+}
@@ -16,41 +16,77 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
-
-	"github.com/kelseyhightower/ping"
-
-	"golang.org/x/net/context"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/metadata"
+	"os"
+	"strings"
 )
 
 const (
 	version = "v1.0.0"
 )
 
-var (
-	serverAddr string
-)
+const usage = `Usage: client [command] [flags]
 
-func main() {
-	flag.StringVar(&serverAddr, "server", "127.0.0.1:8080", "The ping server address")
-	flag.Parse()
+Commands:
+  ping       Send a single ping (default)
+  load       Generate load and report latency percentiles
+  health     Check the health of a server
+  list       List the services of a server, or the methods of a service
+  describe   Describe a service, method, message or enum
+  call       Call any method with JSON input and output
+  sample     Check the bar and foo version split against expected weights
+  endpoints  Ping every endpoint a name resolves to and report each separately
+  probe      Run probes on a schedule and export the results as Prometheus metrics
 
-	conn, err := grpc.Dial(serverAddr, grpc.WithInsecure())
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer conn.Close()
+Run 'client <command> -h' for the flags of each command.
+`
 
-	c := ping.NewPingClient(conn)
+func main() {
+	command := "ping"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
+	}
 
-	md := metadata.New(map[string]string{})
-	response, err := c.Ping(context.Background(), &ping.Request{}, grpc.Trailer(&md))
-	if err != nil {
-		log.Fatal(err)
+	switch command {
+	case "ping":
+		runPing(args)
+	case "load":
+		runLoad(args)
+	case "health":
+		runHealth(args)
+	case "list":
+		runList(args)
+	case "describe":
+		runDescribe(args)
+	case "call":
+		runCall(args)
+	case "sample":
+		runSample(args)
+	case "endpoints":
+		runEndpoints(args)
+	case "probe":
+		runProbe(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
 	}
+}
 
-	fmt.Printf("%v\n", md)
-	fmt.Println(response.Message)
+// parseArgs parses args with fs and returns the positional arguments. Unlike
+// fs.Parse it also accepts flags after positional arguments, so commands
+// can be written as 'client call ping.Ping/Ping -d {}'.
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
 }
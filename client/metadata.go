@@ -0,0 +1,113 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+// headerFlags collects repeated -H key:value flags.
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(value string) error {
+	i := strings.Index(value, ":")
+	if i <= 0 {
+		return fmt.Errorf("header %q must be in the form key:value", value)
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+// metadataFlags holds the request metadata shared by all commands that
+// send pings. The presets set the headers the frontend forwards to bar and
+// foo, which the Istio route rules match on.
+type metadataFlags struct {
+	headers   headerFlags
+	userAgent string
+	requestID string
+	token     string
+}
+
+func (f *metadataFlags) register(fs *flag.FlagSet) {
+	fs.Var(&f.headers, "H", "A request header in the form key:value; may be repeated")
+	fs.StringVar(&f.userAgent, "user-agent", "", "Set the x-forwarded-user-agent header, e.g. mobile to match the bar-canary route rule")
+	fs.StringVar(&f.requestID, "request-id", "", "Set the x-request-id header")
+	fs.StringVar(&f.token, "token", "", "The bearer token (API key or JWT) sent in the authorization header")
+}
+
+// metadata returns the outgoing gRPC metadata. Keys are lower cased as
+// required by HTTP/2.
+func (f *metadataFlags) metadata() metadata.MD {
+	md := metadata.MD{}
+	for _, header := range f.headers {
+		i := strings.Index(header, ":")
+		key := strings.ToLower(strings.TrimSpace(header[:i]))
+		md[key] = append(md[key], strings.TrimSpace(header[i+1:]))
+	}
+	if f.userAgent != "" {
+		md["x-forwarded-user-agent"] = []string{f.userAgent}
+	}
+	if f.requestID != "" {
+		md["x-request-id"] = []string{f.requestID}
+	}
+	if f.token != "" {
+		md["authorization"] = []string{"Bearer " + f.token}
+	}
+	return md
+}
+
+// newContext returns a child of ctx carrying the outgoing metadata.
+func (f *metadataFlags) newContext(ctx context.Context) context.Context {
+	return metadata.NewOutgoingContext(ctx, f.metadata())
+}
+
+// setHTTPHeaders sets the headers on an HTTP request. The HTTP gateway of
+// the frontend turns User-Agent into x-forwarded-user-agent itself.
+func (f *metadataFlags) setHTTPHeaders(h http.Header) {
+	for key, values := range f.metadata() {
+		if key == "x-forwarded-user-agent" {
+			key = "user-agent"
+		}
+		for _, v := range values {
+			h.Add(key, v)
+		}
+	}
+}
+
+// printMetadata writes md with one key: value line per value, each line
+// starting with prefix.
+func printMetadata(w io.Writer, prefix string, md metadata.MD) {
+	keys := make([]string, 0, len(md))
+	for k := range md {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range md[k] {
+			fmt.Fprintf(w, "%s%s: %s\n", prefix, k, v)
+		}
+	}
+}
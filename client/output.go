@@ -0,0 +1,417 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// outputFormats lists the values accepted by the -o flag.
+var outputFormats = []string{"table", "json", "jsonl", "csv"}
+
+// result is the outcome of a single request. The field names are part of the
+// machine-readable output and must not change.
+type result struct {
+	Timestamp  time.Time
+	Sequence   int64
+	Target     string
+	Latency    time.Duration
+	Code       string
+	Hostname   string
+	Region     string
+	Version    string
+	BarVersion string
+	FooVersion string
+	RequestID  string
+	Error      string
+}
+
+// summary aggregates the results of a continuous mode.
+type summary struct {
+	Target     string
+	Duration   time.Duration
+	Requests   int64
+	Errors     int64
+	Throughput float64
+	Latency    *histogram
+	Codes      map[string]int64
+}
+
+var summaryQuantiles = []struct {
+	name string
+	q    float64
+}{
+	{"p50", 0.50},
+	{"p90", 0.90},
+	{"p99", 0.99},
+	{"p99.9", 0.999},
+}
+
+// resultWriter renders results and summaries in one of the output formats.
+type resultWriter interface {
+	WriteResult(r *result) error
+	WriteSummary(s *summary) error
+	// WriteEndpointReport writes the report of the endpoints command.
+	WriteEndpointReport(r *endpointReport) error
+	Flush() error
+}
+
+func newResultWriter(format string, w io.Writer) (resultWriter, error) {
+	switch format {
+	case "table":
+		return &tableWriter{w: w}, nil
+	case "json":
+		return &jsonWriter{w: w}, nil
+	case "jsonl":
+		return &jsonlWriter{enc: json.NewEncoder(w)}, nil
+	case "csv":
+		return &csvWriter{w: csv.NewWriter(w)}, nil
+	}
+	return nil, fmt.Errorf("unknown output format %q, must be one of %s",
+		format, strings.Join(outputFormats, ", "))
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+type jsonResult struct {
+	Type       string  `json:"type,omitempty"`
+	Timestamp  string  `json:"timestamp"`
+	Sequence   int64   `json:"sequence"`
+	Target     string  `json:"target"`
+	LatencyMs  float64 `json:"latency_ms"`
+	Code       string  `json:"code"`
+	Hostname   string  `json:"hostname"`
+	Region     string  `json:"region"`
+	Version    string  `json:"version"`
+	BarVersion string  `json:"bar_version"`
+	FooVersion string  `json:"foo_version"`
+	RequestID  string  `json:"request_id"`
+	Error      string  `json:"error,omitempty"`
+}
+
+func newJSONResult(r *result) *jsonResult {
+	return &jsonResult{
+		Timestamp:  r.Timestamp.UTC().Format(time.RFC3339Nano),
+		Sequence:   r.Sequence,
+		Target:     r.Target,
+		LatencyMs:  milliseconds(r.Latency),
+		Code:       r.Code,
+		Hostname:   r.Hostname,
+		Region:     r.Region,
+		Version:    r.Version,
+		BarVersion: r.BarVersion,
+		FooVersion: r.FooVersion,
+		RequestID:  r.RequestID,
+		Error:      r.Error,
+	}
+}
+
+type jsonSummary struct {
+	Type       string             `json:"type,omitempty"`
+	Target     string             `json:"target"`
+	DurationMs float64            `json:"duration_ms"`
+	Requests   int64              `json:"requests"`
+	Errors     int64              `json:"errors"`
+	Throughput float64            `json:"throughput"`
+	LatencyMs  map[string]float64 `json:"latency_ms"`
+	Codes      map[string]int64   `json:"codes"`
+}
+
+// latencySummary returns the latency statistics of h in milliseconds, keyed
+// by min, max, mean and the summary quantiles.
+func latencySummary(h *histogram) map[string]float64 {
+	latency := map[string]float64{
+		"min":  milliseconds(h.Min()),
+		"max":  milliseconds(h.Max()),
+		"mean": milliseconds(h.Mean()),
+	}
+	for _, sq := range summaryQuantiles {
+		latency[sq.name] = milliseconds(h.Quantile(sq.q))
+	}
+	return latency
+}
+
+func newJSONSummary(s *summary) *jsonSummary {
+	return &jsonSummary{
+		Target:     s.Target,
+		DurationMs: milliseconds(s.Duration),
+		Requests:   s.Requests,
+		Errors:     s.Errors,
+		Throughput: s.Throughput,
+		LatencyMs:  latencySummary(s.Latency),
+		Codes:      s.Codes,
+	}
+}
+
+// jsonWriter buffers everything and writes a single JSON document on Flush.
+type jsonWriter struct {
+	w       io.Writer
+	results []*jsonResult
+	summary *jsonSummary
+	report  *jsonEndpointReport
+}
+
+func (j *jsonWriter) WriteResult(r *result) error {
+	j.results = append(j.results, newJSONResult(r))
+	return nil
+}
+
+func (j *jsonWriter) WriteSummary(s *summary) error {
+	j.summary = newJSONSummary(s)
+	return nil
+}
+
+func (j *jsonWriter) Flush() error {
+	var doc interface{} = j.report
+	if j.report == nil {
+		results := j.results
+		if results == nil {
+			results = []*jsonResult{}
+		}
+		doc = &struct {
+			Results []*jsonResult `json:"results"`
+			Summary *jsonSummary  `json:"summary,omitempty"`
+		}{results, j.summary}
+	}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(j.w, "%s\n", data)
+	return err
+}
+
+// jsonlWriter writes one JSON object per line as soon as it is available.
+// The type field tells results and summaries apart.
+type jsonlWriter struct {
+	enc *json.Encoder
+}
+
+func (j *jsonlWriter) WriteResult(r *result) error {
+	jr := newJSONResult(r)
+	jr.Type = "result"
+	return j.enc.Encode(jr)
+}
+
+func (j *jsonlWriter) WriteSummary(s *summary) error {
+	js := newJSONSummary(s)
+	js.Type = "summary"
+	return j.enc.Encode(js)
+}
+
+func (j *jsonlWriter) Flush() error {
+	return nil
+}
+
+var csvResultHeader = []string{
+	"timestamp", "sequence", "target", "latency_ms", "code", "hostname",
+	"region", "version", "bar_version", "foo_version", "error", "request_id",
+}
+
+var csvSummaryHeader = []string{
+	"target", "duration_ms", "requests", "errors", "throughput",
+	"latency_min_ms", "latency_p50_ms", "latency_p90_ms", "latency_p99_ms",
+	"latency_p99.9_ms", "latency_max_ms", "latency_mean_ms", "codes",
+}
+
+// csvWriter writes results as CSV rows. A summary is written as a second
+// table, separated from the results by an empty line.
+type csvWriter struct {
+	w          *csv.Writer
+	wroteTable bool
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', 3, 64)
+}
+
+func (c *csvWriter) WriteResult(r *result) error {
+	if !c.wroteTable {
+		c.w.Write(csvResultHeader)
+		c.wroteTable = true
+	}
+	c.w.Write([]string{
+		r.Timestamp.UTC().Format(time.RFC3339Nano),
+		strconv.FormatInt(r.Sequence, 10),
+		r.Target,
+		formatFloat(milliseconds(r.Latency)),
+		r.Code,
+		r.Hostname,
+		r.Region,
+		r.Version,
+		r.BarVersion,
+		r.FooVersion,
+		r.Error,
+		r.RequestID,
+	})
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvWriter) WriteSummary(s *summary) error {
+	if c.wroteTable {
+		c.w.Flush()
+		c.w.Write(nil)
+	}
+	c.w.Write(csvSummaryHeader)
+	row := []string{
+		s.Target,
+		formatFloat(milliseconds(s.Duration)),
+		strconv.FormatInt(s.Requests, 10),
+		strconv.FormatInt(s.Errors, 10),
+		formatFloat(s.Throughput),
+		formatFloat(milliseconds(s.Latency.Min())),
+	}
+	for _, sq := range summaryQuantiles {
+		row = append(row, formatFloat(milliseconds(s.Latency.Quantile(sq.q))))
+	}
+	row = append(row,
+		formatFloat(milliseconds(s.Latency.Max())),
+		formatFloat(milliseconds(s.Latency.Mean())),
+		formatCodes(s.Codes, ";"),
+	)
+	c.w.Write(row)
+	c.wroteTable = true
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func sortedCodes(m map[string]int64) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func formatCodes(m map[string]int64, sep string) string {
+	var parts []string
+	for _, name := range sortedCodes(m) {
+		parts = append(parts, fmt.Sprintf("%s=%d", name, m[name]))
+	}
+	return strings.Join(parts, sep)
+}
+
+// tableColumns are the columns of the results of a tableWriter.
+var tableColumns = []string{"SEQ", "TARGET", "LATENCY", "CODE", "HOSTNAME", "REGION", "VERSION", "BAR", "FOO", "REQUEST ID", "ERROR"}
+
+// minColumnWidths are the least widths of the columns, wide enough for
+// most of their values: a latency such as 123.456ms, the longest status
+// code and a request ID.
+var minColumnWidths = []int{5, 0, 10, 16, 0, 0, 0, 0, 0, 36, 0}
+
+// tableWriter writes human readable output. Every result is written as
+// soon as it is received, so the widths of the columns are set by the
+// header and the first result; longer values in later results shift the
+// rest of their row.
+type tableWriter struct {
+	w      io.Writer
+	widths []int
+}
+
+func (t *tableWriter) WriteResult(r *result) error {
+	row := []string{
+		strconv.FormatInt(r.Sequence, 10), r.Target, r.Latency.Round(time.Microsecond).String(), r.Code,
+		dash(r.Hostname), dash(r.Region), dash(r.Version),
+		dash(r.BarVersion), dash(r.FooVersion), dash(r.RequestID), dash(r.Error),
+	}
+	if t.widths == nil {
+		t.widths = make([]int, len(tableColumns))
+		for i, name := range tableColumns {
+			t.widths[i] = minColumnWidths[i]
+			if n := len(name); n > t.widths[i] {
+				t.widths[i] = n
+			}
+			if n := len(row[i]); n > t.widths[i] {
+				t.widths[i] = n
+			}
+		}
+		if err := t.writeRow(tableColumns); err != nil {
+			return err
+		}
+	}
+	return t.writeRow(row)
+}
+
+// writeRow writes the cells of a row padded to the widths of their
+// columns, separated by two spaces. The last cell is not padded.
+func (t *tableWriter) writeRow(cells []string) error {
+	var b bytes.Buffer
+	for i, cell := range cells {
+		if i == len(cells)-1 {
+			b.WriteString(cell)
+			break
+		}
+		fmt.Fprintf(&b, "%-*s  ", t.widths[i], cell)
+	}
+	b.WriteByte('\n')
+	_, err := t.w.Write(b.Bytes())
+	return err
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func (t *tableWriter) WriteSummary(s *summary) error {
+	if t.widths != nil {
+		fmt.Fprintln(t.w)
+	}
+	tw := tabwriter.NewWriter(t.w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Target:\t%s\n", s.Target)
+	fmt.Fprintf(tw, "Duration:\t%s\n", s.Duration.Round(time.Millisecond))
+	fmt.Fprintf(tw, "Requests:\t%d\n", s.Requests)
+	fmt.Fprintf(tw, "Errors:\t%d\n", s.Errors)
+	fmt.Fprintf(tw, "Throughput:\t%.1f req/s\n", s.Throughput)
+	fmt.Fprintln(tw)
+
+	fmt.Fprintln(tw, "Latency:")
+	fmt.Fprintf(tw, "  min\t%s\n", s.Latency.Min())
+	for _, sq := range summaryQuantiles {
+		fmt.Fprintf(tw, "  %s\t%s\n", sq.name, s.Latency.Quantile(sq.q))
+	}
+	fmt.Fprintf(tw, "  max\t%s\n", s.Latency.Max())
+	fmt.Fprintf(tw, "  mean\t%s\n", s.Latency.Mean())
+	fmt.Fprintln(tw)
+
+	fmt.Fprintln(tw, "Status codes:")
+	for _, name := range sortedCodes(s.Codes) {
+		fmt.Fprintf(tw, "  %s\t%d\n", name, s.Codes[name])
+	}
+	return tw.Flush()
+}
+
+func (t *tableWriter) Flush() error {
+	return nil
+}
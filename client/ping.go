@@ -0,0 +1,229 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/kelseyhightower/ping"
+	"github.com/kelseyhightower/ping/channelz"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+func runPing(args []string) {
+	var (
+		serverAddr string
+		count      int64
+		interval   time.Duration
+		timeout    time.Duration
+		output     string
+		verbose    bool
+		md         metadataFlags
+		tlsOpts    tlsFlags
+	)
+
+	fs := flag.NewFlagSet("ping", flag.ExitOnError)
+	fs.StringVar(&serverAddr, "server", "127.0.0.1:8080", "The ping server address")
+	fs.Int64Var(&count, "count", 1, "The number of pings to send; 0 pings until interrupted")
+	fs.DurationVar(&interval, "interval", time.Second, "The time to wait between pings")
+	fs.DurationVar(&timeout, "timeout", 5*time.Second, "The per ping timeout")
+	fs.StringVar(&output, "o", "table", "The output format: table, json, jsonl or csv")
+	fs.BoolVar(&verbose, "v", false, "Print the request metadata, the response headers and trailers and the state of the connection to stderr")
+	md.register(fs)
+	tlsOpts.register(fs)
+	fs.Parse(args)
+
+	out, err := newResultWriter(output, os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	securityOpt, err := tlsOpts.dialOption()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The state of the connection is only tracked when it is printed.
+	dialOpts := []grpc.DialOption{securityOpt}
+	var channel *channelz.Channel
+	if verbose {
+		channel = channelz.NewChannel("server", serverAddr)
+		dialOpts = append(dialOpts,
+			grpc.WithDialer(channel.Dialer()),
+			grpc.WithUnaryInterceptor(channel.UnaryClientInterceptor()),
+		)
+	}
+	conn, err := grpc.Dial(serverAddr, dialOpts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	// printChannel prints the state of the connection once the pings are
+	// done.
+	printChannel := func() {
+		if verbose {
+			channel.Info().WriteText(os.Stderr)
+			fmt.Fprintln(os.Stderr)
+		}
+	}
+
+	p := &pinger{
+		client:  ping.NewPingClient(conn),
+		target:  serverAddr,
+		timeout: timeout,
+		md:      md.metadata(),
+		verbose: verbose,
+	}
+
+	// Print the negotiated TLS parameters once, to stderr so they don't mix
+	// with machine-readable output.
+	var printedTLS bool
+	printTLS := func(p *peer.Peer) {
+		if printedTLS || p.AuthInfo == nil {
+			return
+		}
+		printTLSInfo(os.Stderr, p)
+		fmt.Fprintln(os.Stderr)
+		printedTLS = true
+	}
+
+	// A single ping only reports its result. Continuous pings also report a
+	// summary, including when they are interrupted.
+	if count == 1 {
+		r, pr := p.send(1)
+		printTLS(pr)
+		printChannel()
+		out.WriteResult(r)
+		if err := out.Flush(); err != nil {
+			log.Fatal(err)
+		}
+		if r.Error != "" {
+			os.Exit(1)
+		}
+		return
+	}
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+
+	s := &summary{
+		Target:  serverAddr,
+		Latency: newHistogram(),
+		Codes:   make(map[string]int64),
+	}
+	start := time.Now()
+
+loop:
+	for seq := int64(1); count == 0 || seq <= count; seq++ {
+		if seq > 1 {
+			select {
+			case <-time.After(interval):
+			case <-signalChan:
+				break loop
+			}
+		}
+
+		r, pr := p.send(seq)
+		printTLS(pr)
+		s.Requests++
+		s.Codes[r.Code]++
+		if r.Error != "" {
+			s.Errors++
+		} else {
+			s.Latency.Record(r.Latency)
+		}
+		if err := out.WriteResult(r); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	s.Duration = time.Since(start)
+	s.Throughput = float64(s.Requests) / s.Duration.Seconds()
+	printChannel()
+	out.WriteSummary(s)
+	if err := out.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	if s.Errors > 0 {
+		os.Exit(1)
+	}
+}
+
+// pinger sends pings with the same request metadata.
+type pinger struct {
+	client  ping.PingClient
+	target  string
+	timeout time.Duration
+	md      metadata.MD
+	// verbose prints the metadata sent and received to stderr, which
+	// shows the headers the route rules matched on.
+	verbose bool
+}
+
+// send sends a single ping and converts the response header and trailer
+// into a result. It also returns the peer that answered the ping.
+func (p *pinger) send(seq int64) (*result, *peer.Peer) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	ctx = metadata.NewOutgoingContext(ctx, p.md)
+
+	var header, trailer metadata.MD
+	pr := &peer.Peer{}
+	start := time.Now()
+	_, err := p.client.Ping(ctx, &ping.Request{}, grpc.Header(&header), grpc.Trailer(&trailer), grpc.Peer(pr))
+
+	r := &result{
+		Timestamp:  start,
+		Sequence:   seq,
+		Target:     p.target,
+		Latency:    time.Since(start),
+		Code:       errorCode(err),
+		Hostname:   firstValue(trailer, "hostname"),
+		Region:     firstValue(trailer, "region"),
+		Version:    firstValue(trailer, "version"),
+		BarVersion: firstValue(trailer, "barversion"),
+		FooVersion: firstValue(trailer, "fooversion"),
+		RequestID:  firstValue(header, "x-request-id"),
+	}
+	if err != nil {
+		r.Error = grpc.ErrorDesc(err)
+	}
+
+	if p.verbose {
+		fmt.Fprintf(os.Stderr, "ping %d to %s:\n", seq, p.target)
+		printMetadata(os.Stderr, "> ", p.md)
+		printMetadata(os.Stderr, "< ", header)
+		printMetadata(os.Stderr, "< (trailer) ", trailer)
+		fmt.Fprintln(os.Stderr)
+	}
+	return r, pr
+}
+
+func firstValue(md metadata.MD, key string) string {
+	if v := md[key]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
@@ -0,0 +1,404 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kelseyhightower/ping"
+	"github.com/kelseyhightower/ping/internal/yaml"
+	"github.com/kelseyhightower/ping/metrics"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+// duration is a time.Duration that is written as a string such as "10s"
+// in the configuration file.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid duration %s, must be a string such as 10s", data)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// probeConfig is the configuration file of the probe command.
+type probeConfig struct {
+	// Interval and Timeout are the defaults for probes that do not set
+	// their own.
+	Interval duration     `json:"interval"`
+	Timeout  duration     `json:"timeout"`
+	Probes   []*probeSpec `json:"probes"`
+}
+
+// probeSpec describes a single probe.
+type probeSpec struct {
+	Name     string            `json:"name"`
+	Protocol string            `json:"protocol"`
+	Target   string            `json:"target"`
+	Service  string            `json:"service"`
+	Interval duration          `json:"interval"`
+	Timeout  duration          `json:"timeout"`
+	Headers  map[string]string `json:"headers"`
+	TLS      *probeTLS         `json:"tls"`
+}
+
+type probeTLS struct {
+	CA                 string `json:"ca"`
+	Cert               string `json:"cert"`
+	Key                string `json:"key"`
+	ServerName         string `json:"serverName"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+}
+
+func (t *probeTLS) flags() tlsFlags {
+	if t == nil {
+		return tlsFlags{}
+	}
+	return tlsFlags{
+		enabled:            true,
+		caFile:             t.CA,
+		certFile:           t.Cert,
+		keyFile:            t.Key,
+		serverName:         t.ServerName,
+		insecureSkipVerify: t.InsecureSkipVerify,
+	}
+}
+
+func loadProbeConfig(path string) (*probeConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &probeConfig{
+		Interval: duration(30 * time.Second),
+		Timeout:  duration(5 * time.Second),
+	}
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	if c.Interval <= 0 {
+		return nil, fmt.Errorf("%s: interval must be positive", path)
+	}
+	if c.Timeout <= 0 {
+		return nil, fmt.Errorf("%s: timeout must be positive", path)
+	}
+	if len(c.Probes) == 0 {
+		return nil, fmt.Errorf("%s: no probes configured", path)
+	}
+	names := make(map[string]bool)
+	for i, p := range c.Probes {
+		if p.Name == "" {
+			return nil, fmt.Errorf("%s: probe %d has no name", path, i)
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("%s: duplicate probe %q", path, p.Name)
+		}
+		names[p.Name] = true
+		switch p.Protocol {
+		case "grpc", "grpc-health", "http":
+		default:
+			return nil, fmt.Errorf("%s: probe %q: unknown protocol %q, must be grpc, grpc-health or http", path, p.Name, p.Protocol)
+		}
+		if p.Target == "" {
+			return nil, fmt.Errorf("%s: probe %q has no target", path, p.Name)
+		}
+		if p.Interval == 0 {
+			p.Interval = c.Interval
+		}
+		if p.Timeout == 0 {
+			p.Timeout = c.Timeout
+		}
+		if p.Interval < 0 {
+			return nil, fmt.Errorf("%s: probe %q: interval must be positive", path, p.Name)
+		}
+		if p.Timeout < 0 {
+			return nil, fmt.Errorf("%s: probe %q: timeout must be positive", path, p.Name)
+		}
+	}
+	return c, nil
+}
+
+// probeResult is the outcome of a single probe. Versions maps the
+// component that reported a version (server, bar or foo) to the version.
+type probeResult struct {
+	code     string
+	versions map[string]string
+	err      error
+}
+
+// prober runs one kind of probe against a target.
+type prober interface {
+	probe(ctx context.Context) *probeResult
+}
+
+type grpcProber struct {
+	client ping.PingClient
+	md     metadata.MD
+}
+
+func (p *grpcProber) probe(ctx context.Context) *probeResult {
+	var trailer metadata.MD
+	_, err := p.client.Ping(metadata.NewOutgoingContext(ctx, p.md), &ping.Request{}, grpc.Trailer(&trailer))
+	return &probeResult{
+		code: errorCode(err),
+		versions: map[string]string{
+			"server": firstValue(trailer, "version"),
+			"bar":    firstValue(trailer, "barversion"),
+			"foo":    firstValue(trailer, "fooversion"),
+		},
+		err: err,
+	}
+}
+
+type healthProber struct {
+	client  healthpb.HealthClient
+	service string
+	md      metadata.MD
+}
+
+func (p *healthProber) probe(ctx context.Context) *probeResult {
+	resp, err := p.client.Check(metadata.NewOutgoingContext(ctx, p.md), &healthpb.HealthCheckRequest{Service: p.service})
+	if err != nil {
+		return &probeResult{code: errorCode(err), err: err}
+	}
+	status := resp.Status.String()
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return &probeResult{code: status, err: fmt.Errorf("service %q is %s", p.service, status)}
+	}
+	return &probeResult{code: status}
+}
+
+type httpProber struct {
+	client  *http.Client
+	url     string
+	headers map[string]string
+}
+
+func (p *httpProber) probe(ctx context.Context) *probeResult {
+	req, err := http.NewRequest("GET", p.url, nil)
+	if err != nil {
+		return &probeResult{code: errorCode(err), err: err}
+	}
+	for k, v := range p.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		} else {
+			err = &httpTransportError{err}
+		}
+		return &probeResult{code: errorCode(err), err: err}
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = httpStatusError{resp.StatusCode}
+	}
+	if err != nil {
+		return &probeResult{code: errorCode(err), err: err}
+	}
+
+	// The frontend reports the versions in the JSON body.
+	var r struct {
+		Version    string `json:"version"`
+		BarVersion string `json:"bar_version"`
+		FooVersion string `json:"foo_version"`
+	}
+	json.Unmarshal(body, &r)
+	return &probeResult{
+		code:     errorCode(nil),
+		versions: map[string]string{"server": r.Version, "bar": r.BarVersion, "foo": r.FooVersion},
+	}
+}
+
+// probeMetrics holds the metrics exported by the probe command.
+type probeMetrics struct {
+	registry    *metrics.Registry
+	success     *metrics.GaugeVec
+	duration    *metrics.HistogramVec
+	total       *metrics.CounterVec
+	lastSuccess *metrics.GaugeVec
+	versions    *metrics.CounterVec
+}
+
+func newProbeMetrics() *probeMetrics {
+	r := metrics.NewRegistry()
+	labels := []string{"probe", "protocol", "target"}
+	return &probeMetrics{
+		registry: r,
+		success: r.NewGaugeVec("probe_success",
+			"Whether the last probe succeeded.", labels...),
+		duration: r.NewHistogramVec("probe_duration_seconds",
+			"The duration of probes.", metrics.DefaultBuckets, labels...),
+		total: r.NewCounterVec("probe_total",
+			"The number of probes by result code.", append(labels, "code")...),
+		lastSuccess: r.NewGaugeVec("probe_last_success_timestamp_seconds",
+			"The time of the last successful probe.", labels...),
+		versions: r.NewCounterVec("probe_observed_version_total",
+			"The number of successful probes by the version a component reported.", append(labels, "component", "version")...),
+	}
+}
+
+// scheduleProbe runs p on its schedule until ctx is done.
+func scheduleProbe(ctx context.Context, spec *probeSpec, p prober, m *probeMetrics) {
+	labels := []string{spec.Name, spec.Protocol, spec.Target}
+	interval := time.Duration(spec.Interval)
+
+	// Spread the first probes over the interval so they do not all run at
+	// the same time.
+	select {
+	case <-time.After(time.Duration(rand.Int63n(int64(interval)))):
+	case <-ctx.Done():
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		probeCtx, cancel := context.WithTimeout(ctx, time.Duration(spec.Timeout))
+		start := time.Now()
+		r := p.probe(probeCtx)
+		elapsed := time.Since(start)
+		cancel()
+
+		m.duration.With(labels...).Observe(elapsed.Seconds())
+		m.total.With(append(labels, r.code)...).Inc()
+		if r.err != nil {
+			m.success.With(labels...).Set(0)
+			log.Printf("Probe %s of %s failed after %s: %v", spec.Name, spec.Target, elapsed, r.err)
+		} else {
+			m.success.With(labels...).Set(1)
+			m.lastSuccess.With(labels...).Set(float64(start.UnixNano()) / 1e9)
+			for component, version := range r.versions {
+				if version != "" {
+					m.versions.With(append(labels, component, version)...).Inc()
+				}
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// newProber creates the prober for spec.
+func newProber(spec *probeSpec) (prober, io.Closer, error) {
+	tlsOpts := spec.TLS.flags()
+	md := metadata.MD{}
+	for k, v := range spec.Headers {
+		md[strings.ToLower(k)] = []string{v}
+	}
+
+	if spec.Protocol == "http" {
+		tlsConfig, err := tlsOpts.config()
+		if err != nil {
+			return nil, nil, err
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		return &httpProber{client, spec.Target, spec.Headers}, nil, nil
+	}
+
+	securityOpt, err := tlsOpts.dialOption()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := grpc.Dial(spec.Target, securityOpt)
+	if err != nil {
+		return nil, nil, err
+	}
+	if spec.Protocol == "grpc-health" {
+		return &healthProber{healthpb.NewHealthClient(conn), spec.Service, md}, conn, nil
+	}
+	return &grpcProber{ping.NewPingClient(conn), md}, conn, nil
+}
+
+func runProbe(args []string) {
+	var (
+		configFile string
+		listenAddr string
+	)
+
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	fs.StringVar(&configFile, "config", "", "The probe configuration file (required)")
+	fs.StringVar(&listenAddr, "listen", "127.0.0.1:9115", "The address to serve the metrics on")
+	fs.Parse(args)
+
+	if configFile == "" {
+		log.Fatal("-config is required")
+	}
+	config, err := loadProbeConfig(configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	m := newProbeMetrics()
+	ctx, cancel := context.WithCancel(context.Background())
+	for _, spec := range config.Probes {
+		p, closer, err := newProber(spec)
+		if err != nil {
+			log.Fatalf("Probe %s: %v", spec.Name, err)
+		}
+		if closer != nil {
+			defer closer.Close()
+		}
+		log.Printf("Probing %s (%s %s) every %s", spec.Name, spec.Protocol, spec.Target, time.Duration(spec.Interval))
+		go scheduleProbe(ctx, spec, p, m)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.registry)
+	server := &http.Server{Addr: listenAddr, Handler: mux}
+	go func() {
+		log.Printf("Serving metrics on: http://%s/metrics", listenAddr)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	<-signalChan
+	log.Println("Shutdown signal received, exiting...")
+	cancel()
+	server.Shutdown(context.Background())
+}
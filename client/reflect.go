@@ -0,0 +1,399 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+)
+
+// reflectionClient fetches file descriptors from the server reflection
+// service and loads them into a registry.
+type reflectionClient struct {
+	stream rpb.ServerReflection_ServerReflectionInfoClient
+	reg    *registry
+}
+
+func newReflectionClient(ctx context.Context, conn *grpc.ClientConn) (*reflectionClient, error) {
+	stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &reflectionClient{stream, newRegistry()}, nil
+}
+
+func (c *reflectionClient) send(req *rpb.ServerReflectionRequest) (*rpb.ServerReflectionResponse, error) {
+	if err := c.stream.Send(req); err != nil {
+		return nil, err
+	}
+	resp, err := c.stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if e := resp.GetErrorResponse(); e != nil {
+		return nil, fmt.Errorf("reflection error %d: %s", e.ErrorCode, e.ErrorMessage)
+	}
+	return resp, nil
+}
+
+func (c *reflectionClient) listServices() ([]string, error) {
+	resp, err := c.send(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_ListServices{ListServices: "*"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var services []string
+	for _, s := range resp.GetListServicesResponse().GetService() {
+		services = append(services, s.Name)
+	}
+	sort.Strings(services)
+	return services, nil
+}
+
+// loadSymbol loads the file that declares symbol and all of its
+// dependencies.
+func (c *reflectionClient) loadSymbol(symbol string) error {
+	symbol = strings.TrimPrefix(symbol, ".")
+	resp, err := c.send(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: symbol},
+	})
+	if err != nil {
+		// Methods are not symbols known to every server, so retry with
+		// the service that contains the method.
+		if i := strings.LastIndexAny(symbol, "./"); i > 0 {
+			if c.loadSymbol(symbol[:i]) == nil {
+				return nil
+			}
+		}
+		return err
+	}
+	return c.addFiles(resp)
+}
+
+func (c *reflectionClient) loadFile(name string) error {
+	if _, ok := c.reg.files[name]; ok {
+		return nil
+	}
+	resp, err := c.send(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_FileByFilename{FileByFilename: name},
+	})
+	if err != nil {
+		return err
+	}
+	return c.addFiles(resp)
+}
+
+func (c *reflectionClient) addFiles(resp *rpb.ServerReflectionResponse) error {
+	fdr := resp.GetFileDescriptorResponse()
+	if fdr == nil {
+		return fmt.Errorf("unexpected reflection response %v", resp)
+	}
+	for _, data := range fdr.FileDescriptorProto {
+		fd, err := c.reg.addFile(data)
+		if err != nil {
+			return err
+		}
+		for _, dep := range fd.GetDependency() {
+			if err := c.loadFile(dep); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *reflectionClient) Close() error {
+	return c.stream.CloseSend()
+}
+
+// reflectionFlags holds the settings shared by the list, describe and call
+// commands.
+type reflectionFlags struct {
+	serverAddr string
+	timeout    time.Duration
+	md         metadataFlags
+	tlsOpts    tlsFlags
+}
+
+func (f *reflectionFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.serverAddr, "server", "127.0.0.1:8080", "The gRPC server address")
+	fs.DurationVar(&f.timeout, "timeout", 10*time.Second, "The timeout for the whole command")
+	f.md.register(fs)
+	f.tlsOpts.register(fs)
+}
+
+func (f *reflectionFlags) connect() (context.Context, context.CancelFunc, *grpc.ClientConn, *reflectionClient) {
+	securityOpt, err := f.tlsOpts.dialOption()
+	if err != nil {
+		log.Fatal(err)
+	}
+	conn, err := grpc.Dial(f.serverAddr, securityOpt)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	rc, err := newReflectionClient(f.md.newContext(ctx), conn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return ctx, cancel, conn, rc
+}
+
+func runList(args []string) {
+	var rf reflectionFlags
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: client list [flags] [service]")
+		fs.PrintDefaults()
+	}
+	rf.register(fs)
+	positional := parseArgs(fs, args)
+
+	_, cancel, conn, rc := rf.connect()
+	defer cancel()
+	defer conn.Close()
+	defer rc.Close()
+
+	if len(positional) == 0 {
+		services, err := rc.listServices()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, s := range services {
+			fmt.Println(s)
+		}
+		return
+	}
+
+	service := positional[0]
+	if err := rc.loadSymbol(service); err != nil {
+		log.Fatal(err)
+	}
+	s, ok := rc.reg.services[service]
+	if !ok {
+		log.Fatalf("%s is not a service", service)
+	}
+	for _, m := range s.desc.GetMethod() {
+		fmt.Printf("%s.%s\n", s.name, m.GetName())
+	}
+}
+
+func runDescribe(args []string) {
+	var rf reflectionFlags
+	fs := flag.NewFlagSet("describe", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: client describe [flags] <symbol>")
+		fs.PrintDefaults()
+	}
+	rf.register(fs)
+	positional := parseArgs(fs, args)
+
+	if len(positional) != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	_, cancel, conn, rc := rf.connect()
+	defer cancel()
+	defer conn.Close()
+	defer rc.Close()
+
+	symbol := positional[0]
+	if err := rc.loadSymbol(symbol); err != nil {
+		log.Fatal(err)
+	}
+	if err := rc.reg.describe(os.Stdout, symbol); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runCall(args []string) {
+	var (
+		rf      reflectionFlags
+		data    string
+		verbose bool
+	)
+	fs := flag.NewFlagSet("call", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: client call [flags] <package.Service/Method>")
+		fs.PrintDefaults()
+	}
+	rf.register(fs)
+	fs.StringVar(&data, "d", "{}", "The request as JSON; use @ to read from stdin. Client streaming methods accept several JSON objects")
+	fs.BoolVar(&verbose, "v", false, "Print the request metadata and the response headers and trailers to stderr")
+	positional := parseArgs(fs, args)
+
+	if len(positional) != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel, conn, rc := rf.connect()
+	defer cancel()
+	defer conn.Close()
+
+	method := positional[0]
+	if err := rc.loadSymbol(method); err != nil {
+		log.Fatal(err)
+	}
+	rc.Close()
+
+	s, m, err := rc.reg.method(method)
+	if err != nil {
+		log.Fatal(err)
+	}
+	inType, err := rc.reg.message(m.GetInputType())
+	if err != nil {
+		log.Fatal(err)
+	}
+	outType, err := rc.reg.message(m.GetOutputType())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var input io.Reader = strings.NewReader(data)
+	if data == "@" {
+		input = os.Stdin
+	}
+	requests, err := readRequests(input, rc.reg, inType)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !m.GetClientStreaming() && len(requests) != 1 {
+		log.Fatalf("%s expects exactly one request message, got %d", method, len(requests))
+	}
+
+	outgoing := rf.md.metadata()
+	if verbose {
+		printMetadata(os.Stderr, "> ", outgoing)
+	}
+	ctx = metadata.NewOutgoingContext(ctx, outgoing)
+
+	fullMethod := fmt.Sprintf("/%s/%s", s.name, m.GetName())
+	responses := make(chan *dynamicMessage)
+	errc := make(chan error, 1)
+	var header, trailer metadata.MD
+	go func() {
+		defer close(responses)
+		errc <- invokeDynamic(ctx, conn, fullMethod, m.GetClientStreaming(), m.GetServerStreaming(),
+			requests, func() *dynamicMessage { return newDynamicMessage(rc.reg, outType) }, responses, &header, &trailer)
+	}()
+
+	for resp := range responses {
+		data, err := resp.MarshalJSON()
+		if err != nil {
+			log.Fatal(err)
+		}
+		var out bytes.Buffer
+		json.Indent(&out, data, "", "  ")
+		fmt.Println(out.String())
+	}
+	err = <-errc
+	if verbose {
+		printMetadata(os.Stderr, "< ", header)
+		printMetadata(os.Stderr, "< (trailer) ", trailer)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// readRequests decodes a stream of JSON objects into request messages.
+func readRequests(r io.Reader, reg *registry, typ *messageType) ([]*dynamicMessage, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var requests []*dynamicMessage
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		m := newDynamicMessage(reg, typ)
+		if err := m.UnmarshalJSON(raw); err != nil {
+			return nil, err
+		}
+		// Catch unknown fields and type mismatches before calling.
+		if _, err := m.Marshal(); err != nil {
+			return nil, err
+		}
+		requests = append(requests, m)
+	}
+	return requests, nil
+}
+
+// invokeDynamic calls method with the given requests and sends every
+// response on responses. The response header and trailer are stored in
+// header and trailer.
+func invokeDynamic(ctx context.Context, conn *grpc.ClientConn, method string, clientStreaming, serverStreaming bool,
+	requests []*dynamicMessage, newResponse func() *dynamicMessage, responses chan<- *dynamicMessage,
+	header, trailer *metadata.MD) error {
+	if !clientStreaming && !serverStreaming {
+		resp := newResponse()
+		if err := grpc.Invoke(ctx, method, requests[0], resp, conn, grpc.Header(header), grpc.Trailer(trailer)); err != nil {
+			return err
+		}
+		responses <- resp
+		return nil
+	}
+
+	desc := &grpc.StreamDesc{ClientStreams: clientStreaming, ServerStreams: serverStreaming}
+	stream, err := grpc.NewClientStream(ctx, desc, conn, method)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		*header, _ = stream.Header()
+		*trailer = stream.Trailer()
+	}()
+	for _, req := range requests {
+		if err := stream.SendMsg(req); err != nil {
+			return err
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	for {
+		resp := newResponse()
+		err := stream.RecvMsg(resp)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		responses <- resp
+	}
+}
@@ -0,0 +1,341 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kelseyhightower/ping"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// weights maps a version to its expected share of the traffic.
+type weights map[string]float64
+
+// parseWeights parses a list such as "v1=90,v2=10" and normalizes the
+// weights so they add up to 1.
+func parseWeights(s string) (weights, error) {
+	if s == "" {
+		return nil, nil
+	}
+	w := make(weights)
+	var total float64
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			kv = strings.SplitN(part, ":", 2)
+		}
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("weight %q must be in the form version=weight", part)
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("invalid weight %q", part)
+		}
+		w[strings.TrimSpace(kv[0])] = v
+		total += v
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("weights %q add up to zero", s)
+	}
+	for k := range w {
+		w[k] /= total
+	}
+	return w, nil
+}
+
+// distributionCheck is the result of comparing observed version counts
+// against the expected weights.
+type distributionCheck struct {
+	chiSquare  float64
+	df         int
+	pValue     float64
+	unexpected []string
+}
+
+func (c *distributionCheck) ok(alpha float64) bool {
+	return len(c.unexpected) == 0 && c.pValue >= alpha
+}
+
+// checkDistribution runs a chi-square goodness of fit test of the observed
+// counts against the expected weights. Versions that were observed but have
+// no expected weight, or a weight of zero, fail the check outright: a
+// version that must not receive traffic has no expected count to compare
+// with.
+func checkDistribution(observed map[string]int64, expected weights) *distributionCheck {
+	var n int64
+	for _, c := range observed {
+		n += c
+	}
+
+	c := &distributionCheck{}
+	for version, count := range observed {
+		if count > 0 && expected[version] == 0 {
+			c.unexpected = append(c.unexpected, version)
+		}
+	}
+	sort.Strings(c.unexpected)
+
+	categories := 0
+	for version, p := range expected {
+		if p == 0 {
+			continue
+		}
+		categories++
+		e := p * float64(n)
+		d := float64(observed[version]) - e
+		c.chiSquare += d * d / e
+	}
+	c.df = categories - 1
+	c.pValue = chiSquarePValue(c.chiSquare, c.df)
+	return c
+}
+
+// chiSquarePValue returns the probability of a chi-square statistic of at
+// least x with df degrees of freedom.
+func chiSquarePValue(x float64, df int) float64 {
+	if df <= 0 {
+		return 1
+	}
+	return gammaQ(float64(df)/2, x/2)
+}
+
+// gammaQ is the regularized upper incomplete gamma function Q(a, x),
+// computed with a series expansion for small x and a continued fraction
+// otherwise.
+func gammaQ(a, x float64) float64 {
+	if x <= 0 {
+		return 1
+	}
+	lg, _ := math.Lgamma(a)
+
+	if x < a+1 {
+		sum, term := 1/a, 1/a
+		for n := 1; n < 1000; n++ {
+			term *= x / (a + float64(n))
+			sum += term
+			if math.Abs(term) < math.Abs(sum)*1e-15 {
+				break
+			}
+		}
+		return 1 - sum*math.Exp(-x+a*math.Log(x)-lg)
+	}
+
+	// Lentz's method.
+	const tiny = 1e-300
+	b := x + 1 - a
+	c := 1 / tiny
+	d := 1 / b
+	h := d
+	for i := 1; i < 1000; i++ {
+		an := -float64(i) * (float64(i) - a)
+		b += 2
+		d = an*d + b
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = b + an/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+		if math.Abs(delta-1) < 1e-15 {
+			break
+		}
+	}
+	return math.Exp(-x+a*math.Log(x)-lg) * h
+}
+
+func runSample(args []string) {
+	var (
+		serverAddr  string
+		n           int
+		concurrency int
+		timeout     time.Duration
+		alpha       float64
+		barWeights  string
+		fooWeights  string
+		md          metadataFlags
+		tlsOpts     tlsFlags
+	)
+
+	fs := flag.NewFlagSet("sample", flag.ExitOnError)
+	fs.StringVar(&serverAddr, "server", "127.0.0.1:8080", "The frontend address")
+	fs.IntVar(&n, "n", 1000, "The number of pings to send")
+	fs.IntVar(&concurrency, "c", 4, "The number of concurrent pings")
+	fs.DurationVar(&timeout, "timeout", 5*time.Second, "The per ping timeout")
+	fs.Float64Var(&alpha, "alpha", 0.01, "The significance level below which the split is considered to have drifted")
+	fs.StringVar(&barWeights, "bar", "", "The expected bar versions, e.g. v1=90,v2=10")
+	fs.StringVar(&fooWeights, "foo", "", "The expected foo versions, e.g. v1=100")
+	md.register(fs)
+	tlsOpts.register(fs)
+	fs.Parse(args)
+
+	if n < 1 {
+		log.Fatal("-n must be at least 1")
+	}
+	if concurrency < 1 {
+		log.Fatal("-c must be at least 1")
+	}
+
+	expected := map[string]weights{}
+	for name, s := range map[string]string{"bar": barWeights, "foo": fooWeights} {
+		w, err := parseWeights(s)
+		if err != nil {
+			log.Fatalf("-%s: %v", name, err)
+		}
+		if w != nil {
+			expected[name] = w
+		}
+	}
+
+	securityOpt, err := tlsOpts.dialOption()
+	if err != nil {
+		log.Fatal(err)
+	}
+	conn, err := grpc.Dial(serverAddr, securityOpt)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+	client := ping.NewPingClient(conn)
+
+	var (
+		mu       sync.Mutex
+		errCodes = make(map[string]int64)
+		observed = map[string]map[string]int64{
+			"bar": make(map[string]int64),
+			"foo": make(map[string]int64),
+		}
+	)
+
+	jobs := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				var trailer metadata.MD
+				_, err := client.Ping(md.newContext(ctx), &ping.Request{}, grpc.Trailer(&trailer))
+				cancel()
+
+				mu.Lock()
+				if err != nil {
+					errCodes[errorCode(err)]++
+				} else {
+					observed["bar"][firstValue(trailer, "barversion")]++
+					observed["foo"][firstValue(trailer, "fooversion")]++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if !printSample(os.Stdout, n, errCodes, observed, expected, alpha) {
+		os.Exit(1)
+	}
+}
+
+// printSample reports the observed distributions and returns false if any
+// of them drifted from the expected weights.
+func printSample(w io.Writer, n int, errCodes map[string]int64, observed map[string]map[string]int64,
+	expected map[string]weights, alpha float64) bool {
+	var failed int64
+	for _, c := range errCodes {
+		failed += c
+	}
+	fmt.Fprintf(w, "Samples: %d (%d errors", n, failed)
+	if failed > 0 {
+		fmt.Fprintf(w, ": %s", formatCodes(errCodes, ", "))
+	}
+	fmt.Fprintln(w, ")")
+
+	ok := failed < int64(n)
+	for _, service := range []string{"bar", "foo"} {
+		counts := observed[service]
+		want := expected[service]
+
+		versions := make(map[string]bool)
+		for v := range counts {
+			versions[v] = true
+		}
+		for v := range want {
+			versions[v] = true
+		}
+		names := make([]string, 0, len(versions))
+		for v := range versions {
+			names = append(names, v)
+		}
+		sort.Strings(names)
+
+		var total int64
+		for _, c := range counts {
+			total += c
+		}
+
+		fmt.Fprintf(w, "\n%s:\n", service)
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprint(tw, "  VERSION\tOBSERVED\tPERCENT\tEXPECTED\t\n")
+		for _, v := range names {
+			percent := 0.0
+			if total > 0 {
+				percent = 100 * float64(counts[v]) / float64(total)
+			}
+			exp := "-"
+			if want != nil {
+				exp = fmt.Sprintf("%.1f%%", 100*want[v])
+			}
+			fmt.Fprintf(tw, "  %s\t%d\t%.1f%%\t%s\t\n", dash(v), counts[v], percent, exp)
+		}
+		tw.Flush()
+
+		if want == nil || total == 0 {
+			continue
+		}
+		check := checkDistribution(counts, want)
+		verdict := "OK"
+		if !check.ok(alpha) {
+			verdict = "DRIFT"
+			ok = false
+		}
+		fmt.Fprintf(w, "  chi-square = %.3f, df = %d, p = %.4f: %s\n", check.chiSquare, check.df, check.pValue, verdict)
+		if len(check.unexpected) > 0 {
+			fmt.Fprintf(w, "  unexpected versions: %s\n", strings.Join(check.unexpected, ", "))
+		}
+	}
+	return ok
+}
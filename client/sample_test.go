@@ -0,0 +1,84 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestCheckDistribution(t *testing.T) {
+	tests := []struct {
+		name       string
+		observed   map[string]int64
+		expected   weights
+		unexpected []string
+		ok         bool
+	}{
+		{"fair split", map[string]int64{"v1": 905, "v2": 95}, weights{"v1": 0.9, "v2": 0.1}, nil, true},
+		{"drifted split", map[string]int64{"v1": 500, "v2": 500}, weights{"v1": 0.9, "v2": 0.1}, nil, false},
+		{"single version", map[string]int64{"v1": 1000}, weights{"v1": 1}, nil, true},
+		{"version without weight", map[string]int64{"v1": 999, "v3": 1}, weights{"v1": 1}, []string{"v3"}, false},
+		{"zero weight observed", map[string]int64{"v1": 999, "v2": 1}, weights{"v1": 1, "v2": 0}, []string{"v2"}, false},
+		{"zero weight not observed", map[string]int64{"v1": 1000}, weights{"v1": 1, "v2": 0}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := checkDistribution(tt.observed, tt.expected)
+			if !reflect.DeepEqual(c.unexpected, tt.unexpected) {
+				t.Errorf("unexpected = %v, want %v", c.unexpected, tt.unexpected)
+			}
+			if got := c.ok(0.01); got != tt.ok {
+				t.Errorf("ok = %t, want %t (chi-square %g, df %d, p %g)", got, tt.ok, c.chiSquare, c.df, c.pValue)
+			}
+		})
+	}
+}
+
+func TestChiSquarePValue(t *testing.T) {
+	// Critical values of the chi-square distribution.
+	tests := []struct {
+		x    float64
+		df   int
+		want float64
+	}{
+		{3.841459, 1, 0.05},
+		{6.634897, 1, 0.01},
+		{5.991465, 2, 0.05},
+		{9.210340, 2, 0.01},
+		{18.307038, 10, 0.05},
+		{23.209251, 10, 0.01},
+		{0, 3, 1},
+		{5, 0, 1},
+	}
+	for _, tt := range tests {
+		if got := chiSquarePValue(tt.x, tt.df); math.Abs(got-tt.want) > 1e-6 {
+			t.Errorf("chiSquarePValue(%g, %d) = %g, want %g", tt.x, tt.df, got, tt.want)
+		}
+	}
+}
+
+func TestGammaQ(t *testing.T) {
+	// Q(1, x) = e^-x and Q(1/2, x) = erfc(sqrt(x)), on both sides of the
+	// switch from the series to the continued fraction at x = a+1.
+	for _, x := range []float64{0.1, 1, 1.4, 1.6, 5, 20} {
+		if got, want := gammaQ(1, x), math.Exp(-x); math.Abs(got-want) > 1e-12 {
+			t.Errorf("gammaQ(1, %g) = %g, want %g", x, got, want)
+		}
+		if got, want := gammaQ(0.5, x), math.Erfc(math.Sqrt(x)); math.Abs(got-want) > 1e-12 {
+			t.Errorf("gammaQ(0.5, %g) = %g, want %g", x, got, want)
+		}
+	}
+}
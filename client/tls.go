@@ -0,0 +1,164 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// tlsFlags holds the transport security settings shared by all commands.
+type tlsFlags struct {
+	enabled            bool
+	caFile             string
+	certFile           string
+	keyFile            string
+	serverName         string
+	insecureSkipVerify bool
+}
+
+func (f *tlsFlags) register(fs *flag.FlagSet) {
+	fs.BoolVar(&f.enabled, "tls", false, "Connect using TLS; implied by -ca, -cert and -key")
+	fs.StringVar(&f.caFile, "ca", "", "The PEM encoded CA bundle used to verify the server certificate")
+	fs.StringVar(&f.certFile, "cert", "", "The PEM encoded client certificate for mTLS")
+	fs.StringVar(&f.keyFile, "key", "", "The PEM encoded client private key for mTLS")
+	fs.StringVar(&f.serverName, "server-name", "", "Override the server name used to verify the server certificate")
+	fs.BoolVar(&f.insecureSkipVerify, "insecure-skip-verify", false, "Skip verification of the server certificate")
+}
+
+// config returns the TLS client configuration described by the flags, or
+// nil if TLS is not enabled.
+func (f *tlsFlags) config() (*tls.Config, error) {
+	if !f.enabled && f.caFile == "" && f.certFile == "" && f.keyFile == "" {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		ServerName:         f.serverName,
+		InsecureSkipVerify: f.insecureSkipVerify,
+	}
+
+	if f.caFile != "" {
+		data, err := ioutil.ReadFile(f.caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", f.caFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if f.certFile != "" || f.keyFile != "" {
+		if f.certFile == "" || f.keyFile == "" {
+			return nil, errors.New("-cert and -key must be used together")
+		}
+		cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// dialOption returns the transport security dial option for the flags.
+func (f *tlsFlags) dialOption() (grpc.DialOption, error) {
+	cfg, err := f.config()
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		return grpc.WithInsecure(), nil
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(cfg)), nil
+}
+
+// dialOptionFor is like dialOption, but verifies the server certificate
+// against host unless -server-name is set. It is used when dialing an
+// address that host was resolved to.
+func (f *tlsFlags) dialOptionFor(host string) (grpc.DialOption, error) {
+	cfg, err := f.config()
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		return grpc.WithInsecure(), nil
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(cfg)), nil
+}
+
+// printTLSInfo writes the details of the TLS connection negotiated with p.
+func printTLSInfo(w io.Writer, p *peer.Peer) {
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		fmt.Fprintf(w, "Connection to %v is not using TLS\n", p.Addr)
+		return
+	}
+
+	state := info.State
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Peer:\t%v\n", p.Addr)
+	fmt.Fprintf(tw, "TLS version:\t%s\n", tls.VersionName(state.Version))
+	fmt.Fprintf(tw, "Cipher suite:\t%s\n", tls.CipherSuiteName(state.CipherSuite))
+	fmt.Fprintf(tw, "ALPN protocol:\t%s\n", dash(state.NegotiatedProtocol))
+	fmt.Fprintf(tw, "Resumed:\t%t\n", state.DidResume)
+
+	for i, cert := range state.PeerCertificates {
+		fmt.Fprintf(tw, "Certificate %d:\n", i)
+		fmt.Fprintf(tw, "  Subject:\t%s\n", cert.Subject)
+		fmt.Fprintf(tw, "  Issuer:\t%s\n", cert.Issuer)
+		fmt.Fprintf(tw, "  Not before:\t%s\n", cert.NotBefore.UTC().Format(time.RFC3339))
+		fmt.Fprintf(tw, "  Not after:\t%s\n", cert.NotAfter.UTC().Format(time.RFC3339))
+		if sans := subjectAltNames(cert); len(sans) > 0 {
+			fmt.Fprintf(tw, "  SANs:\t%s\n", strings.Join(sans, ", "))
+		}
+	}
+	tw.Flush()
+}
+
+// subjectAltNames returns the SANs of cert in the form TYPE:value.
+func subjectAltNames(cert *x509.Certificate) []string {
+	var sans []string
+	for _, name := range cert.DNSNames {
+		sans = append(sans, "DNS:"+name)
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, "IP:"+ip.String())
+	}
+	for _, email := range cert.EmailAddresses {
+		sans = append(sans, "email:"+email)
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, "URI:"+uri.String())
+	}
+	return sans
+}
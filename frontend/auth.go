@@ -0,0 +1,86 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/kelseyhightower/ping/auth"
+
+	"golang.org/x/net/context"
+)
+
+// mintedTokenTTL is the lifetime of the tokens minted for calls to bar and
+// foo. They are minted per call, so they only need to outlive the call.
+const mintedTokenTTL = time.Minute
+
+// tokenSource returns the bearer token for the calls to bar and foo made
+// while serving ctx. An empty token means the calls carry none.
+type tokenSource func(ctx context.Context) (string, error)
+
+// newTokenSource returns the token source for a -downstream-auth mode:
+//
+//	none     no token is sent
+//	forward  the caller's own bearer token is passed on
+//	mint     a JWT is minted for the authenticated caller, or for
+//	         "frontend" if the caller is anonymous
+//	static   the token in -downstream-token-file is sent
+func newTokenSource(mode string) (tokenSource, error) {
+	switch mode {
+	case "", "none":
+		return nil, nil
+	case "forward":
+		return func(ctx context.Context) (string, error) {
+			return auth.TokenFromContext(ctx), nil
+		}, nil
+	case "mint":
+		secretFile := downstreamJWTSecret
+		if secretFile == "" {
+			secretFile = authJWTSecret
+		}
+		if secretFile == "" {
+			return nil, fmt.Errorf("-downstream-auth=mint requires -downstream-jwt-secret or -auth-jwt-secret")
+		}
+		secret, err := auth.LoadSecret(secretFile)
+		if err != nil {
+			return nil, err
+		}
+		minter := &auth.Minter{
+			Secret:   secret,
+			Issuer:   downstreamJWTIssuer,
+			Audience: downstreamJWTAudience,
+			TTL:      mintedTokenTTL,
+		}
+		return func(ctx context.Context) (string, error) {
+			subject := "frontend"
+			if p, ok := auth.FromContext(ctx); ok && p.Subject != "" {
+				subject = p.Subject
+			}
+			return minter.Mint(subject)
+		}, nil
+	case "static":
+		if downstreamTokenFile == "" {
+			return nil, fmt.Errorf("-downstream-auth=static requires -downstream-token-file")
+		}
+		token, err := auth.LoadSecret(downstreamTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context) (string, error) {
+			return string(token), nil
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid -downstream-auth %q: must be none, forward, mint or static", mode)
+}
@@ -14,9 +14,12 @@
 package main
 
 import (
-	"log"
+	"encoding/json"
 	"net/http"
 
+	"github.com/kelseyhightower/ping/breaker"
+	"github.com/kelseyhightower/ping/logging"
+
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/health"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
@@ -24,20 +27,38 @@ import (
 
 type healthHandler struct {
 	healthServer *health.Server
+	breakers     []*breaker.Group
+}
+
+func httpHealthServer(server *health.Server, breakers []*breaker.Group) http.Handler {
+	return &healthHandler{server, breakers}
 }
 
-func httpHealthServer(server *health.Server) http.Handler {
-	return &healthHandler{server}
+// healthResponse reports the serving status and the states of the circuit
+// breakers, keyed by downstream and endpoint. Open breakers do not make the
+// frontend unhealthy.
+type healthResponse struct {
+	Status          string                              `json:"status"`
+	CircuitBreakers map[string]map[string]breaker.State `json:"circuit_breakers,omitempty"`
 }
 
 func (h *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	hcr, err := h.healthServer.Check(context.Background(), &healthpb.HealthCheckRequest{""})
 	if err != nil {
-		log.Println("Error checking gRPC server health", err)
+		logging.FromContext(r.Context()).Errorf("Error checking gRPC server health: %v", err)
 		w.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
 
+	resp := healthResponse{Status: hcr.Status.String()}
+	if len(h.breakers) > 0 {
+		resp.CircuitBreakers = make(map[string]map[string]breaker.State)
+		for _, g := range h.breakers {
+			resp.CircuitBreakers[g.Name()] = g.States()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
 	switch hcr.Status.String() {
 	case "UNKNOWN":
 		w.WriteHeader(http.StatusServiceUnavailable)
@@ -46,4 +67,5 @@ func (h *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case "NOT_SERVING":
 		w.WriteHeader(http.StatusServiceUnavailable)
 	}
+	json.NewEncoder(w).Encode(&resp)
 }
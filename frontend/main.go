@@ -16,73 +16,400 @@ package main
 import (
 	"context"
 	"flag"
-	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/kelseyhightower/ping"
+	"github.com/kelseyhightower/ping/accesslog"
+	"github.com/kelseyhightower/ping/admin"
+	"github.com/kelseyhightower/ping/auth"
+	"github.com/kelseyhightower/ping/balancer"
+	"github.com/kelseyhightower/ping/breaker"
+	"github.com/kelseyhightower/ping/channelz"
+	"github.com/kelseyhightower/ping/internal/service"
+	"github.com/kelseyhightower/ping/logging"
+	"github.com/kelseyhightower/ping/metrics"
+	"github.com/kelseyhightower/ping/middleware"
+	"github.com/kelseyhightower/ping/propagation"
+	"github.com/kelseyhightower/ping/ratelimit"
+	"github.com/kelseyhightower/ping/retry"
+	"github.com/kelseyhightower/ping/rules"
+	"github.com/kelseyhightower/ping/tlsutil"
 
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/grpclog"
 	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/reflection"
 )
 
 const (
 	version = "v2"
+
+	// tlsReloadInterval is how often the TLS files are checked for changes.
+	tlsReloadInterval = 10 * time.Second
+
+	// rulesReloadInterval is how often the rules file is checked for
+	// changes.
+	rulesReloadInterval = 5 * time.Second
 )
 
 var (
-	barAddr    string
-	fooAddr    string
-	grpcAddr   string
-	healthAddr string
-	httpAddr   string
-	region     string
+	accessLog             string
+	accessLogFormat       string
+	accessLogMaxBackups   int
+	accessLogMaxSize      int
+	accessLogSampleRate   float64
+	adminAddr             string
+	adminTokenFile        string
+	authAPIKeys           string
+	authJWTSecret         string
+	authJWTIssuer         string
+	authJWTAudience       string
+	barAddr               string
+	breakerErrors         int
+	breakerMaxEjection    int
+	breakerSleepWindow    time.Duration
+	downstreamAuth        string
+	downstreamJWTSecret   string
+	downstreamJWTIssuer   string
+	downstreamJWTAudience string
+	downstreamTokenFile   string
+	fooAddr               string
+	grpcAddr              string
+	healthAddr            string
+	rateLimits            string
+	httpAddr              string
+	lbPolicy              string
+	lbResolve             string
+	lbResolveInterval     time.Duration
+	logFormat             string
+	logLevel              string
+	propagationFormats    string
+	region                string
+	retryPolicies         string
+	rulesFile             string
+	serviceName           string
+	sourceLabels          string
+	tlsCert               string
+	tlsKey                string
+	tlsCA                 string
+	tlsClientAuth         bool
+	traceFile             string
+	traceSampleRate       float64
+	zipkinURL             string
 )
 
 func main() {
+	flag.StringVar(&accessLog, "access-log", "", "Write an access log to stdout or to this file; disabled if empty")
+	flag.StringVar(&accessLogFormat, "access-log-format", accesslog.JSON, "The format of the access log: json, common, combined or combined+")
+	flag.IntVar(&accessLogMaxBackups, "access-log-max-backups", 3, "The number of rotated access log files that are kept")
+	flag.IntVar(&accessLogMaxSize, "access-log-max-size", 100, "The size in MB at which the access log file is rotated")
+	flag.Float64Var(&accessLogSampleRate, "access-log-sample-rate", 1, "The fraction of successful requests that are logged; failures are always logged")
+	flag.StringVar(&adminAddr, "admin", "", "The listen address of the admin server with /debug/requests, /debug/events, /debug/pprof and /loglevel; disabled if empty")
+	flag.StringVar(&adminTokenFile, "admin-token-file", "", "The file holding the token the admin server requires")
+	flag.StringVar(&authAPIKeys, "auth-api-keys", "", "The file of API keys accepted as bearer tokens; enables token authentication")
+	flag.StringVar(&authJWTSecret, "auth-jwt-secret", "", "The file holding the HMAC secret of accepted JWTs; enables token authentication")
+	flag.StringVar(&authJWTIssuer, "auth-jwt-issuer", "", "The required issuer (iss) of JWTs")
+	flag.StringVar(&authJWTAudience, "auth-jwt-audience", "", "The required audience (aud) of JWTs")
 	flag.StringVar(&barAddr, "bar", "", "The bar service address")
+	flag.IntVar(&breakerErrors, "circuit-breaker-consecutive-errors", 0, "The number of consecutive server errors that opens the circuit breaker of bar or foo; disabled if 0")
+	flag.IntVar(&breakerMaxEjection, "circuit-breaker-max-ejection-percent", 10, "The percentage of the endpoints of bar or foo whose circuit breakers may be open at once; at least one may always open")
+	flag.DurationVar(&breakerSleepWindow, "circuit-breaker-sleep-window", 10*time.Second, "How long an open circuit breaker fails calls before it lets a trial call through")
+	flag.StringVar(&downstreamAuth, "downstream-auth", "none", "The bearer token sent to bar and foo: none, forward, mint or static")
+	flag.StringVar(&downstreamJWTSecret, "downstream-jwt-secret", "", "The file holding the HMAC secret of minted JWTs (default -auth-jwt-secret)")
+	flag.StringVar(&downstreamJWTIssuer, "downstream-jwt-issuer", "frontend", "The issuer (iss) of minted JWTs")
+	flag.StringVar(&downstreamJWTAudience, "downstream-jwt-audience", "", "The audience (aud) of minted JWTs")
+	flag.StringVar(&downstreamTokenFile, "downstream-token-file", "", "The file holding the static bearer token sent to bar and foo")
 	flag.StringVar(&fooAddr, "foo", "", "The foo service address")
 	flag.StringVar(&grpcAddr, "grpc", "127.0.0.1:8080", "The gRPC listen address")
 	flag.StringVar(&healthAddr, "health", "127.0.0.1:8008", "The health listen address")
+	flag.StringVar(&lbPolicy, "lb-policy", "", "Balance the calls to bar and foo across the endpoints of their targets: round-robin, random, least-request or p2c; disabled if empty")
+	flag.StringVar(&lbResolve, "lb-resolve", balancer.Auto, "How the targets of bar and foo are resolved when balancing: auto, dns, srv or list")
+	flag.DurationVar(&lbResolveInterval, "lb-resolve-interval", 30*time.Second, "How often the targets of bar and foo are resolved again when balancing")
+	flag.StringVar(&logFormat, "log-format", logging.Logfmt, "The format of log lines: logfmt or json")
+	flag.StringVar(&logLevel, "log-level", "info", "The minimum level of log lines: debug, info, warn or error")
 	flag.StringVar(&httpAddr, "http", "127.0.0.1:80", "The HTTP listen address")
+	flag.StringVar(&rateLimits, "rate-limits", "", "The file of per-caller rate limits")
 	flag.StringVar(&region, "region", "", "The compute region")
+	flag.StringVar(&retryPolicies, "retry-policies", "", "The file of retry and hedging policies for the calls to bar and foo; calls are not retried if empty")
+	flag.StringVar(&propagationFormats, "propagation", propagation.DefaultFormats, "The formats the trace context is passed on to bar and foo in: b3multi, b3, tracecontext and baggage")
+	flag.StringVar(&rulesFile, "rules", "", "The file of rules that allow, deny or rate limit calls by their attributes")
+	flag.StringVar(&sourceLabels, "source-labels", "app=frontend", "The labels sent to bar and foo as x-source-labels, as comma separated key=value pairs")
+	flag.StringVar(&tlsCert, "tls-cert", "", "The PEM encoded TLS certificate; enables TLS for the gRPC server and is presented to bar and foo")
+	flag.StringVar(&tlsKey, "tls-key", "", "The PEM encoded TLS private key")
+	flag.StringVar(&tlsCA, "tls-ca", "", "The PEM encoded CA bundle used to verify clients, bar and foo; enables TLS to bar and foo")
+	flag.StringVar(&serviceName, "service-name", "frontend", "The service name reported in traces and logs")
+	flag.BoolVar(&tlsClientAuth, "tls-client-auth", false, "Require client certificates signed by -tls-ca (mTLS)")
+	flag.StringVar(&traceFile, "trace-file", "", "Append spans to this file in Zipkin v2 JSON; enables tracing")
+	flag.Float64Var(&traceSampleRate, "trace-sample-rate", 1, "The fraction of new traces that are sampled")
+	flag.StringVar(&zipkinURL, "zipkin-url", "", "The Zipkin v2 collector URL spans are sent to, e.g. http://zipkin:9411/api/v2/spans; enables tracing")
 	flag.Parse()
 
-	log.Println("Starting frontend service ...")
-	log.Printf("gRPC server listening on: %s", grpcAddr)
-	log.Printf("Health server listening on: %s", healthAddr)
-	log.Printf("HTTP server listening on: %s", httpAddr)
+	level, err := logging.ParseLevel(logLevel)
+	if err != nil {
+		logging.Fatalf("%v", err)
+	}
+	logger, err := logging.New(os.Stderr, logFormat, level)
+	if err != nil {
+		logging.Fatalf("%v", err)
+	}
+	logging.SetDefault(logger.With("service", serviceName))
+	grpclog.SetLogger(logging.GRPCLogger())
+
+	// gRPC records the traces shown on /debug/requests only for the admin
+	// server.
+	grpc.EnableTracing = adminAddr != ""
+
+	logging.Infof("Starting frontend service ...")
+	logging.Infof("gRPC server listening on: %s", grpcAddr)
+	logging.Infof("Health server listening on: %s", healthAddr)
+	logging.Infof("HTTP server listening on: %s", httpAddr)
 
 	hostname, err := os.Hostname()
 	if err != nil {
-		log.Fatal("Error getting hostname:", err)
+		logging.Fatalf("Error getting hostname: %v", err)
+	}
+
+	// The same certificates are used to serve TLS, to verify bar and foo
+	// and as the client certificate for calls to them.
+	var (
+		serverOpts      []grpc.ServerOption
+		downstreamCreds credentials.TransportCredentials
+		downstreamOpt   = grpc.WithInsecure()
+		localOpt        = grpc.WithInsecure()
+	)
+	if tlsCert != "" || tlsKey != "" || tlsCA != "" {
+		certs, err := tlsutil.NewReloader(tlsCert, tlsKey, tlsCA)
+		if err != nil {
+			logging.Fatalf("%v", err)
+		}
+		go certs.Watch(tlsReloadInterval)
+
+		downstreamCreds = certs.ClientCredentials("")
+		downstreamOpt = grpc.WithTransportCredentials(downstreamCreds)
+		if tlsCert != "" {
+			creds, err := certs.ServerCredentials(tlsClientAuth)
+			if err != nil {
+				logging.Fatalf("%v", err)
+			}
+			serverOpts = append(serverOpts, grpc.Creds(creds))
+			// The HTTP gateway calls the local gRPC server like any other
+			// client.
+			localOpt = grpc.WithTransportCredentials(certs.ClientCredentials(certs.ServerName()))
+		}
+		logging.Infof("TLS enabled, client certificates required: %t", tlsClientAuth)
+	} else if tlsClientAuth {
+		logging.Fatalf("-tls-client-auth requires -tls-cert, -tls-key and -tls-ca")
+	}
+
+	// Every call carries a trace context, extracted or generated.
+	unaryInterceptors := []grpc.UnaryServerInterceptor{
+		propagation.UnaryServerInterceptor(),
+		logging.UnaryServerInterceptor(),
+	}
+	streamInterceptors := []grpc.StreamServerInterceptor{
+		propagation.StreamServerInterceptor(),
+		logging.StreamServerInterceptor(),
+	}
+	accessLogger, err := service.NewAccessLogger(accesslog.Config{
+		Path:       accessLog,
+		Format:     accessLogFormat,
+		SampleRate: accessLogSampleRate,
+		MaxSize:    int64(accessLogMaxSize) << 20,
+		MaxBackups: accessLogMaxBackups,
+	})
+	if err != nil {
+		logging.Fatalf("%v", err)
+	}
+	if accessLogger != nil {
+		unaryInterceptors = append(unaryInterceptors, accessLogger.UnaryServerInterceptor())
+		streamInterceptors = append(streamInterceptors, accessLogger.StreamServerInterceptor())
+	}
+	tracer, err := service.NewTracer(service.TracingConfig{
+		ServiceName: serviceName,
+		Addr:        grpcAddr,
+		ZipkinURL:   zipkinURL,
+		File:        traceFile,
+		SampleRate:  traceSampleRate,
+	})
+	if err != nil {
+		logging.Fatalf("%v", err)
+	}
+	if tracer != nil {
+		unaryInterceptors = append(unaryInterceptors, tracer.UnaryServerInterceptor())
+		streamInterceptors = append(streamInterceptors, tracer.StreamServerInterceptor())
+	}
+	if authAPIKeys != "" || authJWTSecret != "" {
+		authenticator, err := auth.NewAuthenticator(auth.Config{
+			KeyFile:       authAPIKeys,
+			JWTSecretFile: authJWTSecret,
+			Issuer:        authJWTIssuer,
+			Audience:      authJWTAudience,
+		})
+		if err != nil {
+			logging.Fatalf("%v", err)
+		}
+		unaryInterceptors = append(unaryInterceptors, authenticator.UnaryServerInterceptor())
+		streamInterceptors = append(streamInterceptors, authenticator.StreamServerInterceptor())
+		logging.Infof("Bearer token authentication enabled")
+	}
+	if rulesFile != "" {
+		engine, err := rules.Load(rulesFile)
+		if err != nil {
+			logging.Fatalf("%v", err)
+		}
+		go engine.Watch(rulesReloadInterval)
+		unaryInterceptors = append(unaryInterceptors, engine.UnaryServerInterceptor())
+		streamInterceptors = append(streamInterceptors, engine.StreamServerInterceptor())
+		logging.Infof("Applying rules from %s", rulesFile)
+	}
+	if rateLimits != "" {
+		limiter, err := ratelimit.Load(rateLimits)
+		if err != nil {
+			logging.Fatalf("%v", err)
+		}
+		unaryInterceptors = append(unaryInterceptors, limiter.UnaryServerInterceptor())
+		streamInterceptors = append(streamInterceptors, limiter.StreamServerInterceptor())
+		logging.Infof("Rate limiting callers with %s", rateLimits)
+	}
+	registry := metrics.NewRegistry()
+	metrics.RegisterProcessMetrics(registry)
+	serverOpts = append(serverOpts,
+		grpc.StatsHandler(metrics.NewServerMetrics(registry)),
+		grpc.UnaryInterceptor(middleware.ChainUnaryServer(unaryInterceptors...)),
+		grpc.StreamInterceptor(middleware.ChainStreamServer(streamInterceptors...)),
+	)
+
+	downstreamToken, err := newTokenSource(downstreamAuth)
+	if err != nil {
+		logging.Fatalf("%v", err)
 	}
 
+	clientMetrics := metrics.NewClientMetrics(registry)
+	var policies *retry.Policies
+	if retryPolicies != "" {
+		policies, err = retry.Load(retryPolicies)
+		if err != nil {
+			logging.Fatalf("%v", err)
+		}
+		logging.Infof("Retrying calls to bar and foo with %s", retryPolicies)
+	}
+	var barInterceptors, fooInterceptors, localInterceptors []grpc.UnaryClientInterceptor
+	var barOpts, fooOpts []grpc.DialOption
+	if tracer != nil {
+		barInterceptors = append(barInterceptors, tracer.UnaryClientInterceptor("bar"))
+		fooInterceptors = append(fooInterceptors, tracer.UnaryClientInterceptor("foo"))
+		localInterceptors = append(localInterceptors, tracer.UnaryClientInterceptor(serviceName))
+	}
+	if adminAddr != "" {
+		barEvents := admin.NewEventLog("bar", barAddr)
+		barEvents.Printf("Dialing %s", barAddr)
+		barInterceptors = append(barInterceptors, admin.UnaryClientInterceptor(barEvents))
+		fooEvents := admin.NewEventLog("foo", fooAddr)
+		fooEvents.Printf("Dialing %s", fooAddr)
+		fooInterceptors = append(fooInterceptors, admin.UnaryClientInterceptor(fooEvents))
+	}
+	var policy balancer.Policy
+	if lbPolicy != "" {
+		policy, err = balancer.ParsePolicy(lbPolicy)
+		if err != nil {
+			logging.Fatalf("%v", err)
+		}
+		if lbResolveInterval <= 0 {
+			logging.Fatalf("-lb-resolve-interval must be positive")
+		}
+		logging.Infof("Balancing calls to bar and foo with the %s policy", policy)
+	}
+	var (
+		breakers                 []*breaker.Group
+		barBreakers, fooBreakers *breaker.Group
+	)
+	if breakerErrors > 0 {
+		if breakerMaxEjection < 0 || breakerMaxEjection > 100 {
+			logging.Fatalf("-circuit-breaker-max-ejection-percent must be between 0 and 100")
+		}
+		cfg := breaker.Config{
+			ConsecutiveErrors:  breakerErrors,
+			SleepWindow:        breakerSleepWindow,
+			MaxEjectionPercent: breakerMaxEjection,
+			Balanced:           policy != "",
+		}
+		barBreakers = breaker.NewGroup("bar", barAddr, cfg, clientMetrics)
+		barInterceptors = append(barInterceptors, barBreakers.UnaryClientInterceptor())
+		fooBreakers = breaker.NewGroup("foo", fooAddr, cfg, clientMetrics)
+		fooInterceptors = append(fooInterceptors, fooBreakers.UnaryClientInterceptor())
+		breakers = append(breakers, barBreakers, fooBreakers)
+		logging.Infof("Opening circuit breakers after %d consecutive errors for %s", breakerErrors, breakerSleepWindow)
+	}
+	// The connectivity state of the downstream connections is only tracked
+	// when the admin server reports it on /debug/channels.
+	var barChannel, fooChannel *channelz.Channel
+	if adminAddr != "" {
+		barChannel = channelz.NewChannel("bar", barAddr)
+		barInterceptors = append(barInterceptors, barChannel.UnaryClientInterceptor())
+		barOpts = append(barOpts, grpc.WithDialer(barChannel.Dialer()))
+		defer barChannel.Close()
+		fooChannel = channelz.NewChannel("foo", fooAddr)
+		fooInterceptors = append(fooInterceptors, fooChannel.UnaryClientInterceptor())
+		fooOpts = append(fooOpts, grpc.WithDialer(fooChannel.Dialer()))
+		defer fooChannel.Close()
+	}
+	propagator, err := propagation.NewPropagator(propagationFormats)
+	if err != nil {
+		logging.Fatalf("%v", err)
+	}
+	barInterceptors = append(barInterceptors, propagator.UnaryClientInterceptor())
+	fooInterceptors = append(fooInterceptors, propagator.UnaryClientInterceptor())
+	localInterceptors = append(localInterceptors, propagator.UnaryClientInterceptor())
+
 	// Create a gRPC client for service bar.
-	barConn, err := grpc.Dial(barAddr, grpc.WithInsecure())
+	barOpts = append(barOpts,
+		grpc.WithStatsHandler(clientMetrics.Handler("bar")),
+		grpc.WithUnaryInterceptor(middleware.ChainUnaryClient(barInterceptors...)),
+	)
+	if policy != "" {
+		barOpts = append(barOpts, balancerOptions(policy, barAddr, downstreamCreds, barChannel, barBreakers)...)
+	} else {
+		barOpts = append(barOpts, downstreamOpt)
+	}
+	barConn, err := grpc.Dial(barAddr, barOpts...)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatalf("%v", err)
 	}
 	defer barConn.Close()
 	barClient := ping.NewPingClient(barConn)
 
 	// Create a gRPC client for service foo.
-	fooConn, err := grpc.Dial(fooAddr, grpc.WithInsecure())
+	fooOpts = append(fooOpts,
+		grpc.WithStatsHandler(clientMetrics.Handler("foo")),
+		grpc.WithUnaryInterceptor(middleware.ChainUnaryClient(fooInterceptors...)),
+	)
+	if policy != "" {
+		fooOpts = append(fooOpts, balancerOptions(policy, fooAddr, downstreamCreds, fooChannel, fooBreakers)...)
+	} else {
+		fooOpts = append(fooOpts, downstreamOpt)
+	}
+	fooConn, err := grpc.Dial(fooAddr, fooOpts...)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatalf("%v", err)
 	}
 	defer fooConn.Close()
 	fooClient := ping.NewPingClient(fooConn)
 
 	// Setup the gRPC server.
-	grpcServer := grpc.NewServer()
-	s := &server{barClient, fooClient, hostname, region, version}
+	grpcServer := grpc.NewServer(serverOpts...)
+	s := &server{
+		barClient, fooClient,
+		policies.Retrier("bar", clientMetrics), policies.Retrier("foo", clientMetrics),
+		hostname, region, version, sourceLabels, downstreamToken,
+	}
 	ping.RegisterPingServer(grpcServer, s)
 	reflection.Register(grpcServer)
 
@@ -92,29 +419,56 @@ func main() {
 
 	ln, err := net.Listen("tcp", grpcAddr)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatalf("%v", err)
 	}
 
 	go func() {
-		log.Fatal(grpcServer.Serve(ln))
+		logging.Fatalf("%v", grpcServer.Serve(ln))
 	}()
 
 	// Setup a HTTP server for health checks.
 	healthMux := http.NewServeMux()
-	healthMux.Handle("/health", httpHealthServer(grpcHealthServer))
+	healthMux.Handle("/health", httpHealthServer(grpcHealthServer, breakers))
+	healthMux.Handle("/metrics", registry)
 	healthServer := http.Server{Addr: healthAddr, Handler: healthMux}
 
 	go func() {
-		log.Fatal(healthServer.ListenAndServe())
+		if err := healthServer.ListenAndServe(); err != http.ErrServerClosed {
+			logging.Fatalf("%v", err)
+		}
 	}()
 
+	// Setup the opt-in admin HTTP server.
+	adminServer, err := service.NewAdminServer(adminAddr, adminTokenFile)
+	if err != nil {
+		logging.Fatalf("%v", err)
+	}
+	if adminServer != nil {
+		go func() {
+			if err := adminServer.ListenAndServe(); err != http.ErrServerClosed {
+				logging.Fatalf("%v", err)
+			}
+		}()
+	}
+
 	// Setup a HTTP server to proxy the gRPC server.
 	mux := http.NewServeMux()
-	mux.Handle("/ping", httpPingServer(grpcAddr))
+	httpMetrics := metrics.NewHTTPMetrics(registry)
+	pingHandler := httpPingServer(grpcAddr, localOpt, grpc.WithUnaryInterceptor(middleware.ChainUnaryClient(localInterceptors...)))
+	if tracer != nil {
+		pingHandler = tracer.Handler(pingHandler)
+	}
+	pingHandler = logging.Handler(pingHandler)
+	if accessLogger != nil {
+		pingHandler = accessLogger.Handler(pingHandler)
+	}
+	mux.Handle("/ping", httpMetrics.Handler("/ping", propagation.Handler(pingHandler)))
 	httpServer := http.Server{Addr: httpAddr, Handler: mux}
 
 	go func() {
-		log.Fatal(httpServer.ListenAndServe())
+		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+			logging.Fatalf("%v", err)
+		}
 	}()
 
 	grpcHealthServer.SetServingStatus("ping.Ping", 1)
@@ -123,9 +477,47 @@ func main() {
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 	<-signalChan
 
-	log.Printf("Shutdown signal received shutting down gracefully...")
+	logging.Infof("Shutdown signal received shutting down gracefully...")
 
 	grpcServer.GracefulStop()
 	healthServer.Shutdown(context.Background())
+	if adminServer != nil {
+		adminServer.Shutdown(context.Background())
+	}
 	httpServer.Shutdown(context.Background())
+	if tracer != nil {
+		tracer.Close()
+	}
+}
+
+// balancerOptions returns the dial options that balance the calls of a
+// downstream connection across the endpoints of target with policy, over
+// TLS with creds unless it is nil. The addresses the target resolves to
+// are reported, if not nil, to its channel and to its circuit breakers,
+// which the balancer skips while they are open.
+func balancerOptions(policy balancer.Policy, target string, creds credentials.TransportCredentials, channel *channelz.Channel, breakers *breaker.Group) []grpc.DialOption {
+	r := &balancer.Resolver{
+		Mode:     lbResolve,
+		Interval: lbResolveInterval,
+		Notify: func(addrs []string) {
+			if channel != nil {
+				channel.SetAddresses(addrs)
+			}
+			if breakers != nil {
+				breakers.SetEndpoints(addrs)
+			}
+		},
+	}
+	var filter balancer.Filter
+	if breakers != nil {
+		filter = breakers.Allow
+	}
+	b := balancer.New(r, policy, filter)
+	securityOpt := grpc.WithInsecure()
+	if creds != nil {
+		// The endpoints are dialed by IP address; their certificates are
+		// verified against the hosts they were resolved from.
+		securityOpt = grpc.WithTransportCredentials(b.Credentials(creds, balancer.Authority(target, lbResolve)))
+	}
+	return []grpc.DialOption{grpc.WithBalancer(b), securityOpt}
 }
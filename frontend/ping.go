@@ -15,23 +15,30 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"fmt"
+	"math"
+	"net"
 	"net/http"
-	"strings"
+	"strconv"
 
 	"github.com/kelseyhightower/ping"
+	"github.com/kelseyhightower/ping/accesslog"
+	"github.com/kelseyhightower/ping/logging"
+	"github.com/kelseyhightower/ping/propagation"
+	"github.com/kelseyhightower/ping/ratelimit"
 
-	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 )
 
 type pingHandler struct {
 	localAddr string
+	dialOpts  []grpc.DialOption
 }
 
-func httpPingServer(addr string) http.Handler {
-	return &pingHandler{addr}
+func httpPingServer(addr string, dialOpts ...grpc.DialOption) http.Handler {
+	return &pingHandler{addr, dialOpts}
 }
 
 type httpResponse struct {
@@ -44,29 +51,28 @@ type httpResponse struct {
 }
 
 func (p *pingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Propagate the appropriate HTTP headers so that when the proxies send
-	// span information to Zipkin, the spans can be correlated correctly into
-	// a single trace.
+	// The trace context is added by the client interceptors of the local
+	// connection.
 	h := map[string]string{}
+	if v := r.Header.Get("User-Agent"); v != "" {
+		h["x-forwarded-user-agent"] = v
+	}
+	if v := r.Header.Get("Authorization"); v != "" {
+		h["authorization"] = v
+	}
 
-	for k, v := range r.Header {
-		k = strings.ToLower(k)
-		switch k {
-		case "x-request-id", "x-b3-traceid", "x-b3-spanid", "x-b3-sampled":
-			h[k] = v[0]
-		case "x-b3-flags", "x-ot-span-context", "x-b3-parentspanid":
-			h[k] = v[0]
-		case "user-agent":
-			h["x-forwarded-user-agent"] = v[0]
-		}
+	// The gRPC server keys rate limits by peer address. Its peer is this
+	// gateway, so pass the address of the HTTP client on.
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		h[ratelimit.GatewayClientKey] = ratelimit.GatewayClient(host)
 	}
 
 	hmd := metadata.New(h)
 
-	conn, err := grpc.Dial(p.localAddr, grpc.WithInsecure())
+	conn, err := grpc.Dial(p.localAddr, p.dialOpts...)
 	if err != nil {
-		log.Println("Error calling the local ping server", err)
-		w.WriteHeader(http.StatusServiceUnavailable)
+		logging.FromContext(r.Context()).Errorf("Error calling the local ping server: %v", err)
+		httpError(w, r, "Error calling the local ping server", http.StatusServiceUnavailable)
 		return
 	}
 
@@ -74,14 +80,29 @@ func (p *pingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	client := ping.NewPingClient(conn)
 
 	md := metadata.New(map[string]string{})
-	ctx := metadata.NewOutgoingContext(context.Background(), hmd)
+	ctx := metadata.NewOutgoingContext(detach(r.Context()), hmd)
 	grpcResponse, err := client.Ping(ctx, &ping.Request{}, grpc.Trailer(&md))
+	switch grpc.Code(err) {
+	case codes.Unauthenticated:
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		httpError(w, r, grpc.ErrorDesc(err), http.StatusUnauthorized)
+		return
+	case codes.ResourceExhausted:
+		if wait, ok := ratelimit.RetryDelay(err); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		}
+		httpError(w, r, grpc.ErrorDesc(err), http.StatusTooManyRequests)
+		return
+	}
 	if err != nil {
-		log.Println("Error calling the local ping server", err)
-		w.WriteHeader(http.StatusServiceUnavailable)
+		logging.FromContext(r.Context()).Errorf("Error calling the local ping server: %v", err)
+		httpError(w, r, "Error calling the local ping server", http.StatusServiceUnavailable)
 		return
 	}
 
+	accesslog.SetVersion(r.Context(), "bar", md["barversion"][0])
+	accesslog.SetVersion(r.Context(), "foo", md["fooversion"][0])
+
 	response := httpResponse{
 		BarVersion: md["barversion"][0],
 		FooVersion: md["fooversion"][0],
@@ -93,10 +114,19 @@ func (p *pingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	data, err := json.MarshalIndent(&response, "", "  ")
 	if err != nil {
-		log.Println("Error marshalling HTTP response:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		logging.FromContext(r.Context()).Errorf("Error marshalling HTTP response: %v", err)
+		httpError(w, r, "Error marshalling HTTP response", http.StatusInternalServerError)
 		return
 	}
 	w.Write(data)
 	return
 }
+
+// httpError replies with msg and the request ID, which lets the caller
+// find the request in the logs.
+func httpError(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	if c := propagation.FromContext(r.Context()); c != nil {
+		msg = fmt.Sprintf("%s (request ID %s)", msg, c.RequestID)
+	}
+	http.Error(w, msg, code)
+}
@@ -14,66 +14,96 @@
 package main
 
 import (
-	"log"
+	"strconv"
 
 	"github.com/kelseyhightower/ping"
+	"github.com/kelseyhightower/ping/accesslog"
+	"github.com/kelseyhightower/ping/logging"
+	"github.com/kelseyhightower/ping/propagation"
+	"github.com/kelseyhightower/ping/retry"
+	"github.com/kelseyhightower/ping/rules"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 type server struct {
-	bar      ping.PingClient
-	foo      ping.PingClient
+	bar ping.PingClient
+	foo ping.PingClient
+
+	// barRetrier and fooRetrier apply the retry policies of bar and foo.
+	barRetrier *retry.Retrier
+	fooRetrier *retry.Retrier
+
 	hostname string
 	region   string
 	version  string
+
+	// labels are sent to bar and foo so that their rules can match on
+	// source.labels.
+	labels string
+
+	// token picks the bearer token for calls to bar and foo; nil sends
+	// none.
+	token tokenSource
 }
 
 func (s *server) Ping(ctx context.Context, in *ping.Request) (*ping.Response, error) {
-	// Propagate the appropriate HTTP headers so that when the proxies send
-	// span information to Zipkin, the spans can be correlated correctly into
-	// a single trace.
+	// The trace context is added by the client interceptors of bar and
+	// foo; pass the user agent of the original client on as well.
 	h := map[string]string{}
-	imd, ok := metadata.FromIncomingContext(ctx)
-	if ok {
-		for k, v := range imd {
-			switch k {
-			case "x-request-id", "x-b3-traceid", "x-b3-spanid", "x-b3-sampled":
-				h[k] = v[0]
-			case "x-b3-flags", "x-ot-span-context", "x-b3-parentspanid":
-				h[k] = v[0]
-			case "x-forwarded-user-agent":
-				h[k] = v[0]
-			}
+	if imd, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := imd["x-forwarded-user-agent"]; len(v) > 0 {
+			h["x-forwarded-user-agent"] = v[0]
+		}
+	}
+
+	if s.labels != "" {
+		h[rules.SourceLabelsKey] = s.labels
+	}
+
+	if s.token != nil {
+		token, err := s.token(ctx)
+		if err != nil {
+			logging.FromContext(ctx).Errorf("Error getting the token for bar and foo: %v", err)
+			return nil, status.Errorf(codes.Internal, "getting the token for bar and foo: %v", err)
+		}
+		if token != "" {
+			h["authorization"] = "Bearer " + token
 		}
 	}
 
 	hmd := metadata.New(h)
 
+	base := detach(ctx)
+
 	// Call the bar service with the trace headers and extract the version
 	// from the response metadata.
-	bmd := metadata.New(map[string]string{})
-	barCtx := metadata.NewOutgoingContext(context.Background(), hmd)
-	_, err := s.bar.Ping(barCtx, &ping.Request{}, grpc.Trailer(&bmd))
+	barCtx := metadata.NewOutgoingContext(base, hmd)
+	v, attempts, err := s.barRetrier.Do(barCtx, pingTrailer(s.bar))
+	grpc.SetTrailer(ctx, metadata.Pairs("barAttempts", strconv.Itoa(attempts)))
 	if err != nil {
-		log.Printf("Error calling bar service: %v", err)
+		logging.FromContext(ctx).With("backend", "bar", "attempts", attempts).Errorf("Error calling bar service: %v", err)
 		return nil, err
 	}
 
-	barVersion := bmd["version"][0]
+	barVersion := v.(metadata.MD)["version"][0]
+	accesslog.SetVersion(ctx, "bar", barVersion)
 
 	// Call the foo service with the trace headers and extract the version
 	// from the response metadata.
-	fmd := metadata.New(map[string]string{})
-	fooCtx := metadata.NewOutgoingContext(context.Background(), hmd)
-	_, err = s.foo.Ping(fooCtx, &ping.Request{}, grpc.Trailer(&fmd))
+	fooCtx := metadata.NewOutgoingContext(base, hmd)
+	v, attempts, err = s.fooRetrier.Do(fooCtx, pingTrailer(s.foo))
+	grpc.SetTrailer(ctx, metadata.Pairs("fooAttempts", strconv.Itoa(attempts)))
 	if err != nil {
-		log.Printf("Error calling foo service: %v", err)
+		logging.FromContext(ctx).With("backend", "foo", "attempts", attempts).Errorf("Error calling foo service: %v", err)
 		return nil, err
 	}
 
-	fooVersion := fmd["version"][0]
+	fooVersion := v.(metadata.MD)["version"][0]
+	accesslog.SetVersion(ctx, "foo", fooVersion)
 
 	// Set the reponse metadata that will be send back to the client.
 	md := metadata.New(map[string]string{
@@ -85,8 +115,25 @@ func (s *server) Ping(ctx context.Context, in *ping.Request) (*ping.Response, er
 	})
 
 	if err := grpc.SetTrailer(ctx, md); err != nil {
-		log.Printf("Error setting the response metadata: %v", err)
+		logging.FromContext(ctx).Errorf("Error setting the response metadata: %v", err)
 	}
 
 	return &ping.Response{Message: "pong"}, nil
 }
+
+// pingTrailer returns a call that pings client and returns the response
+// trailer. Every attempt of the call gets its own trailer.
+func pingTrailer(client ping.PingClient) retry.Call {
+	return func(ctx context.Context) (interface{}, error) {
+		md := metadata.MD{}
+		_, err := client.Ping(ctx, &ping.Request{}, grpc.Trailer(&md))
+		return md, err
+	}
+}
+
+// detach returns a context that carries the trace context and the logger of
+// ctx but is not canceled with it, for the downstream calls of a request.
+func detach(ctx context.Context) context.Context {
+	base := propagation.NewContext(context.Background(), propagation.FromContext(ctx))
+	return logging.NewContext(base, logging.FromContext(ctx))
+}
@@ -0,0 +1,95 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package service builds the parts of the frontend and backend that they
+// configure with the same flags.
+package service
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/kelseyhightower/ping/accesslog"
+	"github.com/kelseyhightower/ping/admin"
+	"github.com/kelseyhightower/ping/auth"
+	"github.com/kelseyhightower/ping/logging"
+	"github.com/kelseyhightower/ping/tracing"
+)
+
+// TracingConfig is the tracing configuration of a service.
+type TracingConfig struct {
+	// ServiceName and Addr identify the service in its spans.
+	ServiceName string
+	Addr        string
+	// ZipkinURL is the collector spans are posted to, and File the file
+	// they are appended to. At most one may be set.
+	ZipkinURL  string
+	File       string
+	SampleRate float64
+}
+
+// NewTracer returns the tracer configured by cfg, or nil if tracing is
+// disabled.
+func NewTracer(cfg TracingConfig) (*tracing.Tracer, error) {
+	var exporter tracing.Exporter
+	switch {
+	case cfg.ZipkinURL != "" && cfg.File != "":
+		return nil, errors.New("-zipkin-url and -trace-file cannot be used together")
+	case cfg.ZipkinURL != "":
+		exporter = tracing.NewHTTPExporter(cfg.ZipkinURL)
+		logging.Infof("Sending spans to %s", cfg.ZipkinURL)
+	case cfg.File != "":
+		e, err := tracing.NewFileExporter(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		exporter = e
+		logging.Infof("Writing spans to %s", cfg.File)
+	default:
+		return nil, nil
+	}
+	return tracing.NewTracer(tracing.NewEndpoint(cfg.ServiceName, cfg.Addr), exporter, cfg.SampleRate), nil
+}
+
+// NewAccessLogger returns the access logger configured by cfg, or nil if
+// cfg.Path is empty and the access log is disabled.
+func NewAccessLogger(cfg accesslog.Config) (*accesslog.Logger, error) {
+	if cfg.Path == "" {
+		return nil, nil
+	}
+	l, err := accesslog.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	logging.Infof("Writing the access log to %s", cfg.Path)
+	return l, nil
+}
+
+// NewAdminServer returns the admin server listening on addr, or nil if
+// addr is empty and the admin server is disabled. If tokenFile is set,
+// requests must present the token it holds.
+func NewAdminServer(addr, tokenFile string) (*http.Server, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	var token string
+	if tokenFile != "" {
+		secret, err := auth.LoadSecret(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = string(secret)
+	}
+	logging.Infof("Admin server listening on: %s, token required: %t", addr, token != "")
+	return &http.Server{Addr: addr, Handler: admin.Handler(token)}, nil
+}
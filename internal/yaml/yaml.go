@@ -0,0 +1,503 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package yaml decodes the subset of YAML used by the configuration files
+// in this repository: block mappings and sequences, flow sequences and
+// mappings, plain, single and double quoted scalars, literal (|) and folded
+// (>) block scalars, and comments. Anchors, tags and multiple documents are
+// not supported.
+//
+// Documents are decoded into Go values through encoding/json, so the
+// destination types use json struct tags.
+package yaml
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Unmarshal decodes the YAML document in data into v.
+func Unmarshal(data []byte, v interface{}) error {
+	tree, err := Parse(data)
+	if err != nil {
+		return err
+	}
+	js, err := json.Marshal(tree)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(js, v)
+}
+
+// Parse decodes the YAML document in data into a tree of
+// map[string]interface{}, []interface{}, string, int64, float64, bool and
+// nil values.
+func Parse(data []byte) (interface{}, error) {
+	p := &parser{}
+	for i, text := range strings.Split(string(data), "\n") {
+		text = strings.TrimRight(text, " \t\r")
+		p.lines = append(p.lines, line{number: i + 1, raw: text})
+	}
+	p.prepare()
+	if len(p.lines) == 0 {
+		return nil, nil
+	}
+	v, err := p.parseNode(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		return nil, fmt.Errorf("yaml: line %d: unexpected indentation", l.number)
+	}
+	return v, nil
+}
+
+type line struct {
+	number int
+	indent int
+	raw    string
+	// text is the content without indentation and trailing comments.
+	text string
+}
+
+type parser struct {
+	lines []line
+	pos   int
+}
+
+// prepare computes the indentation of every line and removes comments and
+// blank lines. Lines that belong to block scalars are kept as they are.
+func (p *parser) prepare() {
+	var lines []line
+	blockIndent := -1
+	for _, l := range p.lines {
+		trimmed := strings.TrimLeft(l.raw, " ")
+		l.indent = len(l.raw) - len(trimmed)
+		if blockIndent >= 0 {
+			if trimmed == "" || l.indent > blockIndent {
+				l.text = l.raw
+				l.indent = -1
+				lines = append(lines, l)
+				continue
+			}
+			blockIndent = -1
+		}
+		l.text = stripComment(trimmed)
+		if l.text == "" || l.text == "---" || l.text == "..." {
+			continue
+		}
+		text := l.text
+		for isSequenceItem(text) {
+			text = strings.TrimLeft(strings.TrimPrefix(text, "-"), " ")
+		}
+		if _, value, ok := splitKey(text); ok && isBlockScalar(value) {
+			blockIndent = l.indent
+		}
+		lines = append(lines, l)
+	}
+	p.lines = lines
+}
+
+// stripComment removes a trailing comment that is not inside quotes.
+func stripComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || strings.ContainsRune(" [{,:-", rune(s[i-1])) {
+				quote = c
+			}
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return strings.TrimRight(s[:i], " \t")
+		}
+	}
+	return s
+}
+
+func (p *parser) errorf(l line, format string, args ...interface{}) error {
+	return fmt.Errorf("yaml: line %d: %s", l.number, fmt.Sprintf(format, args...))
+}
+
+// parseNode parses the block node that starts at the current line, whose
+// indentation is indent.
+func (p *parser) parseNode(indent int) (interface{}, error) {
+	l := p.lines[p.pos]
+	if isSequenceItem(l.text) {
+		return p.parseSequence(indent)
+	}
+	if _, _, ok := splitKey(l.text); ok {
+		return p.parseMapping(indent)
+	}
+	p.pos++
+	return parseScalar(l.text, l)
+}
+
+func isSequenceItem(s string) bool {
+	return s == "-" || strings.HasPrefix(s, "- ")
+}
+
+func (p *parser) parseSequence(indent int) (interface{}, error) {
+	items := []interface{}{}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent != indent || !isSequenceItem(l.text) {
+			if l.indent > indent {
+				return nil, p.errorf(l, "unexpected indentation")
+			}
+			break
+		}
+		rest := strings.TrimLeft(strings.TrimPrefix(l.text, "-"), " ")
+		if rest == "" {
+			p.pos++
+			if p.pos >= len(p.lines) || p.lines[p.pos].indent <= indent {
+				items = append(items, nil)
+				continue
+			}
+			v, err := p.parseNode(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+			continue
+		}
+		// The content after the dash starts a node indented to its column,
+		// so "- name: a" continues with "  value: b".
+		p.lines[p.pos].indent = indent + len(l.text) - len(rest)
+		p.lines[p.pos].text = rest
+		v, err := p.parseNode(p.lines[p.pos].indent)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, v)
+	}
+	return items, nil
+}
+
+func (p *parser) parseMapping(indent int) (interface{}, error) {
+	m := map[string]interface{}{}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent != indent {
+			if l.indent > indent {
+				return nil, p.errorf(l, "unexpected indentation")
+			}
+			break
+		}
+		key, value, ok := splitKey(l.text)
+		if !ok {
+			return nil, p.errorf(l, "expected a key: value pair, got %q", l.text)
+		}
+		if _, dup := m[key]; dup {
+			return nil, p.errorf(l, "duplicate key %q", key)
+		}
+		p.pos++
+
+		switch {
+		case value == "":
+			// The value is the nested block, if any. Sequences may be at the
+			// same indentation as their key.
+			if p.pos < len(p.lines) {
+				next := p.lines[p.pos]
+				if next.indent > indent || (next.indent == indent && isSequenceItem(next.text)) {
+					v, err := p.parseNode(next.indent)
+					if err != nil {
+						return nil, err
+					}
+					m[key] = v
+					continue
+				}
+			}
+			m[key] = nil
+		case isBlockScalar(value):
+			m[key] = p.parseBlockScalar(value)
+		default:
+			v, err := parseScalar(value, l)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+		}
+	}
+	return m, nil
+}
+
+// splitKey splits "key: value" into its key and value. It reports false if
+// s is not a mapping entry.
+func splitKey(s string) (string, string, bool) {
+	if s == "" || s[0] == '[' || s[0] == '{' {
+		return "", "", false
+	}
+	if s[0] == '"' || s[0] == '\'' {
+		end := closingQuote(s)
+		if end < 0 {
+			return "", "", false
+		}
+		rest := s[end+1:]
+		if rest != ":" && !strings.HasPrefix(rest, ": ") {
+			return "", "", false
+		}
+		key, err := unquote(s[:end+1])
+		if err != nil {
+			return "", "", false
+		}
+		return key, strings.TrimSpace(rest[1:]), true
+	}
+	if strings.HasSuffix(s, ":") && !strings.Contains(s, ": ") {
+		return s[:len(s)-1], "", true
+	}
+	i := strings.Index(s, ": ")
+	if i < 0 {
+		return "", "", false
+	}
+	return strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+2:]), true
+}
+
+// closingQuote returns the index of the quote that closes the quoted string
+// at the start of s, or -1.
+func closingQuote(s string) int {
+	q := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case q == '"' && s[i] == '\\':
+			i++
+		case q == '\'' && s[i] == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			i++
+		case s[i] == q:
+			return i
+		}
+	}
+	return -1
+}
+
+func unquote(s string) (string, error) {
+	if s[0] == '\'' {
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	}
+	return strconv.Unquote(s)
+}
+
+func isBlockScalar(s string) bool {
+	switch s {
+	case "|", ">", "|-", ">-":
+		return true
+	}
+	return false
+}
+
+// parseBlockScalar reads the lines of a literal or folded block scalar that
+// follow the current line.
+func (p *parser) parseBlockScalar(style string) string {
+	var lines []string
+	contentIndent := -1
+	for p.pos < len(p.lines) && p.lines[p.pos].indent < 0 {
+		raw := p.lines[p.pos].raw
+		p.pos++
+		trimmed := strings.TrimLeft(raw, " ")
+		if trimmed == "" {
+			lines = append(lines, "")
+			continue
+		}
+		if contentIndent < 0 {
+			contentIndent = len(raw) - len(trimmed)
+		}
+		if len(raw)-len(trimmed) < contentIndent {
+			contentIndent = len(raw) - len(trimmed)
+		}
+		lines = append(lines, raw[contentIndent:])
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	var s string
+	if style[0] == '|' {
+		s = strings.Join(lines, "\n")
+	} else {
+		for i, l := range lines {
+			switch {
+			case i == 0:
+				s = l
+			case l == "":
+				s += "\n"
+			case strings.HasSuffix(s, "\n"):
+				s += l
+			default:
+				s += " " + l
+			}
+		}
+	}
+	if !strings.HasSuffix(style, "-") && s != "" {
+		s += "\n"
+	}
+	return s
+}
+
+// parseScalar parses a single line value, which may be a flow collection.
+func parseScalar(s string, l line) (interface{}, error) {
+	if s != "" && (s[0] == '[' || s[0] == '{') {
+		f := &flowParser{s: s}
+		v, err := f.parse()
+		if err == nil {
+			f.skipSpace()
+			if f.pos < len(f.s) {
+				err = fmt.Errorf("unexpected %q after flow collection", f.s[f.pos:])
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("yaml: line %d: %v", l.number, err)
+		}
+		return v, nil
+	}
+	if s != "" && (s[0] == '"' || s[0] == '\'') {
+		if closingQuote(s) != len(s)-1 {
+			return nil, fmt.Errorf("yaml: line %d: unterminated or malformed quoted string %s", l.number, s)
+		}
+		v, err := unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("yaml: line %d: invalid quoted string %s", l.number, s)
+		}
+		return v, nil
+	}
+	return plainScalar(s), nil
+}
+
+// plainScalar resolves an unquoted scalar to null, a boolean, a number or a
+// string.
+func plainScalar(s string) interface{} {
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	}
+	if i, err := strconv.ParseInt(s, 0, 64); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil && !strings.ContainsAny(s, "xXpP_") {
+		return f
+	}
+	return s
+}
+
+// flowParser parses flow sequences and mappings such as [a, b] and
+// {key: value}.
+type flowParser struct {
+	s   string
+	pos int
+}
+
+func (f *flowParser) skipSpace() {
+	for f.pos < len(f.s) && f.s[f.pos] == ' ' {
+		f.pos++
+	}
+}
+
+func (f *flowParser) parse() (interface{}, error) {
+	f.skipSpace()
+	if f.pos >= len(f.s) {
+		return nil, fmt.Errorf("unexpected end of flow collection")
+	}
+	switch f.s[f.pos] {
+	case '[':
+		f.pos++
+		items := []interface{}{}
+		for {
+			f.skipSpace()
+			if f.pos < len(f.s) && f.s[f.pos] == ']' {
+				f.pos++
+				return items, nil
+			}
+			v, err := f.parse()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+			if err := f.separator(']'); err != nil {
+				return nil, err
+			}
+		}
+	case '{':
+		f.pos++
+		m := map[string]interface{}{}
+		for {
+			f.skipSpace()
+			if f.pos < len(f.s) && f.s[f.pos] == '}' {
+				f.pos++
+				return m, nil
+			}
+			k, err := f.parse()
+			if err != nil {
+				return nil, err
+			}
+			f.skipSpace()
+			if f.pos >= len(f.s) || f.s[f.pos] != ':' {
+				return nil, fmt.Errorf("expected ':' in flow mapping")
+			}
+			f.pos++
+			v, err := f.parse()
+			if err != nil {
+				return nil, err
+			}
+			m[fmt.Sprint(k)] = v
+			if err := f.separator('}'); err != nil {
+				return nil, err
+			}
+		}
+	case '"', '\'':
+		end := closingQuote(f.s[f.pos:])
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated quoted string")
+		}
+		v, err := unquote(f.s[f.pos : f.pos+end+1])
+		f.pos += end + 1
+		return v, err
+	}
+	start := f.pos
+	for f.pos < len(f.s) && !strings.ContainsRune(",]}", rune(f.s[f.pos])) {
+		// A colon followed by a space ends a key in a flow mapping.
+		if f.s[f.pos] == ':' && (f.pos+1 == len(f.s) || f.s[f.pos+1] == ' ') {
+			break
+		}
+		f.pos++
+	}
+	return plainScalar(strings.TrimSpace(f.s[start:f.pos])), nil
+}
+
+// separator consumes the comma between items, or leaves the closing
+// bracket for the caller.
+func (f *flowParser) separator(closing byte) error {
+	f.skipSpace()
+	if f.pos >= len(f.s) {
+		return fmt.Errorf("missing %q", closing)
+	}
+	switch f.s[f.pos] {
+	case ',':
+		f.pos++
+		return nil
+	case closing:
+		return nil
+	}
+	return fmt.Errorf("expected ',' or %q, got %q", closing, f.s[f.pos])
+}
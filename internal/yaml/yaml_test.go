@@ -0,0 +1,157 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package yaml
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want interface{}
+	}{
+		{"empty", "", nil},
+		{"comment only", "# nothing here\n", nil},
+		{"plain string", "hello world", "hello world"},
+		{"integer", "42", int64(42)},
+		{"negative integer", "-7", int64(-7)},
+		{"hex integer", "0x1f", int64(31)},
+		{"float", "2.5", 2.5},
+		{"bool", "a: true\nb: False\nc: TRUE", map[string]interface{}{"a": true, "b": false, "c": true}},
+		{"null", "a: ~\nb: null\nc:", map[string]interface{}{"a": nil, "b": nil, "c": nil}},
+		{"duration stays a string", "interval: 10s", map[string]interface{}{"interval": "10s"}},
+		{"version stays a string", "version: 1.2.3", map[string]interface{}{"version": "1.2.3"}},
+		{"trailing comment", "name: bar # the backend", map[string]interface{}{"name": "bar"}},
+		{"hash without space", "url: http://a/#frag", map[string]interface{}{"url": "http://a/#frag"}},
+		{"colon in value", "target: bar:8080", map[string]interface{}{"target": "bar:8080"}},
+		{"double quoted", `a: "x: y # z"`, map[string]interface{}{"a": "x: y # z"}},
+		{"double quoted escapes", `a: "tab\there\n"`, map[string]interface{}{"a": "tab\there\n"}},
+		{"single quoted", `a: 'it''s'`, map[string]interface{}{"a": "it's"}},
+		{"quoted number", `a: "10"`, map[string]interface{}{"a": "10"}},
+		{"quoted key", `"x-user: id": 1`, map[string]interface{}{"x-user: id": int64(1)}},
+		{
+			"nested mapping",
+			"a:\n  b:\n    c: 1\n  d: 2\ne: 3",
+			map[string]interface{}{"a": map[string]interface{}{"b": map[string]interface{}{"c": int64(1)}, "d": int64(2)}, "e": int64(3)},
+		},
+		{
+			"sequence of scalars",
+			"- a\n- 1\n- true",
+			[]interface{}{"a", int64(1), true},
+		},
+		{
+			"sequence at key indentation",
+			"items:\n- a\n- b\nnext: 1",
+			map[string]interface{}{"items": []interface{}{"a", "b"}, "next": int64(1)},
+		},
+		{
+			"sequence of mappings",
+			"probes:\n  - name: a\n    target: x\n  - name: b\n    target: y",
+			map[string]interface{}{"probes": []interface{}{map[string]interface{}{"name": "a", "target": "x"}, map[string]interface{}{"name": "b", "target": "y"}}},
+		},
+		{
+			"nested sequences",
+			"- - a\n  - b\n- - c",
+			[]interface{}{[]interface{}{"a", "b"}, []interface{}{"c"}},
+		},
+		{
+			"empty sequence item",
+			"-\n- a",
+			[]interface{}{nil, "a"},
+		},
+		{"flow sequence", "a: [1, two, 'three', \"four\"]", map[string]interface{}{"a": []interface{}{int64(1), "two", "three", "four"}}},
+		{"empty flow sequence", "a: []", map[string]interface{}{"a": []interface{}{}}},
+		{"nested flow sequence", "a: [[1, 2], [], [3]]", map[string]interface{}{"a": []interface{}{[]interface{}{int64(1), int64(2)}, []interface{}{}, []interface{}{int64(3)}}}},
+		{"flow mapping", "a: {x: 1, y: [b, c]}", map[string]interface{}{"a": map[string]interface{}{"x": int64(1), "y": []interface{}{"b", "c"}}}},
+		{"flow with quoted comma", `a: ["x, y", z]`, map[string]interface{}{"a": []interface{}{"x, y", "z"}}},
+		{"flow with trailing comment", "a: [1, 2] # numbers", map[string]interface{}{"a": []interface{}{int64(1), int64(2)}}},
+		{"literal block", "a: |\n  one\n  two\nb: 1", map[string]interface{}{"a": "one\ntwo\n", "b": int64(1)}},
+		{"literal block strip", "a: |-\n  one\n  two", map[string]interface{}{"a": "one\ntwo"}},
+		{"literal block keeps comments", "a: |\n  # not a comment\n  x", map[string]interface{}{"a": "# not a comment\nx\n"}},
+		{"folded block", "a: >\n  one\n  two\n\n  three", map[string]interface{}{"a": "one two\nthree\n"}},
+		{"document markers", "---\na: 1\n...", map[string]interface{}{"a": int64(1)}},
+	}
+	for _, tt := range tests {
+		got, err := Parse([]byte(tt.doc))
+		if err != nil {
+			t.Errorf("%s: Parse(%q) returned error: %v", tt.name, tt.doc, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Parse(%q) = %#v, want %#v", tt.name, tt.doc, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want string
+	}{
+		{"duplicate key", "a: 1\nb: 2\na: 3", "yaml: line 3: duplicate key \"a\""},
+		{"unexpected indentation", "a: 1\n    b: 2", "yaml: line 2: unexpected indentation"},
+		{"indented after sequence", "- a\n   - b", "yaml: line 2: unexpected indentation"},
+		{"scalar in mapping", "a: 1\n# comment\nb", "yaml: line 3: expected a key: value pair"},
+		{"unterminated quote", "a: 1\nb: \"open", "yaml: line 2: unterminated or malformed quoted string"},
+		{"text after quote", "a: 'x' y", "yaml: line 1: unterminated or malformed quoted string"},
+		{"unterminated flow sequence", "a: [1, 2", "yaml: line 1: missing ']'"},
+		{"flow mapping without colon", "\n\na: {x}", "yaml: line 3: expected ':' in flow mapping"},
+		{"text after flow", "a: [1] x", "yaml: line 1: unexpected \"x\" after flow collection"},
+		{"bad separator", "a: [1 2}", "yaml: line 1: expected ',' or ']'"},
+	}
+	for _, tt := range tests {
+		_, err := Parse([]byte(tt.doc))
+		if err == nil {
+			t.Errorf("%s: Parse(%q) returned no error", tt.name, tt.doc)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("%s: Parse(%q) returned %q, want prefix %q", tt.name, tt.doc, err, tt.want)
+		}
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	var config struct {
+		Interval string `json:"interval"`
+		Probes   []struct {
+			Name    string            `json:"name"`
+			Port    int               `json:"port"`
+			Headers map[string]string `json:"headers"`
+		} `json:"probes"`
+	}
+	doc := `
+interval: 30s
+probes:
+  - name: bar
+    port: 8080
+    headers:
+      x-user: "1"
+`
+	if err := Unmarshal([]byte(doc), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Interval != "30s" || len(config.Probes) != 1 {
+		t.Fatalf("Unmarshal = %+v", config)
+	}
+	p := config.Probes[0]
+	if p.Name != "bar" || p.Port != 8080 || p.Headers["x-user"] != "1" {
+		t.Errorf("Unmarshal probe = %+v", p)
+	}
+}
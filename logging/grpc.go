@@ -0,0 +1,75 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"time"
+
+	"github.com/kelseyhightower/ping/middleware"
+	"github.com/kelseyhightower/ping/propagation"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+)
+
+// ForRequest returns l with the fields that identify a request: its
+// request ID and trace ID, taken from the trace context in ctx, its method
+// and its peer.
+func (l *Logger) ForRequest(ctx context.Context, method, peerAddr string) *Logger {
+	var keyvals []interface{}
+	if c := propagation.FromContext(ctx); c != nil {
+		if c.RequestID != "" {
+			keyvals = append(keyvals, "request_id", c.RequestID)
+		}
+		keyvals = append(keyvals, "trace_id", c.TraceID)
+	}
+	keyvals = append(keyvals, "method", method, "peer", peerAddr)
+	return l.With(keyvals...)
+}
+
+func forCall(ctx context.Context, method string) *Logger {
+	addr := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		addr = p.Addr.String()
+	}
+	return FromContext(ctx).ForRequest(ctx, method, addr)
+}
+
+// UnaryServerInterceptor returns an interceptor that puts a logger for
+// every unary call in its context. It must come after the propagation
+// interceptor.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		l := forCall(ctx, info.FullMethod)
+		start := time.Now()
+		resp, err := handler(NewContext(ctx, l), req)
+		l.Debugf("Finished call with code %s in %s", grpc.Code(err), time.Since(start))
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor returns an interceptor that puts a logger for
+// every streaming call in its context. It must come after the propagation
+// interceptor.
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx := ss.Context()
+		l := forCall(ctx, info.FullMethod)
+		start := time.Now()
+		err := handler(srv, middleware.WrapServerStream(ss, NewContext(ctx, l)))
+		l.Debugf("Finished call with code %s in %s", grpc.Code(err), time.Since(start))
+		return err
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc/grpclog"
+)
+
+// GRPCLogger returns a grpclog.Logger that writes the messages of the
+// gRPC library with the default logger, at the info level.
+func GRPCLogger() grpclog.Logger {
+	return grpcLogger{}
+}
+
+type grpcLogger struct{}
+
+func (grpcLogger) Print(args ...interface{}) {
+	Default().log(InfoLevel, "%s", []interface{}{fmt.Sprint(args...)})
+}
+
+func (grpcLogger) Printf(format string, args ...interface{}) {
+	Default().log(InfoLevel, format, args)
+}
+
+func (grpcLogger) Println(args ...interface{}) {
+	Default().log(InfoLevel, "%s", []interface{}{strings.TrimSuffix(fmt.Sprintln(args...), "\n")})
+}
+
+func (grpcLogger) Fatal(args ...interface{}) {
+	Default().log(ErrorLevel, "%s", []interface{}{fmt.Sprint(args...)})
+	os.Exit(1)
+}
+
+func (grpcLogger) Fatalf(format string, args ...interface{}) {
+	Default().log(ErrorLevel, format, args)
+	os.Exit(1)
+}
+
+func (grpcLogger) Fatalln(args ...interface{}) {
+	Default().log(ErrorLevel, "%s", []interface{}{strings.TrimSuffix(fmt.Sprintln(args...), "\n")})
+	os.Exit(1)
+}
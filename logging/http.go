@@ -0,0 +1,57 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Handler returns h wrapped so that every request has a logger in its
+// context. It must be wrapped by propagation.Handler.
+func Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		l := FromContext(ctx).ForRequest(ctx, r.Method+" "+r.URL.Path, r.RemoteAddr)
+		h.ServeHTTP(w, r.WithContext(NewContext(ctx, l)))
+	})
+}
+
+// LevelHandler returns a handler that reports the level of l on GET and
+// changes it on PUT or POST with a level parameter, such as
+//
+//	curl -X PUT http://127.0.0.1:9090/loglevel?level=debug
+func LevelHandler(l *Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			level, err := ParseLevel(r.FormValue("level"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if old := l.Level(); old != level {
+				l.SetLevel(level)
+				Default().Infof("Changed the log level from %s to %s", old, level)
+			}
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"level": l.Level().String()})
+	})
+}
@@ -0,0 +1,295 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logging is a leveled, structured logger that writes JSON or
+// logfmt lines.
+//
+// Every line has a time, a level and a message, followed by the fields of
+// the logger. The servers put a logger with the request ID, trace ID,
+// method and peer of every call in its context, so that the lines logged
+// while handling a call can be correlated.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Level is the severity of a log line.
+type Level int32
+
+// The levels, from the least to the most severe.
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < DebugLevel || l > ErrorLevel {
+		return "Level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level named s.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q; use debug, info, warn or error", s)
+}
+
+// Formats of the log lines.
+const (
+	JSON   = "json"
+	Logfmt = "logfmt"
+)
+
+// output is shared by a logger and the loggers derived from it with With,
+// so that changing the level affects them all.
+type output struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+	level  int32
+}
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+// Logger writes log lines at or above its level. It is safe for
+// concurrent use.
+type Logger struct {
+	out    *output
+	fields []field
+}
+
+// New returns a logger that writes lines in format, JSON or Logfmt, to w.
+func New(w io.Writer, format string, level Level) (*Logger, error) {
+	if format != JSON && format != Logfmt {
+		return nil, fmt.Errorf("unknown log format %q; use %s or %s", format, JSON, Logfmt)
+	}
+	return &Logger{out: &output{w: w, format: format, level: int32(level)}}, nil
+}
+
+// With returns a logger that adds fields, given as alternating keys and
+// values, to every line.
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]field, len(l.fields), len(l.fields)+len(keyvals)/2)
+	copy(fields, l.fields)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fields = append(fields, field{fmt.Sprint(keyvals[i]), keyvals[i+1]})
+	}
+	return &Logger{out: l.out, fields: fields}
+}
+
+// Level returns the level of the logger.
+func (l *Logger) Level() Level {
+	return Level(atomic.LoadInt32(&l.out.level))
+}
+
+// SetLevel changes the level of the logger and of the loggers that share
+// its output.
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(&l.out.level, int32(level))
+}
+
+// Enabled reports whether lines at level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.Level()
+}
+
+// Debugf logs a debug message.
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log(DebugLevel, format, args)
+}
+
+// Infof logs an informational message.
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(InfoLevel, format, args)
+}
+
+// Warnf logs a warning.
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.log(WarnLevel, format, args)
+}
+
+// Errorf logs an error.
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(ErrorLevel, format, args)
+}
+
+// Fatalf logs an error and exits.
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.log(ErrorLevel, format, args)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level Level, format string, args []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	fields := make([]field, 0, 3+len(l.fields))
+	fields = append(fields,
+		field{"time", time.Now().UTC().Format(time.RFC3339Nano)},
+		field{"level", level.String()},
+		field{"msg", fmt.Sprintf(format, args...)},
+	)
+	fields = append(fields, l.fields...)
+
+	var buf bytes.Buffer
+	if l.out.format == JSON {
+		writeJSON(&buf, fields)
+	} else {
+		writeLogfmt(&buf, fields)
+	}
+	buf.WriteByte('\n')
+
+	l.out.mu.Lock()
+	l.out.w.Write(buf.Bytes())
+	l.out.mu.Unlock()
+}
+
+// plain returns the value of a field as it is logged, except for strings
+// which are quoted by the format.
+func plain(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	case time.Duration:
+		return v.String()
+	}
+	return v
+}
+
+func writeJSON(buf *bytes.Buffer, fields []field) {
+	buf.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(f.key)
+		buf.Write(key)
+		buf.WriteByte(':')
+		value, err := json.Marshal(plain(f.value))
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(f.value))
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+}
+
+func writeLogfmt(buf *bytes.Buffer, fields []field) {
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(logfmtValue(f.key))
+		buf.WriteByte('=')
+		buf.WriteString(logfmtValue(fmt.Sprint(plain(f.value))))
+	}
+}
+
+// logfmtValue quotes s if it is empty or contains spaces, quotes, equal
+// signs or control characters.
+func logfmtValue(s string) string {
+	if s == "" || strings.IndexFunc(s, func(r rune) bool {
+		return r <= ' ' || r == '=' || r == '"' || r == 0x7f
+	}) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+var (
+	mu  sync.RWMutex
+	std = &Logger{out: &output{w: os.Stderr, format: Logfmt, level: int32(InfoLevel)}}
+)
+
+// Default returns the logger used outside of calls, and by FromContext for
+// contexts without a logger.
+func Default() *Logger {
+	mu.RLock()
+	defer mu.RUnlock()
+	return std
+}
+
+// SetDefault replaces the default logger, which writes logfmt lines at the
+// info level to standard error.
+func SetDefault(l *Logger) {
+	mu.Lock()
+	std = l
+	mu.Unlock()
+}
+
+// Debugf logs a debug message with the default logger.
+func Debugf(format string, args ...interface{}) {
+	Default().log(DebugLevel, format, args)
+}
+
+// Infof logs an informational message with the default logger.
+func Infof(format string, args ...interface{}) {
+	Default().log(InfoLevel, format, args)
+}
+
+// Warnf logs a warning with the default logger.
+func Warnf(format string, args ...interface{}) {
+	Default().log(WarnLevel, format, args)
+}
+
+// Errorf logs an error with the default logger.
+func Errorf(format string, args ...interface{}) {
+	Default().log(ErrorLevel, format, args)
+}
+
+// Fatalf logs an error with the default logger and exits.
+func Fatalf(format string, args ...interface{}) {
+	Default().log(ErrorLevel, format, args)
+	os.Exit(1)
+}
+
+type loggerKey struct{}
+
+// NewContext returns a context that carries l.
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// FromContext returns the logger in ctx, or the default logger.
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return l
+	}
+	return Default()
+}
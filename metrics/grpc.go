@@ -0,0 +1,221 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/stats"
+)
+
+// splitMethod splits /package.Service/Method into its service and method.
+func splitMethod(fullMethod string) (string, string) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	if i := strings.Index(fullMethod, "/"); i >= 0 {
+		return fullMethod[:i], fullMethod[i+1:]
+	}
+	return "unknown", fullMethod
+}
+
+type rpcKey struct{}
+
+// rpcInfo is what a stats handler remembers about an RPC between its
+// events.
+type rpcInfo struct {
+	service string
+	method  string
+	begin   time.Time
+}
+
+// ServerMetrics records the RPCs handled by a gRPC server. It is a
+// stats.Handler, installed with grpc.StatsHandler.
+type ServerMetrics struct {
+	started  *CounterVec
+	handled  *CounterVec
+	latency  *HistogramVec
+	inFlight *GaugeVec
+	received *CounterVec
+	sent     *CounterVec
+}
+
+// NewServerMetrics registers the gRPC server metrics with r.
+func NewServerMetrics(r *Registry) *ServerMetrics {
+	return &ServerMetrics{
+		started: r.NewCounterVec("grpc_server_started_total",
+			"Total number of RPCs started on the server.", "grpc_service", "grpc_method"),
+		handled: r.NewCounterVec("grpc_server_handled_total",
+			"Total number of RPCs completed on the server, by status code.", "grpc_service", "grpc_method", "grpc_code"),
+		latency: r.NewHistogramVec("grpc_server_handling_seconds",
+			"Latency of RPCs handled by the server.", DefaultBuckets, "grpc_service", "grpc_method"),
+		inFlight: r.NewGaugeVec("grpc_server_in_flight",
+			"Number of RPCs currently being handled by the server.", "grpc_service", "grpc_method"),
+		received: r.NewCounterVec("grpc_server_msg_received_total",
+			"Total number of messages received by the server.", "grpc_service", "grpc_method"),
+		sent: r.NewCounterVec("grpc_server_msg_sent_total",
+			"Total number of messages sent by the server.", "grpc_service", "grpc_method"),
+	}
+}
+
+// TagRPC remembers the method of the RPC.
+func (m *ServerMetrics) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	service, method := splitMethod(info.FullMethodName)
+	return context.WithValue(ctx, rpcKey{}, &rpcInfo{service: service, method: method})
+}
+
+// HandleRPC records the events of the RPC.
+func (m *ServerMetrics) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	info, ok := ctx.Value(rpcKey{}).(*rpcInfo)
+	if !ok {
+		return
+	}
+	switch s := s.(type) {
+	case *stats.Begin:
+		info.begin = s.BeginTime
+		m.started.With(info.service, info.method).Inc()
+		m.inFlight.With(info.service, info.method).Inc()
+	case *stats.InPayload:
+		m.received.With(info.service, info.method).Inc()
+	case *stats.OutPayload:
+		m.sent.With(info.service, info.method).Inc()
+	case *stats.End:
+		m.inFlight.With(info.service, info.method).Dec()
+		m.handled.With(info.service, info.method, grpc.Code(s.Error).String()).Inc()
+		m.latency.With(info.service, info.method).Observe(s.EndTime.Sub(info.begin).Seconds())
+	}
+}
+
+// TagConn returns ctx unchanged.
+func (m *ServerMetrics) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+// HandleConn does nothing.
+func (m *ServerMetrics) HandleConn(ctx context.Context, s stats.ConnStats) {}
+
+// attemptBuckets are the buckets of the number of attempts per call.
+var attemptBuckets = []float64{1, 2, 3, 4, 5}
+
+// ClientMetrics records the RPCs sent to downstream services.
+type ClientMetrics struct {
+	started   *CounterVec
+	handled   *CounterVec
+	latency   *HistogramVec
+	inFlight  *GaugeVec
+	attempts  *HistogramVec
+	retries   *CounterVec
+	throttled *CounterVec
+	breakers  *GaugeVec
+	rejected  *CounterVec
+}
+
+// NewClientMetrics registers the gRPC client metrics with r.
+func NewClientMetrics(r *Registry) *ClientMetrics {
+	return &ClientMetrics{
+		started: r.NewCounterVec("grpc_client_started_total",
+			"Total number of RPCs started on the client.", "downstream", "grpc_service", "grpc_method"),
+		handled: r.NewCounterVec("grpc_client_handled_total",
+			"Total number of RPCs completed by the client, by status code.", "downstream", "grpc_service", "grpc_method", "grpc_code"),
+		latency: r.NewHistogramVec("grpc_client_handling_seconds",
+			"Latency of RPCs sent by the client, until the response is received.", DefaultBuckets, "downstream", "grpc_service", "grpc_method"),
+		inFlight: r.NewGaugeVec("grpc_client_in_flight",
+			"Number of RPCs currently waiting for a response.", "downstream", "grpc_service", "grpc_method"),
+		attempts: r.NewHistogramVec("grpc_client_attempts",
+			"Number of attempts per call, including retries and hedged requests.", attemptBuckets, "downstream"),
+		retries: r.NewCounterVec("grpc_client_retries_total",
+			"Total number of retries (kind retry) and hedged requests (kind hedge) sent.", "downstream", "kind"),
+		throttled: r.NewCounterVec("grpc_client_retries_throttled_total",
+			"Total number of retries and hedged requests not sent because the retry budget was exhausted.", "downstream"),
+		breakers: r.NewGaugeVec("grpc_client_circuit_breaker_state",
+			"State of the circuit breaker of an endpoint: 0 closed, 1 open, 2 half-open.", "downstream", "endpoint"),
+		rejected: r.NewCounterVec("grpc_client_circuit_breaker_rejected_total",
+			"Total number of calls failed fast by an open circuit breaker.", "downstream"),
+	}
+}
+
+// RecordAttempts records the number of attempts a call to downstream used.
+func (m *ClientMetrics) RecordAttempts(downstream string, attempts int) {
+	m.attempts.With(downstream).Observe(float64(attempts))
+}
+
+// RecordRetry records a retry or, if kind is hedge, a hedged request to
+// downstream.
+func (m *ClientMetrics) RecordRetry(downstream, kind string) {
+	m.retries.With(downstream, kind).Inc()
+}
+
+// SetBreakerState sets the state of the circuit breaker of an endpoint of
+// downstream.
+func (m *ClientMetrics) SetBreakerState(downstream, endpoint string, state int) {
+	m.breakers.With(downstream, endpoint).Set(float64(state))
+}
+
+// DeleteBreakerState removes the circuit breaker state of an endpoint that
+// downstream no longer has.
+func (m *ClientMetrics) DeleteBreakerState(downstream, endpoint string) {
+	m.breakers.Delete(downstream, endpoint)
+}
+
+// RecordBreakerRejected records a call to downstream failed fast by a
+// circuit breaker.
+func (m *ClientMetrics) RecordBreakerRejected(downstream string) {
+	m.rejected.With(downstream).Inc()
+}
+
+// RecordThrottled records a retry or hedged request to downstream that the
+// retry budget did not allow.
+func (m *ClientMetrics) RecordThrottled(downstream string) {
+	m.throttled.With(downstream).Inc()
+}
+
+// Handler returns the stats handler for the connection to a downstream
+// service, installed with grpc.WithStatsHandler.
+func (m *ClientMetrics) Handler(downstream string) stats.Handler {
+	return &clientHandler{m, downstream}
+}
+
+type clientHandler struct {
+	m          *ClientMetrics
+	downstream string
+}
+
+func (h *clientHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	service, method := splitMethod(info.FullMethodName)
+	return context.WithValue(ctx, rpcKey{}, &rpcInfo{service: service, method: method})
+}
+
+func (h *clientHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	info, ok := ctx.Value(rpcKey{}).(*rpcInfo)
+	if !ok {
+		return
+	}
+	switch s := s.(type) {
+	case *stats.Begin:
+		info.begin = s.BeginTime
+		h.m.started.With(h.downstream, info.service, info.method).Inc()
+		h.m.inFlight.With(h.downstream, info.service, info.method).Inc()
+	case *stats.End:
+		h.m.inFlight.With(h.downstream, info.service, info.method).Dec()
+		h.m.handled.With(h.downstream, info.service, info.method, grpc.Code(s.Error).String()).Inc()
+		h.m.latency.With(h.downstream, info.service, info.method).Observe(s.EndTime.Sub(info.begin).Seconds())
+	}
+}
+
+func (h *clientHandler) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (h *clientHandler) HandleConn(ctx context.Context, s stats.ConnStats) {}
@@ -0,0 +1,56 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kelseyhightower/ping/middleware"
+)
+
+// HTTPMetrics records the requests served by HTTP handlers.
+type HTTPMetrics struct {
+	requests *CounterVec
+	latency  *HistogramVec
+	inFlight *GaugeVec
+}
+
+// NewHTTPMetrics registers the HTTP server metrics with r.
+func NewHTTPMetrics(r *Registry) *HTTPMetrics {
+	return &HTTPMetrics{
+		requests: r.NewCounterVec("http_requests_total",
+			"Total number of HTTP requests, by status code.", "handler", "method", "code"),
+		latency: r.NewHistogramVec("http_request_duration_seconds",
+			"Latency of HTTP requests.", DefaultBuckets, "handler"),
+		inFlight: r.NewGaugeVec("http_requests_in_flight",
+			"Number of HTTP requests currently being served.", "handler"),
+	}
+}
+
+// Handler returns h instrumented under the name handler.
+func (m *HTTPMetrics) Handler(handler string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight := m.inFlight.With(handler)
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		start := time.Now()
+		rec := middleware.NewResponseRecorder(w)
+		h.ServeHTTP(rec, r)
+		m.latency.With(handler).Observe(time.Since(start).Seconds())
+		m.requests.With(handler, r.Method, strconv.Itoa(rec.Status)).Inc()
+	})
+}
@@ -0,0 +1,366 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics implements counters, gauges and histograms with labels,
+// and exposes them in the Prometheus text format. It also collects the
+// standard metrics of gRPC servers and clients, HTTP handlers and the
+// process itself.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are histogram buckets, in seconds, suited to the latency
+// of RPCs.
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds metric families and writes them in the Prometheus text
+// format.
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+	names    map[string]bool
+	collect  []func()
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (r *Registry) register(f *family) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[f.name] {
+		panic(fmt.Sprintf("metrics: %s registered twice", f.name))
+	}
+	r.names[f.name] = true
+	r.families = append(r.families, f)
+	return f
+}
+
+// family is a metric together with all of its labeled series.
+type family struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+	fn      func() float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	values []string
+
+	mu    sync.Mutex
+	value float64
+	// counts holds the number of observations per bucket of a histogram,
+	// and sum their total.
+	counts []uint64
+	sum    float64
+}
+
+func newFamily(name, help, typ string, labels []string) *family {
+	return &family{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		series: make(map[string]*series),
+	}
+}
+
+func (f *family) with(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		if f.buckets != nil {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (f *family) delete(values []string) {
+	f.mu.Lock()
+	delete(f.series, strings.Join(values, "\xff"))
+	f.mu.Unlock()
+}
+
+func (s *series) add(v float64) {
+	s.mu.Lock()
+	s.value += v
+	s.mu.Unlock()
+}
+
+func (s *series) set(v float64) {
+	s.mu.Lock()
+	s.value = v
+	s.mu.Unlock()
+}
+
+// Counter is a value that only goes up.
+type Counter struct{ s *series }
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() { c.s.add(1) }
+
+// Add adds v, which must not be negative, to the counter.
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		panic("metrics: counters cannot decrease")
+	}
+	c.s.add(v)
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct{ f *family }
+
+// NewCounterVec registers a counter with the given label names.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{r.register(newFamily(name, help, "counter", labels))}
+}
+
+// With returns the counter for the label values, in the order of the label
+// names.
+func (v *CounterVec) With(values ...string) *Counter { return &Counter{v.f.with(values)} }
+
+// Gauge is a value that can go up and down.
+type Gauge struct{ s *series }
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v float64) { g.s.set(v) }
+
+// Inc adds one to the gauge.
+func (g *Gauge) Inc() { g.s.add(1) }
+
+// Dec subtracts one from the gauge.
+func (g *Gauge) Dec() { g.s.add(-1) }
+
+// Add adds v to the gauge.
+func (g *Gauge) Add(v float64) { g.s.add(v) }
+
+// GaugeVec is a gauge partitioned by labels.
+type GaugeVec struct{ f *family }
+
+// NewGaugeVec registers a gauge with the given label names.
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r.register(newFamily(name, help, "gauge", labels))}
+}
+
+// With returns the gauge for the label values.
+func (v *GaugeVec) With(values ...string) *Gauge { return &Gauge{v.f.with(values)} }
+
+// Delete removes the gauge for the label values.
+func (v *GaugeVec) Delete(values ...string) { v.f.delete(values) }
+
+// NewGaugeFunc registers a gauge without labels whose value is computed by
+// f whenever the metrics are written.
+func (r *Registry) NewGaugeFunc(name, help string, f func() float64) {
+	fam := newFamily(name, help, "gauge", nil)
+	fam.fn = f
+	r.register(fam)
+}
+
+// NewCounterFunc registers a counter without labels whose value is
+// computed by f whenever the metrics are written.
+func (r *Registry) NewCounterFunc(name, help string, f func() float64) {
+	fam := newFamily(name, help, "counter", nil)
+	fam.fn = f
+	r.register(fam)
+}
+
+// OnCollect registers f to run whenever the metrics are written, before
+// the values of Func metrics are computed. It lets several Func metrics
+// share one expensive read.
+func (r *Registry) OnCollect(f func()) {
+	r.mu.Lock()
+	r.collect = append(r.collect, f)
+	r.mu.Unlock()
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	s       *series
+	buckets []float64
+}
+
+// Observe records v.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.s.mu.Lock()
+	if i < len(h.buckets) {
+		h.s.counts[i]++
+	}
+	h.s.value++
+	h.s.sum += v
+	h.s.mu.Unlock()
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct{ f *family }
+
+// NewHistogramVec registers a histogram with the given upper bounds and
+// label names. The buckets must be sorted; a +Inf bucket is implied.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	f := newFamily(name, help, "histogram", labels)
+	f.buckets = buckets
+	return &HistogramVec{r.register(f)}
+}
+
+// With returns the histogram for the label values.
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return &Histogram{v.f.with(values), v.f.buckets}
+}
+
+// WriteTo writes all metrics in the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := append([]*family(nil), r.families...)
+	collect := append([]func(){}, r.collect...)
+	r.mu.Unlock()
+	for _, f := range collect {
+		f()
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, f := range families {
+		f.write(cw)
+	}
+	if err := cw.w.Flush(); err != nil {
+		return cw.n, err
+	}
+	return cw.n, cw.err
+}
+
+// ServeHTTP serves the metrics.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) printf(format string, args ...interface{}) {
+	if c.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(c.w, format, args...)
+	c.n += int64(n)
+	c.err = err
+}
+
+func (f *family) write(w *countingWriter) {
+	w.printf("# HELP %s %s\n", f.name, escapeHelp(f.help))
+	w.printf("# TYPE %s %s\n", f.name, f.typ)
+	if f.fn != nil {
+		w.printf("%s %s\n", f.name, formatValue(f.fn()))
+		return
+	}
+
+	f.mu.Lock()
+	all := make([]*series, 0, len(f.series))
+	for _, s := range f.series {
+		all = append(all, s)
+	}
+	f.mu.Unlock()
+	sort.Slice(all, func(i, j int) bool {
+		a, b := all[i].values, all[j].values
+		for k := range a {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return false
+	})
+
+	for _, s := range all {
+		s.mu.Lock()
+		value, sum := s.value, s.sum
+		counts := append([]uint64(nil), s.counts...)
+		s.mu.Unlock()
+
+		labels := formatLabels(f.labels, s.values)
+		if f.typ != "histogram" {
+			w.printf("%s%s %s\n", f.name, labels, formatValue(value))
+			continue
+		}
+		names := append(append([]string(nil), f.labels...), "le")
+		values := append(append([]string(nil), s.values...), "")
+		var cumulative uint64
+		for i, upper := range f.buckets {
+			cumulative += counts[i]
+			values[len(values)-1] = formatValue(upper)
+			w.printf("%s_bucket%s %d\n", f.name, formatLabels(names, values), cumulative)
+		}
+		values[len(values)-1] = "+Inf"
+		w.printf("%s_bucket%s %s\n", f.name, formatLabels(names, values), formatValue(value))
+		w.printf("%s_sum%s %s\n", f.name, labels, formatValue(sum))
+		w.printf("%s_count%s %s\n", f.name, labels, formatValue(value))
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + `="` + escapeLabel(values[i]) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
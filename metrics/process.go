@@ -0,0 +1,127 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clockTicks is the unit of the CPU times in /proc/self/stat. It is 100 on
+// every common Linux configuration.
+const clockTicks = 100
+
+// RegisterProcessMetrics registers metrics about the current process and
+// the Go runtime with r. The CPU, memory and file descriptor metrics are
+// read from /proc and are only registered where it exists.
+func RegisterProcessMetrics(r *Registry) {
+	// The runtime and /proc/self/stat are read once per scrape and shared
+	// by the metrics taken from them; runtime.ReadMemStats stops the world.
+	snap := &processSnapshot{}
+	r.OnCollect(snap.read)
+
+	start := float64(time.Now().UnixNano()) / 1e9
+	r.NewGaugeFunc("process_start_time_seconds",
+		"Start time of the process since the Unix epoch in seconds.",
+		func() float64 { return start })
+	r.NewGaugeFunc("go_goroutines", "Number of goroutines that currently exist.",
+		func() float64 { return float64(runtime.NumGoroutine()) })
+	r.NewGaugeFunc("go_memstats_alloc_bytes", "Number of bytes allocated and still in use.",
+		func() float64 { return float64(snap.memStats().Alloc) })
+	r.NewGaugeFunc("go_memstats_sys_bytes", "Number of bytes obtained from the system.",
+		func() float64 { return float64(snap.memStats().Sys) })
+	r.NewCounterFunc("go_gc_cycles_total", "Number of completed GC cycles.",
+		func() float64 { return float64(snap.memStats().NumGC) })
+
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		return
+	}
+	r.NewCounterFunc("process_cpu_seconds_total", "Total user and system CPU time spent in seconds.",
+		func() float64 {
+			fields := snap.procStat()
+			if len(fields) < 15 {
+				return 0
+			}
+			utime, _ := strconv.ParseFloat(fields[13], 64)
+			stime, _ := strconv.ParseFloat(fields[14], 64)
+			return (utime + stime) / clockTicks
+		})
+	r.NewGaugeFunc("process_resident_memory_bytes", "Resident memory size in bytes.",
+		func() float64 {
+			fields := snap.procStat()
+			if len(fields) < 24 {
+				return 0
+			}
+			rss, _ := strconv.ParseFloat(fields[23], 64)
+			return rss * float64(os.Getpagesize())
+		})
+	r.NewGaugeFunc("process_open_fds", "Number of open file descriptors.",
+		func() float64 {
+			fds, err := ioutil.ReadDir("/proc/self/fd")
+			if err != nil {
+				return 0
+			}
+			return float64(len(fds))
+		})
+}
+
+// processSnapshot holds the runtime and /proc readings of the latest
+// scrape.
+type processSnapshot struct {
+	mu   sync.Mutex
+	ms   runtime.MemStats
+	stat []string
+}
+
+func (s *processSnapshot) read() {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	stat := readProcStat()
+	s.mu.Lock()
+	s.ms = ms
+	s.stat = stat
+	s.mu.Unlock()
+}
+
+func (s *processSnapshot) memStats() runtime.MemStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ms
+}
+
+func (s *processSnapshot) procStat() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stat
+}
+
+// readProcStat returns the fields of /proc/self/stat. The command name, which
+// may contain spaces, is skipped but still counted as field 2.
+func readProcStat() []string {
+	data, err := ioutil.ReadFile("/proc/self/stat")
+	if err != nil {
+		return nil
+	}
+	s := string(data)
+	i := strings.LastIndex(s, ")")
+	if i < 0 {
+		return nil
+	}
+	return append([]string{"", ""}, strings.Fields(s[i+1:])...)
+}
@@ -0,0 +1,136 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package propagation
+
+import (
+	"strings"
+)
+
+// B3 header names, lower cased as in gRPC metadata.
+const (
+	b3Single       = "b3"
+	b3TraceID      = "x-b3-traceid"
+	b3SpanID       = "x-b3-spanid"
+	b3ParentSpanID = "x-b3-parentspanid"
+	b3Sampled      = "x-b3-sampled"
+	b3Flags        = "x-b3-flags"
+)
+
+// validB3TraceID reports whether s is a 64 or 128-bit trace ID.
+func validB3TraceID(s string) bool {
+	return isHex(s, 16) || isHex(s, 32)
+}
+
+// extractB3 returns the trace context in the x-b3-* headers, or nil if
+// there is none. A context with only a sampling decision has no IDs.
+func extractB3(get func(key string) string) *Context {
+	c := &Context{Debug: get(b3Flags) == "1"}
+	switch get(b3Sampled) {
+	case "1", "true":
+		c.Sampled = boolPtr(true)
+	case "0", "false":
+		c.Sampled = boolPtr(false)
+	}
+	traceID := strings.ToLower(get(b3TraceID))
+	spanID := strings.ToLower(get(b3SpanID))
+	if validB3TraceID(traceID) && isHex(spanID, 16) {
+		c.TraceID, c.SpanID = traceID, spanID
+		if parentID := strings.ToLower(get(b3ParentSpanID)); isHex(parentID, 16) {
+			c.ParentID = parentID
+		}
+	} else if c.Sampled == nil && !c.Debug {
+		return nil
+	}
+	return c
+}
+
+// extractB3Single returns the trace context in the b3 header, which is
+// either {TraceId}-{SpanId}[-{SamplingState}[-{ParentSpanId}]] or only a
+// sampling state, or nil if there is none.
+func extractB3Single(get func(key string) string) *Context {
+	v := strings.ToLower(get(b3Single))
+	if v == "" {
+		return nil
+	}
+	parts := strings.Split(v, "-")
+	c := &Context{}
+	sampling := ""
+	switch len(parts) {
+	case 1:
+		sampling = parts[0]
+	case 2, 3, 4:
+		if !validB3TraceID(parts[0]) || !isHex(parts[1], 16) {
+			return nil
+		}
+		c.TraceID, c.SpanID = parts[0], parts[1]
+		if len(parts) > 2 {
+			sampling = parts[2]
+		}
+		if len(parts) == 4 {
+			if !isHex(parts[3], 16) {
+				return nil
+			}
+			c.ParentID = parts[3]
+		}
+	default:
+		return nil
+	}
+	switch sampling {
+	case "":
+	case "1":
+		c.Sampled = boolPtr(true)
+	case "0":
+		c.Sampled = boolPtr(false)
+	case "d":
+		c.Debug = true
+	default:
+		return nil
+	}
+	return c
+}
+
+// injectB3 writes c as x-b3-* headers with set.
+func injectB3(c *Context, set func(key, value string)) {
+	set(b3TraceID, c.TraceID)
+	set(b3SpanID, c.SpanID)
+	if c.ParentID != "" {
+		set(b3ParentSpanID, c.ParentID)
+	}
+	if c.Debug {
+		set(b3Flags, "1")
+	} else if c.Sampled != nil {
+		if *c.Sampled {
+			set(b3Sampled, "1")
+		} else {
+			set(b3Sampled, "0")
+		}
+	}
+}
+
+// injectB3Single writes c as the b3 header with set.
+func injectB3Single(c *Context, set func(key, value string)) {
+	v := c.TraceID + "-" + c.SpanID
+	switch {
+	case c.Debug:
+		v += "-d"
+	case c.Sampled != nil && *c.Sampled:
+		v += "-1"
+	case c.Sampled != nil:
+		v += "-0"
+	}
+	if c.ParentID != "" && (c.Debug || c.Sampled != nil) {
+		v += "-" + c.ParentID
+	}
+	set(b3Single, v)
+}
@@ -0,0 +1,220 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package propagation passes the trace context of a request on to the
+// calls it makes, so that Zipkin can put the spans of all services into a
+// single trace.
+//
+// The trace context is extracted from HTTP headers and gRPC metadata in
+// any of the supported formats: W3C Trace Context (traceparent and
+// tracestate), the B3 single header (b3), B3 multiple headers
+// (x-b3-traceid, ...) and W3C baggage. A request without a trace context
+// starts a new trace. Outgoing calls carry the trace context in the
+// formats of a Propagator.
+//
+// Every request also has a request ID, the x-request-id header Envoy sets.
+// A request without one, such as a request made without a mesh, is given a
+// random UUID. Servers return the request ID in the x-request-id response
+// header, so that callers can quote it when they report a problem.
+package propagation
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+// Context is the trace context of a request.
+type Context struct {
+	// TraceID is 32 or, from older B3 callers, 16 lower case hex digits.
+	TraceID  string
+	SpanID   string
+	ParentID string
+
+	// Sampled is the sampling decision of the trace, or nil if the caller
+	// left it to us.
+	Sampled *bool
+	Debug   bool
+
+	// Generated is set if the request carried no trace context and the
+	// IDs were generated. SpanID then does not belong to a recorded span.
+	Generated bool
+
+	// TraceState is the W3C tracestate header, passed on unchanged.
+	TraceState string
+	Baggage    map[string]string
+
+	// RequestID identifies the request in logs and error reports. It is
+	// passed on unchanged.
+	RequestID string
+
+	// Headers are the headers Envoy uses besides the trace context, such
+	// as x-ot-span-context, passed on unchanged.
+	Headers map[string]string
+}
+
+// RequestIDHeader is the header that carries the request ID.
+const RequestIDHeader = "x-request-id"
+
+// passthroughHeaders are the Headers of a Context.
+var passthroughHeaders = []string{"x-ot-span-context"}
+
+// Child returns the context of a new span whose parent is c. Sampling,
+// tracestate, baggage and headers are inherited.
+func (c *Context) Child() *Context {
+	child := *c
+	child.SpanID = NewSpanID()
+	child.ParentID = c.SpanID
+	if c.Generated {
+		child.ParentID = ""
+	}
+	child.Generated = false
+	return &child
+}
+
+// NewTraceID returns a random 128-bit trace ID.
+func NewTraceID() string {
+	return randomHex(16)
+}
+
+// NewSpanID returns a random 64-bit span ID.
+func NewSpanID() string {
+	return randomHex(8)
+}
+
+// NewRequestID returns a random (version 4) UUID.
+func NewRequestID() string {
+	b := randomBytes(16)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func randomHex(n int) string {
+	return hex.EncodeToString(randomBytes(n))
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// Extract returns the trace context found with get, which looks up a
+// header by its lower case name. If there is no trace context a new trace
+// is started, obeying any sampling decision that was passed on, and if
+// there is no request ID a new one is generated.
+//
+// When a request carries several formats, b3 wins over the x-b3-* headers,
+// which win over traceparent: B3 is what Envoy uses, and it can leave the
+// sampling decision to us. The tracestate is kept if traceparent is of the
+// same trace.
+func Extract(get func(key string) string) *Context {
+	c := extractB3Single(get)
+	if c == nil {
+		c = extractB3(get)
+	}
+	if tp := extractTraceParent(get); tp != nil {
+		switch {
+		case c == nil:
+			c = tp
+		case c.TraceID == "":
+			// Only a B3 sampling decision was passed on.
+			tp.Sampled, tp.Debug = c.Sampled, c.Debug
+			c = tp
+		case padTraceID(c.TraceID) == tp.TraceID:
+			c.TraceState = tp.TraceState
+		}
+	}
+	if c == nil {
+		c = &Context{}
+	}
+	if c.TraceID == "" {
+		c.TraceID = NewTraceID()
+		c.SpanID = NewSpanID()
+		c.ParentID = ""
+		c.Generated = true
+	}
+	c.RequestID = get(RequestIDHeader)
+	if c.RequestID == "" {
+		c.RequestID = NewRequestID()
+	}
+	c.Baggage = extractBaggage(get)
+	for _, k := range passthroughHeaders {
+		if v := get(k); v != "" {
+			if c.Headers == nil {
+				c.Headers = make(map[string]string)
+			}
+			c.Headers[k] = v
+		}
+	}
+	return c
+}
+
+// ExtractHTTP returns the trace context of an HTTP request.
+func ExtractHTTP(h http.Header) *Context {
+	return Extract(h.Get)
+}
+
+// ExtractMetadata returns the trace context of a gRPC call.
+func ExtractMetadata(md metadata.MD) *Context {
+	return Extract(func(key string) string {
+		if v := md[key]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	})
+}
+
+type contextKey struct{}
+
+// NewContext returns a context that carries c.
+func NewContext(ctx context.Context, c *Context) context.Context {
+	return context.WithValue(ctx, contextKey{}, c)
+}
+
+// FromContext returns the trace context in ctx, or nil.
+func FromContext(ctx context.Context) *Context {
+	c, _ := ctx.Value(contextKey{}).(*Context)
+	return c
+}
+
+// isHex reports whether s is n lower case hex digits that are not all
+// zero, which makes it a valid trace or span ID.
+func isHex(s string, n int) bool {
+	if len(s) != n || strings.Trim(s, "0") == "" {
+		return false
+	}
+	for _, r := range s {
+		if !('0' <= r && r <= '9' || 'a' <= r && r <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// padTraceID returns a trace ID as 128 bits.
+func padTraceID(id string) string {
+	return strings.Repeat("0", 32-len(id)) + id
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
@@ -0,0 +1,158 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package propagation
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/kelseyhightower/ping/middleware"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Format is a way of passing the trace context on.
+type Format string
+
+// The supported formats, named as in the OTEL_PROPAGATORS variable of
+// OpenTelemetry.
+const (
+	B3Multi      Format = "b3multi"
+	B3Single     Format = "b3"
+	TraceContext Format = "tracecontext"
+	Baggage      Format = "baggage"
+)
+
+// DefaultFormats are understood by Envoy and by W3C compliant tracers.
+const DefaultFormats = "b3multi,tracecontext,baggage"
+
+// headerKeys are the headers written by any format. They are removed from
+// outgoing calls before the trace context is injected.
+var headerKeys = []string{
+	b3Single, b3TraceID, b3SpanID, b3ParentSpanID, b3Sampled, b3Flags,
+	traceParent, traceState, baggage,
+}
+
+// Propagator injects the trace context into outgoing calls in a set of
+// formats. The request ID and headers such as x-ot-span-context are always
+// passed on.
+type Propagator struct {
+	formats []Format
+}
+
+// NewPropagator returns a propagator for formats, a comma separated list
+// such as "b3multi,tracecontext".
+func NewPropagator(formats string) (*Propagator, error) {
+	p := &Propagator{}
+	for _, f := range strings.Split(formats, ",") {
+		switch format := Format(strings.TrimSpace(f)); format {
+		case B3Multi, B3Single, TraceContext, Baggage:
+			p.formats = append(p.formats, format)
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown propagation format %q; use %s, %s, %s or %s", f, B3Multi, B3Single, TraceContext, Baggage)
+		}
+	}
+	return p, nil
+}
+
+// Inject writes c with set.
+func (p *Propagator) Inject(c *Context, set func(key, value string)) {
+	for _, format := range p.formats {
+		switch format {
+		case B3Multi:
+			injectB3(c, set)
+		case B3Single:
+			injectB3Single(c, set)
+		case TraceContext:
+			injectTraceParent(c, set)
+		case Baggage:
+			injectBaggage(c, set)
+		}
+	}
+	if c.RequestID != "" {
+		set(RequestIDHeader, c.RequestID)
+	}
+	for k, v := range c.Headers {
+		set(k, v)
+	}
+}
+
+// InjectHTTP writes c to the headers of an HTTP request.
+func (p *Propagator) InjectHTTP(c *Context, h http.Header) {
+	p.Inject(c, h.Set)
+}
+
+// InjectMetadata writes c to gRPC metadata, replacing any trace context
+// already in md.
+func (p *Propagator) InjectMetadata(c *Context, md metadata.MD) {
+	for _, k := range headerKeys {
+		delete(md, k)
+	}
+	p.Inject(c, func(key, value string) { md[key] = []string{value} })
+}
+
+// UnaryClientInterceptor returns an interceptor that injects the trace
+// context of the call's context, if any, into its metadata. It should be
+// the last client interceptor, after any that start spans.
+func (p *Propagator) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if c := FromContext(ctx); c != nil {
+			md, _ := metadata.FromOutgoingContext(ctx)
+			md = md.Copy()
+			p.InjectMetadata(c, md)
+			ctx = metadata.NewOutgoingContext(ctx, md)
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// UnaryServerInterceptor returns an interceptor that puts the trace
+// context of every unary call in its context and returns the request ID in
+// the response header, which is sent even if the call fails.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		c := ExtractMetadata(md)
+		grpc.SetHeader(ctx, metadata.Pairs(RequestIDHeader, c.RequestID))
+		return handler(NewContext(ctx, c), req)
+	}
+}
+
+// StreamServerInterceptor returns an interceptor that puts the trace
+// context of every streaming call in its context and returns the request
+// ID in the response header.
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		md, _ := metadata.FromIncomingContext(ss.Context())
+		c := ExtractMetadata(md)
+		ss.SetHeader(metadata.Pairs(RequestIDHeader, c.RequestID))
+		ctx := NewContext(ss.Context(), c)
+		return handler(srv, middleware.WrapServerStream(ss, ctx))
+	}
+}
+
+// Handler returns h wrapped so that the trace context of every request is
+// in the request's context and the request ID is in the X-Request-Id
+// response header.
+func Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := ExtractHTTP(r.Header)
+		w.Header().Set(RequestIDHeader, c.RequestID)
+		h.ServeHTTP(w, r.WithContext(NewContext(r.Context(), c)))
+	})
+}
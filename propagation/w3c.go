@@ -0,0 +1,118 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package propagation
+
+import (
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// W3C header names.
+const (
+	traceParent = "traceparent"
+	traceState  = "tracestate"
+	baggage     = "baggage"
+)
+
+// extractTraceParent returns the trace context in the traceparent and
+// tracestate headers, or nil if there is none. A traceparent without the
+// sampled flag leaves the sampling decision to us.
+func extractTraceParent(get func(key string) string) *Context {
+	parts := strings.Split(strings.TrimSpace(get(traceParent)), "-")
+	if len(parts) < 4 {
+		return nil
+	}
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	// Later versions may append fields; version 00 has exactly four.
+	if len(version) != 2 || version == "ff" || (version == "00" && len(parts) != 4) {
+		return nil
+	}
+	if !isHex(traceID, 32) || !isHex(spanID, 16) || len(flags) != 2 {
+		return nil
+	}
+	f, err := strconv.ParseUint(flags, 16, 8)
+	if err != nil {
+		return nil
+	}
+	c := &Context{TraceID: traceID, SpanID: spanID, TraceState: get(traceState)}
+	if f&1 == 1 {
+		c.Sampled = boolPtr(true)
+	}
+	return c
+}
+
+// injectTraceParent writes c as the traceparent and tracestate headers
+// with set. 64-bit trace IDs are padded to 128 bits.
+func injectTraceParent(c *Context, set func(key, value string)) {
+	flags := "00"
+	if c.Debug || (c.Sampled != nil && *c.Sampled) {
+		flags = "01"
+	}
+	set(traceParent, "00-"+padTraceID(c.TraceID)+"-"+c.SpanID+"-"+flags)
+	if c.TraceState != "" {
+		set(traceState, c.TraceState)
+	}
+}
+
+// extractBaggage returns the entries of the baggage header, or nil if
+// there are none. Entry properties are dropped.
+func extractBaggage(get func(key string) string) map[string]string {
+	v := get(baggage)
+	if v == "" {
+		return nil
+	}
+	var b map[string]string
+	for _, member := range strings.Split(v, ",") {
+		if i := strings.Index(member, ";"); i >= 0 {
+			member = member[:i]
+		}
+		kv := strings.SplitN(member, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, err := url.PathUnescape(strings.TrimSpace(kv[0]))
+		if err != nil || key == "" {
+			continue
+		}
+		value, err := url.PathUnescape(strings.TrimSpace(kv[1]))
+		if err != nil {
+			continue
+		}
+		if b == nil {
+			b = make(map[string]string)
+		}
+		b[key] = value
+	}
+	return b
+}
+
+// injectBaggage writes the baggage of c, if any, as the baggage header
+// with set.
+func injectBaggage(c *Context, set func(key, value string)) {
+	if len(c.Baggage) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(c.Baggage))
+	for k := range c.Baggage {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	members := make([]string, len(keys))
+	for i, k := range keys {
+		members[i] = url.PathEscape(k) + "=" + url.PathEscape(c.Baggage[k])
+	}
+	set(baggage, strings.Join(members, ","))
+}
@@ -0,0 +1,314 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ratelimit
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kelseyhightower/ping/auth"
+	"github.com/kelseyhightower/ping/authz"
+	"github.com/kelseyhightower/ping/internal/yaml"
+	"github.com/kelseyhightower/ping/middleware"
+
+	"github.com/golang/protobuf/ptypes"
+	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// GatewayClientKey is the metadata key in which the HTTP gateway passes the
+// address of its client, see GatewayClient.
+const GatewayClientKey = "x-ping-gateway-client"
+
+// gatewaySecret proves that a GatewayClientKey value was set by the HTTP
+// gateway in this process. Callers cannot learn it, so they cannot pose as
+// the gateway, whatever address they call from.
+var gatewaySecret = newGatewaySecret()
+
+func newGatewaySecret() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("ratelimit: reading random bytes: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// GatewayClient returns the GatewayClientKey value with which the HTTP
+// gateway in this process passes on the address of its client. Calls are
+// only keyed by that address if the value carries the secret of this
+// process; forged values are ignored.
+func GatewayClient(addr string) string {
+	return gatewaySecret + " " + addr
+}
+
+// sweepInterval is how often buckets of idle callers are dropped.
+const sweepInterval = time.Minute
+
+// Config is the contents of a rate limits file.
+type Config struct {
+	Limits []Limit `json:"limits"`
+}
+
+// Limit gives every caller of the matching methods its own token bucket.
+type Limit struct {
+	// Methods are full gRPC methods, /package.Service/* or *.
+	Methods []string `json:"methods"`
+	// Key identifies callers: peer, identity or header:<name>.
+	Key   string  `json:"key"`
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// Limiter applies per-caller rate limits to gRPC calls. The first limit
+// that matches the method of a call applies; calls that no limit matches
+// are not limited.
+type Limiter struct {
+	limits []*limit
+}
+
+type limit struct {
+	Limit
+	number int
+	key    func(ctx context.Context) string
+
+	mu        sync.Mutex
+	buckets   map[string]*Bucket
+	lastSweep time.Time
+}
+
+// Load reads a rate limits file:
+//
+//	limits:
+//	- methods: ["/ping.Ping/Ping"]
+//	  key: header:x-forwarded-user-agent
+//	  rate: 5
+//	  burst: 10
+//	- methods: ["*"]
+//	  key: peer
+//	  rate: 100
+//	  burst: 200
+func Load(path string) (*Limiter, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	l, err := New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return l, nil
+}
+
+// New returns a Limiter for cfg.
+func New(cfg Config) (*Limiter, error) {
+	l := &Limiter{}
+	for i, c := range cfg.Limits {
+		lim := &limit{Limit: c, number: i + 1, buckets: make(map[string]*Bucket)}
+		if len(c.Methods) == 0 {
+			return nil, fmt.Errorf("limit %d matches no methods", lim.number)
+		}
+		if c.Rate <= 0 {
+			return nil, fmt.Errorf("limit %d needs a positive rate", lim.number)
+		}
+		switch {
+		case c.Key == "peer":
+			lim.key = peerKey
+		case c.Key == "identity":
+			lim.key = identityKey
+		case strings.HasPrefix(c.Key, "header:") && len(c.Key) > len("header:"):
+			name := strings.ToLower(strings.TrimPrefix(c.Key, "header:"))
+			lim.key = func(ctx context.Context) string {
+				if v := headerKey(ctx, name); v != "" {
+					return v
+				}
+				return "peer:" + peerKey(ctx)
+			}
+		default:
+			return nil, fmt.Errorf("limit %d: key must be peer, identity or header:<name>, got %q", lim.number, c.Key)
+		}
+		l.limits = append(l.limits, lim)
+	}
+	return l, nil
+}
+
+// peerKey returns the IP address of the caller. Calls from the HTTP
+// gateway are keyed by the address of its client instead. Headers such as
+// x-forwarded-for are never trusted: behind a sidecar every caller arrives
+// over the loopback interface and could pick its own bucket.
+func peerKey(ctx context.Context) string {
+	if addr, ok := gatewayClient(ctx); ok {
+		return addr
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		host = p.Addr.String()
+	}
+	return host
+}
+
+// gatewayClient returns the address of the client of the HTTP gateway, if
+// the call carries a GatewayClientKey value set by the gateway.
+func gatewayClient(ctx context.Context) (string, bool) {
+	parts := strings.SplitN(headerKey(ctx, GatewayClientKey), " ", 2)
+	if len(parts) != 2 || subtle.ConstantTimeCompare([]byte(parts[0]), []byte(gatewaySecret)) != 1 {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// identityKey returns the caller authenticated by a bearer token or a
+// client certificate. Anonymous callers are keyed by their address.
+func identityKey(ctx context.Context) string {
+	if p, ok := auth.FromContext(ctx); ok {
+		return p.String()
+	}
+	if id := authz.PeerIdentity(ctx); id != nil {
+		return "cert:" + id.CommonName
+	}
+	return "peer:" + peerKey(ctx)
+}
+
+// headerKey returns the first value of a metadata key, or "".
+func headerKey(ctx context.Context, name string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md[name]) == 0 {
+		return ""
+	}
+	return md[name][0]
+}
+
+// bucket returns the bucket of a caller, dropping the buckets of callers
+// that have been idle long enough for them to be full again.
+func (l *limit) bucket(key string) *Bucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		for k, b := range l.buckets {
+			if b.full(now) {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = NewBucket(l.Rate, l.Burst)
+		l.buckets[key] = b
+	}
+	return b
+}
+
+// Allow returns a RESOURCE_EXHAUSTED error if the caller in ctx has
+// exceeded its limit for method.
+func (l *Limiter) Allow(ctx context.Context, method string) error {
+	for _, lim := range l.limits {
+		matched := false
+		for _, m := range lim.Methods {
+			if middleware.MatchMethod(m, method) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		key := lim.key(ctx)
+		if ok, wait := lim.bucket(key).Take(); !ok {
+			return Exhausted(wait, "%s: rate limit of %g/s exceeded for %s %q by limit %d",
+				method, lim.Rate, lim.Key, key, lim.number)
+		}
+		return nil
+	}
+	return nil
+}
+
+// Exhausted returns a RESOURCE_EXHAUSTED error with a google.rpc.RetryInfo
+// detail that tells the caller to retry after wait. The retry delay is
+// also appended to the message.
+func Exhausted(wait time.Duration, format string, args ...interface{}) error {
+	wait = time.Duration(math.Ceil(float64(wait)/float64(time.Millisecond))) * time.Millisecond
+	msg := fmt.Sprintf(format, args...) + fmt.Sprintf(", retry in %s", wait)
+	st := status.New(codes.ResourceExhausted, msg).Proto()
+	detail, err := ptypes.MarshalAny(&errdetails.RetryInfo{RetryDelay: ptypes.DurationProto(wait)})
+	if err == nil {
+		st.Details = append(st.Details, detail)
+	}
+	return status.ErrorProto(st)
+}
+
+// RetryDelay returns the delay of the google.rpc.RetryInfo detail of err.
+func RetryDelay(err error) (time.Duration, bool) {
+	s, ok := status.FromError(err)
+	if !ok {
+		return 0, false
+	}
+	for _, detail := range s.Proto().GetDetails() {
+		var info errdetails.RetryInfo
+		if ptypes.UnmarshalAny(detail, &info) != nil {
+			continue
+		}
+		d, err := ptypes.Duration(info.GetRetryDelay())
+		if err != nil {
+			return 0, false
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// UnaryServerInterceptor returns an interceptor that rate limits unary
+// calls.
+func (l *Limiter) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := l.Allow(ctx, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor returns an interceptor that rate limits
+// streaming calls when they start.
+func (l *Limiter) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := l.Allow(ss.Context(), info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
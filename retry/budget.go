@@ -0,0 +1,82 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retry
+
+import (
+	"sync"
+	"time"
+)
+
+// budgetWindow is the number of seconds over which the retry budget counts
+// calls and retries.
+const budgetWindow = 10
+
+// budget allows retries while they are fewer than ratio times the calls
+// plus minPerSecond per second, over the last budgetWindow seconds.
+type budget struct {
+	ratio        float64
+	minPerSecond float64
+
+	mu    sync.Mutex
+	slots [budgetWindow]budgetSlot
+}
+
+// budgetSlot counts the calls and retries of one second.
+type budgetSlot struct {
+	second  int64
+	calls   int
+	retries int
+}
+
+func newBudget(ratio, minPerSecond float64) *budget {
+	return &budget{ratio: ratio, minPerSecond: minPerSecond}
+}
+
+// slot returns the slot of now, resetting it if it belongs to an earlier
+// second. It must be called with b.mu held.
+func (b *budget) slot(now time.Time) *budgetSlot {
+	second := now.Unix()
+	s := &b.slots[second%budgetWindow]
+	if s.second != second {
+		*s = budgetSlot{second: second}
+	}
+	return s
+}
+
+// call counts a call.
+func (b *budget) call(now time.Time) {
+	b.mu.Lock()
+	b.slot(now).calls++
+	b.mu.Unlock()
+}
+
+// withdraw counts a retry if the budget allows it.
+func (b *budget) withdraw(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	current := b.slot(now)
+	calls, retries := 0, 0
+	for _, s := range b.slots {
+		if now.Unix()-s.second < budgetWindow {
+			calls += s.calls
+			retries += s.retries
+		}
+	}
+	if float64(retries) >= b.ratio*float64(calls)+b.minPerSecond*budgetWindow {
+		return false
+	}
+	current.retries++
+	return true
+}
@@ -0,0 +1,254 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package retry retries the calls of the frontend to its downstream
+// services. A policy per downstream sets the maximum number of attempts,
+// the exponential backoff between them and the status codes worth
+// retrying. Instead of waiting for a failure, a policy may also hedge: send
+// another attempt when the previous ones are slower than a threshold and
+// take the first success.
+//
+// Retries and hedged requests are limited by a retry budget, so that a
+// struggling downstream does not receive a retry storm on top of its
+// regular load.
+package retry
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/ping/internal/yaml"
+	"github.com/kelseyhightower/ping/metrics"
+
+	"google.golang.org/grpc/codes"
+)
+
+// Defaults of a policy.
+const (
+	DefaultInitialBackoff      = 50 * time.Millisecond
+	DefaultMaxBackoff          = time.Second
+	DefaultBackoffMultiplier   = 2
+	DefaultBudgetRatio         = 0.2
+	DefaultMinRetriesPerSecond = 10
+)
+
+// codeNames are the status codes by the names used in gRPC service
+// configs.
+var codeNames = map[string]codes.Code{
+	"CANCELLED":           codes.Canceled,
+	"UNKNOWN":             codes.Unknown,
+	"INVALID_ARGUMENT":    codes.InvalidArgument,
+	"DEADLINE_EXCEEDED":   codes.DeadlineExceeded,
+	"NOT_FOUND":           codes.NotFound,
+	"ALREADY_EXISTS":      codes.AlreadyExists,
+	"PERMISSION_DENIED":   codes.PermissionDenied,
+	"RESOURCE_EXHAUSTED":  codes.ResourceExhausted,
+	"FAILED_PRECONDITION": codes.FailedPrecondition,
+	"ABORTED":             codes.Aborted,
+	"OUT_OF_RANGE":        codes.OutOfRange,
+	"UNIMPLEMENTED":       codes.Unimplemented,
+	"INTERNAL":            codes.Internal,
+	"UNAVAILABLE":         codes.Unavailable,
+	"DATA_LOSS":           codes.DataLoss,
+	"UNAUTHENTICATED":     codes.Unauthenticated,
+}
+
+// Config is the contents of a retry policies file.
+type Config struct {
+	// Policies are keyed by downstream, such as bar or foo.
+	Policies map[string]Policy `json:"policies"`
+}
+
+// Policy is the retry policy of a downstream. Durations are strings such
+// as 100ms.
+type Policy struct {
+	// MaxAttempts is the number of attempts of a call, including the
+	// first one. Calls are not retried if it is 1 or less.
+	MaxAttempts       int     `json:"maxAttempts"`
+	InitialBackoff    string  `json:"initialBackoff"`
+	MaxBackoff        string  `json:"maxBackoff"`
+	BackoffMultiplier float64 `json:"backoffMultiplier"`
+	// RetryableStatusCodes are the codes, such as UNAVAILABLE, of the
+	// failed attempts that are retried.
+	RetryableStatusCodes []string `json:"retryableStatusCodes"`
+	// PerTryTimeout is the deadline of each attempt; none if empty.
+	PerTryTimeout string `json:"perTryTimeout"`
+	// HedgingDelay enables hedging: another attempt is sent whenever this
+	// long passes without a response. It needs a MaxAttempts of at least 2.
+	HedgingDelay string  `json:"hedgingDelay"`
+	Budget       *Budget `json:"budget"`
+}
+
+// Budget limits retries and hedged requests to a ratio of the calls, plus
+// a minimum number per second, over the last 10 seconds.
+type Budget struct {
+	Ratio               float64 `json:"ratio"`
+	MinRetriesPerSecond float64 `json:"minRetriesPerSecond"`
+}
+
+// policy is a validated Policy.
+type policy struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	multiplier     float64
+	retryable      map[codes.Code]bool
+	perTryTimeout  time.Duration
+	hedgingDelay   time.Duration
+	budgetRatio    float64
+	budgetMin      float64
+}
+
+// Policies are the retry policies of all downstreams.
+type Policies struct {
+	policies map[string]*policy
+}
+
+// Load reads a retry policies file:
+//
+//	policies:
+//	  bar:
+//	    maxAttempts: 3
+//	    initialBackoff: 50ms
+//	    maxBackoff: 1s
+//	    backoffMultiplier: 2
+//	    retryableStatusCodes: [UNAVAILABLE, RESOURCE_EXHAUSTED]
+//	    perTryTimeout: 2s
+//	  foo:
+//	    maxAttempts: 2
+//	    hedgingDelay: 100ms
+//	    retryableStatusCodes: [UNAVAILABLE]
+//	    budget:
+//	      ratio: 0.1
+//	      minRetriesPerSecond: 5
+func Load(path string) (*Policies, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	p, err := New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return p, nil
+}
+
+// New returns the Policies of cfg.
+func New(cfg Config) (*Policies, error) {
+	p := &Policies{policies: make(map[string]*policy)}
+	for name, c := range cfg.Policies {
+		pol, err := newPolicy(c)
+		if err != nil {
+			return nil, fmt.Errorf("policy %s: %v", name, err)
+		}
+		p.policies[name] = pol
+	}
+	return p, nil
+}
+
+func newPolicy(c Policy) (*policy, error) {
+	p := &policy{
+		maxAttempts:    c.MaxAttempts,
+		initialBackoff: DefaultInitialBackoff,
+		maxBackoff:     DefaultMaxBackoff,
+		multiplier:     c.BackoffMultiplier,
+		retryable:      map[codes.Code]bool{codes.Unavailable: true},
+		budgetRatio:    DefaultBudgetRatio,
+		budgetMin:      DefaultMinRetriesPerSecond,
+	}
+	if p.maxAttempts < 1 {
+		p.maxAttempts = 1
+	}
+	durations := []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"initialBackoff", c.InitialBackoff, &p.initialBackoff},
+		{"maxBackoff", c.MaxBackoff, &p.maxBackoff},
+		{"perTryTimeout", c.PerTryTimeout, &p.perTryTimeout},
+		{"hedgingDelay", c.HedgingDelay, &p.hedgingDelay},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", d.name, err)
+		}
+		if v <= 0 {
+			return nil, fmt.Errorf("%s must be positive, got %s", d.name, d.value)
+		}
+		*d.dst = v
+	}
+	if p.hedgingDelay > 0 && p.maxAttempts < 2 {
+		return nil, fmt.Errorf("hedgingDelay needs a maxAttempts of at least 2, got %d", c.MaxAttempts)
+	}
+	if p.maxBackoff < p.initialBackoff {
+		return nil, fmt.Errorf("maxBackoff %s is less than initialBackoff %s", p.maxBackoff, p.initialBackoff)
+	}
+	switch {
+	case p.multiplier == 0:
+		p.multiplier = DefaultBackoffMultiplier
+	case p.multiplier < 1:
+		return nil, fmt.Errorf("backoffMultiplier must be at least 1, got %g", p.multiplier)
+	}
+	if c.RetryableStatusCodes != nil {
+		p.retryable = make(map[codes.Code]bool)
+		for _, name := range c.RetryableStatusCodes {
+			code, ok := codeNames[strings.ToUpper(name)]
+			if !ok {
+				return nil, fmt.Errorf("unknown status code %q in retryableStatusCodes; use one of %s", name, strings.Join(sortedCodeNames(), ", "))
+			}
+			p.retryable[code] = true
+		}
+	}
+	if b := c.Budget; b != nil {
+		if b.Ratio < 0 || b.MinRetriesPerSecond < 0 {
+			return nil, fmt.Errorf("the budget ratio and minRetriesPerSecond must not be negative")
+		}
+		p.budgetRatio, p.budgetMin = b.Ratio, b.MinRetriesPerSecond
+	}
+	return p, nil
+}
+
+func sortedCodeNames() []string {
+	names := make([]string, 0, len(codeNames))
+	for name := range codeNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Retrier returns the retrier of calls to downstream. Downstreams without
+// a policy make a single attempt. m, if not nil, records the attempts.
+// A nil Policies has no policies.
+func (p *Policies) Retrier(downstream string, m *metrics.ClientMetrics) *Retrier {
+	var pol *policy
+	if p != nil {
+		pol = p.policies[downstream]
+	}
+	if pol == nil {
+		pol, _ = newPolicy(Policy{})
+	}
+	return newRetrier(downstream, pol, m)
+}
@@ -0,0 +1,273 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retry
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/kelseyhightower/ping/breaker"
+	"github.com/kelseyhightower/ping/internal/random"
+	"github.com/kelseyhightower/ping/logging"
+	"github.com/kelseyhightower/ping/metrics"
+	"github.com/kelseyhightower/ping/ratelimit"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Kinds of additional attempts, as recorded in metrics.
+const (
+	KindRetry = "retry"
+	KindHedge = "hedge"
+)
+
+// Call makes one attempt of a call with ctx and returns its result.
+type Call func(ctx context.Context) (interface{}, error)
+
+// Retrier makes the calls to a downstream with its retry policy.
+type Retrier struct {
+	downstream string
+	policy     *policy
+	budget     *budget
+	metrics    *metrics.ClientMetrics
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func newRetrier(downstream string, p *policy, m *metrics.ClientMetrics) *Retrier {
+	return &Retrier{
+		downstream: downstream,
+		policy:     p,
+		budget:     newBudget(p.budgetRatio, p.budgetMin),
+		metrics:    m,
+		rnd:        random.New(),
+	}
+}
+
+// Do makes call, retrying or hedging it as the policy says, and returns
+// the result of the successful attempt, or of the last failed one, and the
+// number of attempts made.
+//
+// Hedged attempts run concurrently, so call must not share its results
+// with other attempts except by returning them. The attempts that lose are
+// canceled.
+func (r *Retrier) Do(ctx context.Context, call Call) (interface{}, int, error) {
+	r.budget.call(time.Now())
+	var (
+		v        interface{}
+		attempts int
+		err      error
+	)
+	if r.policy.hedgingDelay > 0 {
+		v, attempts, err = r.hedge(ctx, call)
+	} else {
+		v, attempts, err = r.retry(ctx, call)
+	}
+	if r.metrics != nil {
+		r.metrics.RecordAttempts(r.downstream, attempts)
+	}
+	return v, attempts, err
+}
+
+// retry makes attempts one after the other until one succeeds or fails
+// with a code that is not retryable, or is rejected by a circuit breaker.
+func (r *Retrier) retry(ctx context.Context, call Call) (interface{}, int, error) {
+	for attempt := 1; ; attempt++ {
+		v, err := r.attempt(ctx, call)
+		if err == nil || attempt >= r.policy.maxAttempts || !r.retryable(err) || ctx.Err() != nil {
+			return v, attempt, err
+		}
+
+		delay := r.backoff(attempt)
+		if wait, ok := ratelimit.RetryDelay(err); ok {
+			// The downstream said when to retry; give up if that is
+			// later than we would ever wait.
+			if wait > r.policy.maxBackoff {
+				return v, attempt, err
+			}
+			delay = wait
+		}
+		if !r.withdraw(ctx, KindRetry) {
+			return v, attempt, err
+		}
+		logging.FromContext(ctx).With("downstream", r.downstream).Debugf("Retrying attempt %d in %s: %v", attempt, delay, err)
+
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return v, attempt, err
+		}
+	}
+}
+
+type result struct {
+	v   interface{}
+	err error
+}
+
+// hedge starts another attempt whenever the hedging delay passes without a
+// response, or right away when an attempt fails with a retryable code, and
+// returns the first success. Like retry, it waits for the delay a
+// downstream asks for before the next attempt, and stops sending attempts
+// if that is longer than maxBackoff.
+func (r *Retrier) hedge(ctx context.Context, call Call) (interface{}, int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result, r.policy.maxAttempts)
+	start := func() {
+		go func() {
+			v, err := r.attempt(ctx, call)
+			results <- result{v, err}
+		}()
+	}
+
+	start()
+	attempts, pending := 1, 1
+	maxAttempts := r.policy.maxAttempts
+	timer := time.NewTimer(r.policy.hedgingDelay)
+	defer timer.Stop()
+	reset := func(d time.Duration) {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(d)
+	}
+	// next starts another attempt if the policy and the budget allow it.
+	next := func(kind string) bool {
+		if attempts >= maxAttempts || !r.withdraw(ctx, kind) {
+			return false
+		}
+		start()
+		attempts++
+		pending++
+		reset(r.policy.hedgingDelay)
+		return true
+	}
+
+	var (
+		last result
+		// waiting is set while the next attempt waits for the delay a
+		// downstream asked for; the timer starts it as a retry.
+		waiting bool
+	)
+	for pending > 0 || waiting {
+		select {
+		case res := <-results:
+			pending--
+			if breaker.IsRejected(res.err) {
+				// The breakers reject the call: the pending attempts
+				// may still succeed, but new ones would be rejected
+				// too.
+				last = res
+				maxAttempts = attempts
+				continue
+			}
+			if res.err == nil || !r.retryable(res.err) {
+				return res.v, attempts, res.err
+			}
+			last = res
+			if waiting || attempts >= maxAttempts {
+				continue
+			}
+			wait, ok := ratelimit.RetryDelay(res.err)
+			switch {
+			case !ok:
+				next(KindRetry)
+			case wait > r.policy.maxBackoff:
+				// The downstream asks to wait longer than we would
+				// ever wait: only the pending attempts may succeed.
+				maxAttempts = attempts
+			default:
+				logging.FromContext(ctx).With("downstream", r.downstream).Debugf("Retrying attempt %d in %s: %v", attempts, wait, res.err)
+				waiting = true
+				reset(wait)
+			}
+		case <-timer.C:
+			if waiting {
+				waiting = false
+				next(KindRetry)
+			} else if next(KindHedge) {
+				logging.FromContext(ctx).With("downstream", r.downstream).Debugf("Sent hedged attempt %d after %s without a response", attempts, r.policy.hedgingDelay)
+			}
+		case <-ctx.Done():
+			return nil, attempts, contextError(ctx.Err())
+		}
+	}
+	return last.v, attempts, last.err
+}
+
+// contextError returns the status error of a done context.
+func contextError(err error) error {
+	if err == context.DeadlineExceeded {
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	return status.Error(codes.Canceled, err.Error())
+}
+
+// attempt makes one attempt with the per-try timeout of the policy.
+func (r *Retrier) attempt(ctx context.Context, call Call) (interface{}, error) {
+	if r.policy.perTryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.policy.perTryTimeout)
+		defer cancel()
+	}
+	return call(ctx)
+}
+
+// retryable reports whether a failed attempt may be retried. The calls
+// rejected by a circuit breaker are not, even though they fail with
+// UNAVAILABLE: another attempt would be rejected too.
+func (r *Retrier) retryable(err error) bool {
+	return r.policy.retryable[grpc.Code(err)] && !breaker.IsRejected(err)
+}
+
+// withdraw takes an attempt of kind from the retry budget and records it.
+func (r *Retrier) withdraw(ctx context.Context, kind string) bool {
+	if !r.budget.withdraw(time.Now()) {
+		logging.FromContext(ctx).With("downstream", r.downstream).Debugf("Not sending a %s: the retry budget is exhausted", kind)
+		if r.metrics != nil {
+			r.metrics.RecordThrottled(r.downstream)
+		}
+		return false
+	}
+	if r.metrics != nil {
+		r.metrics.RecordRetry(r.downstream, kind)
+	}
+	return true
+}
+
+// backoff returns the delay before retrying after attempt: a random
+// duration up to initialBackoff * multiplier^(attempt-1), capped at
+// maxBackoff ("full jitter").
+func (r *Retrier) backoff(attempt int) time.Duration {
+	max := float64(r.policy.initialBackoff) * math.Pow(r.policy.multiplier, float64(attempt-1))
+	if max > float64(r.policy.maxBackoff) {
+		max = float64(r.policy.maxBackoff)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return time.Duration(r.rnd.Float64() * max)
+}
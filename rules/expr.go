@@ -0,0 +1,539 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// kind is the type of an expression.
+type kind int
+
+const (
+	kindString kind = iota
+	kindInt
+	kindBool
+	kindMap
+)
+
+func (k kind) String() string {
+	switch k {
+	case kindString:
+		return "string"
+	case kindInt:
+		return "int"
+	case kindBool:
+		return "bool"
+	}
+	return "map"
+}
+
+// attributeKinds lists the attributes that selectors may refer to.
+var attributeKinds = map[string]kind{
+	"source.ip":            kindString,
+	"source.user":          kindString,
+	"source.labels":        kindMap,
+	"request.method":       kindString,
+	"request.headers":      kindMap,
+	"request.time.hour":    kindInt,
+	"request.time.minute":  kindInt,
+	"request.time.weekday": kindString,
+}
+
+// value is the result of evaluating an expression. Only the field of the
+// expression's kind is set.
+type value struct {
+	s string
+	i int64
+	b bool
+}
+
+// expr is a type checked selector expression.
+type expr interface {
+	kind() kind
+	eval(a *Attributes) value
+}
+
+type literal struct {
+	k kind
+	v value
+}
+
+func (l *literal) kind() kind               { return l.k }
+func (l *literal) eval(a *Attributes) value { return l.v }
+
+type attribute struct {
+	name string
+	k    kind
+}
+
+func (r *attribute) kind() kind { return r.k }
+
+func (r *attribute) eval(a *Attributes) value {
+	switch r.name {
+	case "source.ip":
+		return value{s: a.SourceIP}
+	case "source.user":
+		return value{s: a.SourceUser}
+	case "request.method":
+		return value{s: a.Method}
+	case "request.time.hour":
+		return value{i: int64(a.Time.Hour())}
+	case "request.time.minute":
+		return value{i: int64(a.Time.Minute())}
+	case "request.time.weekday":
+		return value{s: a.Time.Weekday().String()}
+	}
+	return value{}
+}
+
+// index looks up a key in a map attribute. Missing keys are empty strings.
+type index struct {
+	name string
+	key  string
+}
+
+func (x *index) kind() kind { return kindString }
+
+func (x *index) eval(a *Attributes) value {
+	switch x.name {
+	case "source.labels":
+		return value{s: a.SourceLabels[x.key]}
+	case "request.headers":
+		return value{s: a.Headers[x.key]}
+	}
+	return value{}
+}
+
+type not struct{ x expr }
+
+func (n *not) kind() kind               { return kindBool }
+func (n *not) eval(a *Attributes) value { return value{b: !n.x.eval(a).b} }
+
+type logical struct {
+	op   string
+	x, y expr
+}
+
+func (l *logical) kind() kind { return kindBool }
+
+func (l *logical) eval(a *Attributes) value {
+	x := l.x.eval(a).b
+	if l.op == "&&" {
+		return value{b: x && l.y.eval(a).b}
+	}
+	return value{b: x || l.y.eval(a).b}
+}
+
+type comparison struct {
+	op   string
+	x, y expr
+}
+
+func (c *comparison) kind() kind { return kindBool }
+
+func (c *comparison) eval(a *Attributes) value {
+	x, y := c.x.eval(a), c.y.eval(a)
+	var cmp int
+	switch c.x.kind() {
+	case kindString:
+		cmp = strings.Compare(x.s, y.s)
+	case kindInt:
+		switch {
+		case x.i < y.i:
+			cmp = -1
+		case x.i > y.i:
+			cmp = 1
+		}
+	case kindBool:
+		if x.b != y.b {
+			cmp = 1
+		}
+	}
+	switch c.op {
+	case "==":
+		return value{b: cmp == 0}
+	case "!=":
+		return value{b: cmp != 0}
+	case "<":
+		return value{b: cmp < 0}
+	case "<=":
+		return value{b: cmp <= 0}
+	case ">":
+		return value{b: cmp > 0}
+	}
+	return value{b: cmp >= 0}
+}
+
+// match reports whether a string matches a pattern with an optional
+// leading or trailing *, like the match function of the Mixer expression
+// language.
+type match struct {
+	x       expr
+	pattern string
+}
+
+func (m *match) kind() kind { return kindBool }
+
+func (m *match) eval(a *Attributes) value {
+	s, p := m.x.eval(a).s, m.pattern
+	switch {
+	case p == "*":
+		return value{b: true}
+	case strings.HasSuffix(p, "*"):
+		return value{b: strings.HasPrefix(s, p[:len(p)-1])}
+	case strings.HasPrefix(p, "*"):
+		return value{b: strings.HasSuffix(s, p[1:])}
+	}
+	return value{b: s == p}
+}
+
+// inCIDR reports whether an IP address is in a network.
+type inCIDR struct {
+	x       expr
+	network *net.IPNet
+}
+
+func (c *inCIDR) kind() kind { return kindBool }
+
+func (c *inCIDR) eval(a *Attributes) value {
+	ip := net.ParseIP(c.x.eval(a).s)
+	return value{b: ip != nil && c.network.Contains(ip)}
+}
+
+// parse parses and type checks a selector, which must be a bool
+// expression.
+func parse(selector string) (expr, error) {
+	p := &parser{lexer: lexer{input: selector}}
+	p.next()
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+	if e.kind() != kindBool {
+		return nil, fmt.Errorf("selector must be a bool expression, got %s", e.kind())
+	}
+	return e, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokInt
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of selector"
+	case tokString:
+		return strconv.Quote(t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+type lexer struct {
+	input string
+	pos   int
+}
+
+var operators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", "[", "]", ","}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.input) && unicode.IsSpace(rune(l.input[l.pos])) {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos >= len(l.input) {
+		return token{kind: tokEOF, pos: start}, nil
+	}
+
+	c := l.input[l.pos]
+	switch {
+	case c == '"' || c == '\'':
+		for l.pos++; l.pos < len(l.input); l.pos++ {
+			if l.input[l.pos] == '\\' {
+				l.pos++
+				continue
+			}
+			if l.input[l.pos] == c {
+				l.pos++
+				text := l.input[start:l.pos]
+				if c == '\'' {
+					text = `"` + strings.Replace(text[1:len(text)-1], `"`, `\"`, -1) + `"`
+				}
+				s, err := strconv.Unquote(text)
+				if err != nil {
+					return token{}, fmt.Errorf("invalid string at offset %d", start)
+				}
+				return token{kind: tokString, text: s, pos: start}, nil
+			}
+		}
+		return token{}, fmt.Errorf("unterminated string at offset %d", start)
+	case c >= '0' && c <= '9':
+		for l.pos < len(l.input) && l.input[l.pos] >= '0' && l.input[l.pos] <= '9' {
+			l.pos++
+		}
+		return token{kind: tokInt, text: l.input[start:l.pos], pos: start}, nil
+	case c == '_' || unicode.IsLetter(rune(c)):
+		for l.pos < len(l.input) {
+			c := rune(l.input[l.pos])
+			if c != '_' && c != '.' && !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+				break
+			}
+			l.pos++
+		}
+		return token{kind: tokIdent, text: l.input[start:l.pos], pos: start}, nil
+	}
+	for _, op := range operators {
+		if strings.HasPrefix(l.input[l.pos:], op) {
+			l.pos += len(op)
+			return token{kind: tokOp, text: op, pos: start}, nil
+		}
+	}
+	return token{}, fmt.Errorf("unexpected %q at offset %d", c, start)
+}
+
+type parser struct {
+	lexer lexer
+	tok   token
+	err   error
+}
+
+func (p *parser) next() {
+	if p.err != nil {
+		return
+	}
+	p.tok, p.err = p.lexer.next()
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("offset %d: %s", p.tok.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) isOp(op string) bool {
+	return p.err == nil && p.tok.kind == tokOp && p.tok.text == op
+}
+
+func (p *parser) expect(op string) error {
+	if p.err != nil {
+		return p.err
+	}
+	if !p.isOp(op) {
+		return p.errorf("expected %q, got %s", op, p.tok)
+	}
+	p.next()
+	return p.err
+}
+
+func (p *parser) parseOr() (expr, error) {
+	x, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		p.next()
+		y, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if x.kind() != kindBool || y.kind() != kindBool {
+			return nil, fmt.Errorf("|| needs bool operands, got %s and %s", x.kind(), y.kind())
+		}
+		x = &logical{"||", x, y}
+	}
+	return x, p.err
+}
+
+func (p *parser) parseAnd() (expr, error) {
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		p.next()
+		y, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if x.kind() != kindBool || y.kind() != kindBool {
+			return nil, fmt.Errorf("&& needs bool operands, got %s and %s", x.kind(), y.kind())
+		}
+		x = &logical{"&&", x, y}
+	}
+	return x, p.err
+}
+
+func (p *parser) parseUnary() (expr, error) {
+	if p.isOp("!") {
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if x.kind() != kindBool {
+			return nil, fmt.Errorf("! needs a bool operand, got %s", x.kind())
+		}
+		return &not{x}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (expr, error) {
+	x, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if p.err != nil || p.tok.kind != tokOp {
+		return x, p.err
+	}
+	op := p.tok.text
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return x, nil
+	}
+	p.next()
+	y, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if x.kind() != y.kind() {
+		return nil, fmt.Errorf("cannot compare %s with %s", x.kind(), y.kind())
+	}
+	if x.kind() == kindMap {
+		return nil, fmt.Errorf("cannot compare maps")
+	}
+	if x.kind() == kindBool && op != "==" && op != "!=" {
+		return nil, fmt.Errorf("%s is not defined for bool", op)
+	}
+	return &comparison{op, x, y}, nil
+}
+
+func (p *parser) parsePrimary() (expr, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	tok := p.tok
+	switch tok.kind {
+	case tokString:
+		p.next()
+		return &literal{kindString, value{s: tok.text}}, p.err
+	case tokInt:
+		p.next()
+		i, err := strconv.ParseInt(tok.text, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return &literal{kindInt, value{i: i}}, p.err
+	case tokIdent:
+		p.next()
+		if p.err != nil {
+			return nil, p.err
+		}
+		switch {
+		case tok.text == "true" || tok.text == "false":
+			return &literal{kindBool, value{b: tok.text == "true"}}, nil
+		case p.isOp("("):
+			return p.parseCall(tok)
+		}
+		k, ok := attributeKinds[tok.text]
+		if !ok {
+			return nil, fmt.Errorf("offset %d: unknown attribute %s", tok.pos, tok.text)
+		}
+		if k != kindMap {
+			return &attribute{tok.text, k}, nil
+		}
+		if err := p.expect("["); err != nil {
+			return nil, fmt.Errorf("%s must be indexed: %v", tok.text, err)
+		}
+		if p.tok.kind != tokString {
+			return nil, p.errorf("expected a string key, got %s", p.tok)
+		}
+		key := p.tok.text
+		if tok.text == "request.headers" {
+			key = strings.ToLower(key)
+		}
+		p.next()
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		return &index{tok.text, key}, nil
+	case tokOp:
+		if tok.text == "(" {
+			p.next()
+			x, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return x, nil
+		}
+	}
+	return nil, p.errorf("unexpected %s", tok)
+}
+
+// parseCall parses the arguments of the functions match(string, pattern)
+// and inCIDR(ip, network). The second argument must be a literal.
+func (p *parser) parseCall(fn token) (expr, error) {
+	if fn.text != "match" && fn.text != "inCIDR" {
+		return nil, fmt.Errorf("offset %d: unknown function %s", fn.pos, fn.text)
+	}
+	p.next()
+	x, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if x.kind() != kindString {
+		return nil, fmt.Errorf("%s needs a string as its first argument, got %s", fn.text, x.kind())
+	}
+	if err := p.expect(","); err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokString {
+		return nil, p.errorf("%s needs a string literal as its second argument", fn.text)
+	}
+	arg := p.tok.text
+	p.next()
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	if fn.text == "match" {
+		return &match{x, arg}, nil
+	}
+	_, network, err := net.ParseCIDR(arg)
+	if err != nil {
+		return nil, err
+	}
+	return &inCIDR{x, network}, nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAttributes are the attributes the selectors in the tests are
+// evaluated against. The time is a Tuesday at 14:30.
+var testAttributes = &Attributes{
+	SourceIP:     "10.1.2.3",
+	SourceUser:   "load-tester",
+	SourceLabels: map[string]string{"app": "frontend", "version": "v2"},
+	Method:       "/ping.Ping/Ping",
+	Headers:      map[string]string{"x-forwarded-user-agent": "mobile"},
+	Time:         time.Date(2017, 10, 17, 14, 30, 0, 0, time.UTC),
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{`true`, true},
+		{`false`, false},
+		{`source.labels["app"] == "frontend"`, true},
+		{`source.labels["app"]=="frontend"`, true},
+		{`source.labels['app'] == 'frontend'`, true},
+		{`source.labels["app"] != "frontend"`, false},
+		{`source.labels["missing"] == ""`, true},
+		{`request.headers["X-Forwarded-User-Agent"] == "mobile"`, true},
+		{`source.user == "load-tester"`, true},
+		{`request.method == "/ping.Ping/Ping"`, true},
+		{`request.time.hour == 14`, true},
+		{`request.time.hour >= 9 && request.time.hour < 17`, true},
+		{`request.time.minute > 30`, false},
+		{`request.time.minute <= 30`, true},
+		{`request.time.weekday == "Tuesday"`, true},
+		{`"a" < "b"`, true},
+		{`"b" >= "a"`, true},
+		{`true == (1 < 2)`, true},
+		{`true != false`, true},
+		{`match(request.method, "/ping.Ping/*")`, true},
+		{`match(request.method, "*/Ping")`, true},
+		{`match(request.method, "/ping.Ping")`, false},
+		{`match(source.user, "*")`, true},
+		{`inCIDR(source.ip, "10.0.0.0/8")`, true},
+		{`inCIDR(source.ip, "192.168.0.0/16")`, false},
+		{`inCIDR(source.user, "10.0.0.0/8")`, false},
+		{`!true`, false},
+		{`!!true`, true},
+		{`!(1 == 2)`, true},
+
+		// && binds tighter than ||, and ! tighter than both.
+		{`true || true && false`, true},
+		{`(true || true) && false`, false},
+		{`false && false || true`, true},
+		{`false && (false || true)`, false},
+		{`!false && false`, false},
+		{`!(false && false)`, true},
+		{`!true || true`, true},
+		{`source.labels["app"] == "frontend" && source.labels["version"] == "v1" || source.user == "load-tester"`, true},
+	}
+	for _, tt := range tests {
+		e, err := parse(tt.selector)
+		if err != nil {
+			t.Errorf("parse(%q) returned error: %v", tt.selector, err)
+			continue
+		}
+		if got := e.eval(testAttributes).b; got != tt.want {
+			t.Errorf("%s = %t, want %t", tt.selector, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		selector string
+		want     string
+	}{
+		{``, "offset 0: unexpected end of selector"},
+		{`request.time.hour`, "selector must be a bool expression, got int"},
+		{`source.ip`, "selector must be a bool expression, got string"},
+		{`source.unknown == "x"`, "offset 0: unknown attribute source.unknown"},
+		{`source.labels == "x"`, `source.labels must be indexed: offset 14: expected "[", got "=="`},
+		{`source.labels[app] == "x"`, `offset 14: expected a string key, got "app"`},
+		{`source.labels["app" == "x"`, `offset 20: expected "]", got "=="`},
+		{`request.time.hour == "9"`, "cannot compare int with string"},
+		{`true < false`, "< is not defined for bool"},
+		{`true && "x"`, "&& needs bool operands, got bool and string"},
+		{`1 || true`, "|| needs bool operands, got int and bool"},
+		{`!source.ip`, "! needs a bool operand, got string"},
+		{`(true`, `offset 5: expected ")", got end of selector`},
+		{`true)`, `offset 4: unexpected ")"`},
+		{`true true`, `offset 5: unexpected "true"`},
+		{`source.user == "open`, "unterminated string at offset 15"},
+		{`source.user == "x" & true`, "unexpected '&' at offset 19"},
+		{`lookup(source.ip, "x")`, "offset 0: unknown function lookup"},
+		{`match(request.time.hour, "1*")`, "match needs a string as its first argument, got int"},
+		{`match(request.method, request.method)`, "offset 22: match needs a string literal as its second argument"},
+		{`match(request.method "x")`, `offset 21: expected ",", got "x"`},
+		{`inCIDR(source.ip, "10.0.0.0")`, "invalid CIDR address: 10.0.0.0"},
+	}
+	for _, tt := range tests {
+		_, err := parse(tt.selector)
+		if err == nil {
+			t.Errorf("parse(%q) returned no error", tt.selector)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parse(%q) returned %q, want %q", tt.selector, err, tt.want)
+		}
+	}
+}
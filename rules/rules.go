@@ -0,0 +1,387 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rules allows, denies or rate limits gRPC calls by evaluating
+// selector expressions against request attributes, like the denials aspect
+// of the Istio Mixer. It lets the Mixer demos run without Istio.
+//
+// Rules are read from a YAML file and evaluated in order; the first rule
+// whose selector matches a call decides its fate:
+//
+//	default: allow
+//	timezone: UTC
+//	rules:
+//	- name: no-frontend
+//	  selector: source.labels["app"]=="frontend"
+//	  action: deny
+//	- name: throttle-mobile
+//	  selector: request.headers["x-forwarded-user-agent"]=="mobile"
+//	  action: rate-limit
+//	  rate: 5
+//	  burst: 10
+//
+// Mixer rules with a denials aspect, such as istio/mixer/bar-deny.yaml, are
+// accepted as they are. The gRPC health service is exempt from the rules,
+// so health checks keep working under default: deny.
+//
+// Selectors compare attributes with ==, !=, <, <=, > and >=, combine
+// conditions with &&, || and !, and may call match(value, "prefix*") and
+// inCIDR(source.ip, "10.0.0.0/8"). The attributes are:
+//
+//	source.ip             the IP address of the peer
+//	source.user           the authenticated caller, see package auth
+//	source.labels["k"]    labels from the x-source-labels metadata
+//	request.method        the full gRPC method, /ping.Ping/Ping
+//	request.headers["k"]  the first value of a metadata key
+//	request.time.hour     the hour of the day, 0 to 23
+//	request.time.minute   the minute of the hour, 0 to 59
+//	request.time.weekday  the day of the week, Monday to Sunday
+//
+// Any caller can set the x-source-labels metadata, so source labels are
+// advisory: they identify well-behaved callers such as the frontend, but
+// do not authenticate them. Rules that must hold against hostile callers
+// should select on source.user, which requires an authenticated token, or
+// be combined with an authorization policy backed by mTLS, see package
+// authz.
+package rules
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kelseyhightower/ping/auth"
+	"github.com/kelseyhightower/ping/internal/yaml"
+	"github.com/kelseyhightower/ping/logging"
+	"github.com/kelseyhightower/ping/ratelimit"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// healthService is the prefix of the methods the rules never apply to.
+const healthService = "/grpc.health.v1.Health/"
+
+// SourceLabelsKey is the metadata key that carries the labels of the
+// calling workload, as comma separated key=value pairs.
+const SourceLabelsKey = "x-source-labels"
+
+// Config is the contents of a rules file.
+type Config struct {
+	// Default is the action for calls that no rule matches: allow or deny.
+	// It defaults to allow, like Mixer.
+	Default string `json:"default"`
+	// Timezone is the location of the request.time attributes. It defaults
+	// to UTC.
+	Timezone string `json:"timezone"`
+	Rules    []Rule `json:"rules"`
+}
+
+// Rule applies an action to the calls its selector matches.
+type Rule struct {
+	Name string `json:"name"`
+	// Selector is the expression calls must match. An empty selector
+	// matches every call.
+	Selector string `json:"selector"`
+	// Action is allow, deny or rate-limit.
+	Action string `json:"action"`
+	// Aspects is the Mixer form of the action; a denials aspect denies.
+	Aspects []Aspect `json:"aspects"`
+	// Message replaces the error message of denied calls.
+	Message string `json:"message"`
+	// Rate and Burst configure rate-limit rules: calls are allowed at Rate
+	// per second on average and Burst at once. All matching calls share one
+	// limit.
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// Aspect is a Mixer aspect.
+type Aspect struct {
+	Kind string `json:"kind"`
+}
+
+// Attributes describe a call.
+type Attributes struct {
+	SourceIP     string
+	SourceUser   string
+	SourceLabels map[string]string
+	Method       string
+	Headers      map[string]string
+	Time         time.Time
+}
+
+// ruleSet is a loaded rules file.
+type ruleSet struct {
+	deny     bool
+	location *time.Location
+	rules    []*rule
+}
+
+type rule struct {
+	number   int
+	name     string
+	selector string
+	expr     expr
+	action   string
+	message  string
+	bucket   *ratelimit.Bucket
+}
+
+func (r *rule) String() string {
+	if r.name != "" {
+		return fmt.Sprintf("rule %d (%s)", r.number, r.name)
+	}
+	return fmt.Sprintf("rule %d", r.number)
+}
+
+func parseConfig(data []byte) (*ruleSet, error) {
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+
+	rs := &ruleSet{location: time.UTC}
+	switch cfg.Default {
+	case "", "allow":
+	case "deny":
+		rs.deny = true
+	default:
+		return nil, fmt.Errorf("default must be allow or deny, got %q", cfg.Default)
+	}
+	if cfg.Timezone != "" {
+		loc, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		rs.location = loc
+	}
+
+	for i, rc := range cfg.Rules {
+		r := &rule{
+			number:   i + 1,
+			name:     rc.Name,
+			selector: rc.Selector,
+			action:   rc.Action,
+			message:  rc.Message,
+		}
+		for _, a := range rc.Aspects {
+			if a.Kind != "denials" {
+				return nil, fmt.Errorf("%s: unsupported aspect %q", r, a.Kind)
+			}
+			r.action = "deny"
+		}
+		if rc.Selector != "" {
+			e, err := parse(rc.Selector)
+			if err != nil {
+				return nil, fmt.Errorf("%s: selector %s: %v", r, rc.Selector, err)
+			}
+			r.expr = e
+		}
+		switch r.action {
+		case "allow", "deny":
+		case "rate-limit":
+			if rc.Rate <= 0 {
+				return nil, fmt.Errorf("%s: rate-limit needs a positive rate", r)
+			}
+			r.bucket = ratelimit.NewBucket(rc.Rate, rc.Burst)
+		case "":
+			return nil, fmt.Errorf("%s: no action", r)
+		default:
+			return nil, fmt.Errorf("%s: action must be allow, deny or rate-limit, got %q", r, r.action)
+		}
+		rs.rules = append(rs.rules, r)
+	}
+	return rs, nil
+}
+
+// check returns the error for a call with attributes a, or nil if it is
+// allowed.
+func (rs *ruleSet) check(a *Attributes) error {
+	a.Time = a.Time.In(rs.location)
+	for _, r := range rs.rules {
+		if r.expr != nil && !r.expr.eval(a).b {
+			continue
+		}
+		switch r.action {
+		case "deny":
+			if r.message != "" {
+				return status.Error(codes.PermissionDenied, r.message)
+			}
+			if r.selector == "" {
+				return status.Errorf(codes.PermissionDenied, "%s is denied by %s", a.Method, r)
+			}
+			return status.Errorf(codes.PermissionDenied, "%s is denied by %s: %s", a.Method, r, r.selector)
+		case "rate-limit":
+			if ok, wait := r.bucket.Take(); !ok {
+				return ratelimit.Exhausted(wait, "%s is rate limited by %s", a.Method, r)
+			}
+		}
+		return nil
+	}
+	if rs.deny {
+		return status.Errorf(codes.PermissionDenied, "%s is denied by default: no rule matches it", a.Method)
+	}
+	return nil
+}
+
+// Engine evaluates the rules in a file, reloading them when the file
+// changes.
+type Engine struct {
+	path string
+
+	mu      sync.RWMutex
+	rules   *ruleSet
+	modTime time.Time
+	size    int64
+}
+
+// Load reads the rules file at path.
+func Load(path string) (*Engine, error) {
+	e := &Engine{path: path}
+	if err := e.load(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *Engine) load() error {
+	fi, err := os.Stat(e.path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(e.path)
+	if err != nil {
+		return err
+	}
+	rs, err := parseConfig(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", e.path, err)
+	}
+	e.mu.Lock()
+	e.rules, e.modTime, e.size = rs, fi.ModTime(), fi.Size()
+	e.mu.Unlock()
+	return nil
+}
+
+func (e *Engine) changed() bool {
+	fi, err := os.Stat(e.path)
+	if err != nil {
+		return false
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return !fi.ModTime().Equal(e.modTime) || fi.Size() != e.size
+}
+
+// Watch checks the rules file for changes every interval and reloads it.
+// If the new rules are invalid the previous ones stay in use. Rate limits
+// start over with full buckets after a reload. Watch never returns.
+func (e *Engine) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if !e.changed() {
+			continue
+		}
+		if err := e.load(); err != nil {
+			logging.Errorf("Error reloading rules: %v", err)
+			continue
+		}
+		logging.Infof("Reloaded rules from %s", e.path)
+	}
+}
+
+// Check returns the error for a call to method, or nil if the rules allow
+// it. Calls to the health service are always allowed.
+func (e *Engine) Check(ctx context.Context, method string) error {
+	if strings.HasPrefix(method, healthService) {
+		return nil
+	}
+	e.mu.RLock()
+	rs := e.rules
+	e.mu.RUnlock()
+	return rs.check(attributesOf(ctx, method))
+}
+
+func attributesOf(ctx context.Context, method string) *Attributes {
+	a := &Attributes{
+		Method:       method,
+		Headers:      make(map[string]string),
+		SourceLabels: make(map[string]string),
+		Time:         time.Now(),
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		a.SourceIP = p.Addr.String()
+		if host, _, err := net.SplitHostPort(a.SourceIP); err == nil {
+			a.SourceIP = host
+		}
+	}
+	if p, ok := auth.FromContext(ctx); ok {
+		a.SourceUser = p.Subject
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for k, v := range md {
+			if len(v) > 0 {
+				a.Headers[k] = v[0]
+			}
+		}
+		for _, v := range md[SourceLabelsKey] {
+			for k, v := range ParseLabels(v) {
+				a.SourceLabels[k] = v
+			}
+		}
+	}
+	return a
+}
+
+// ParseLabels parses comma separated key=value pairs.
+func ParseLabels(s string) map[string]string {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			continue
+		}
+		labels[strings.TrimSpace(pair[:i])] = strings.TrimSpace(pair[i+1:])
+	}
+	return labels
+}
+
+// UnaryServerInterceptor returns an interceptor that applies the rules to
+// unary calls.
+func (e *Engine) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := e.Check(ctx, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor returns an interceptor that applies the rules to
+// streaming calls.
+func (e *Engine) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := e.Check(ss.Context(), info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package rules
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestCheckDefaultDeny(t *testing.T) {
+	rs, err := parseConfig([]byte("default: deny\nrules: []\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &Engine{rules: rs}
+
+	tests := []struct {
+		method  string
+		allowed bool
+	}{
+		{"/grpc.health.v1.Health/Check", true},
+		{"/grpc.health.v1.Health/Watch", true},
+		{"/ping.Ping/Ping", false},
+		{"/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo", false},
+	}
+	for _, tt := range tests {
+		err := e.Check(context.Background(), tt.method)
+		if allowed := err == nil; allowed != tt.allowed {
+			t.Errorf("Check(%q) = %v, want allowed %v", tt.method, err, tt.allowed)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tlsutil loads certificates from disk, reloads them when the files
+// change and provides gRPC transport credentials that always use the latest
+// certificates. This allows servers to run with short-lived certificates
+// without restarting.
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kelseyhightower/ping/logging"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/credentials"
+)
+
+// Reloader holds a certificate, its private key and a CA bundle loaded from
+// files. The certificate is used to serve TLS and as the client certificate
+// for mTLS; the CA bundle verifies peers.
+type Reloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu     sync.RWMutex
+	cert   *tls.Certificate
+	pool   *x509.CertPool
+	stamps map[string]fileStamp
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewReloader loads the files. The certificate and key must be given
+// together; either the key pair or the CA bundle may be omitted.
+func NewReloader(certFile, keyFile, caFile string) (*Reloader, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("tlsutil: the certificate and key must be given together")
+	}
+	if certFile == "" && caFile == "" {
+		return nil, errors.New("tlsutil: no certificate or CA bundle given")
+	}
+	r := &Reloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Reloader) files() []string {
+	var files []string
+	for _, f := range []string{r.certFile, r.keyFile, r.caFile} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+func (r *Reloader) load() error {
+	stamps := make(map[string]fileStamp)
+	for _, f := range r.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		stamps[f] = fileStamp{fi.ModTime(), fi.Size()}
+	}
+
+	var cert *tls.Certificate
+	if r.certFile != "" {
+		c, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return err
+		}
+		if c.Leaf == nil {
+			if c.Leaf, err = x509.ParseCertificate(c.Certificate[0]); err != nil {
+				return err
+			}
+		}
+		cert = &c
+	}
+
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		data, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("tlsutil: no certificates found in %s", r.caFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert, r.pool, r.stamps = cert, pool, stamps
+	r.mu.Unlock()
+	return nil
+}
+
+// changed reports whether any of the files was modified since it was
+// loaded.
+func (r *Reloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, f := range r.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			// The file may be in the middle of being replaced.
+			continue
+		}
+		if s := r.stamps[f]; !fi.ModTime().Equal(s.modTime) || fi.Size() != s.size {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch checks the files for changes every interval and reloads them. If a
+// reload fails, for example because only the certificate was replaced so
+// far, the previous certificates stay in use and the reload is retried.
+// Watch never returns.
+func (r *Reloader) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if !r.changed() {
+			continue
+		}
+		if err := r.load(); err != nil {
+			logging.Errorf("Error reloading TLS certificates: %v", err)
+			continue
+		}
+		if cert := r.Certificate(); cert != nil {
+			logging.Infof("Reloaded TLS certificate %s, valid until %s", r.certFile, cert.Leaf.NotAfter.Format(time.RFC3339))
+		} else {
+			logging.Infof("Reloaded TLS CA bundle %s", r.caFile)
+		}
+	}
+}
+
+// Certificate returns the current certificate, or nil if none was
+// configured.
+func (r *Reloader) Certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert
+}
+
+// CertPool returns the current CA bundle, or nil to use the system roots.
+func (r *Reloader) CertPool() *x509.CertPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pool
+}
+
+// ServerName returns a name the current certificate is valid for. It lets
+// a server dial itself over TLS.
+func (r *Reloader) ServerName() string {
+	cert := r.Certificate()
+	if cert == nil {
+		return ""
+	}
+	if len(cert.Leaf.DNSNames) > 0 {
+		return cert.Leaf.DNSNames[0]
+	}
+	return cert.Leaf.Subject.CommonName
+}
+
+// ServerConfig returns a server configuration that uses the current
+// certificate. If requireClientCert is true, clients must present a
+// certificate signed by the CA bundle; otherwise client certificates are
+// verified only if presented.
+func (r *Reloader) ServerConfig(requireClientCert bool) *tls.Config {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cert := r.Certificate(); cert != nil {
+		cfg.Certificates = []tls.Certificate{*cert}
+	}
+	if pool := r.CertPool(); pool != nil {
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if requireClientCert {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg
+}
+
+// ClientConfig returns a client configuration that verifies servers with
+// the current CA bundle and presents the current certificate, if any.
+func (r *Reloader) ClientConfig(serverName string) *tls.Config {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+		RootCAs:    r.CertPool(),
+	}
+	if cert := r.Certificate(); cert != nil {
+		cfg.Certificates = []tls.Certificate{*cert}
+	}
+	return cfg
+}
+
+// ServerCredentials returns gRPC server credentials that pick up reloaded
+// certificates on every new connection.
+func (r *Reloader) ServerCredentials(requireClientCert bool) (credentials.TransportCredentials, error) {
+	if r.Certificate() == nil {
+		return nil, errors.New("tlsutil: a certificate and key are required to serve TLS")
+	}
+	if requireClientCert && r.CertPool() == nil {
+		return nil, errors.New("tlsutil: a CA bundle is required to verify client certificates")
+	}
+	return &reloadingCredentials{config: func() *tls.Config { return r.ServerConfig(requireClientCert) }}, nil
+}
+
+// ClientCredentials returns gRPC client credentials that pick up reloaded
+// certificates on every new connection. If serverName is empty the host of
+// the dialed address is verified.
+func (r *Reloader) ClientCredentials(serverName string) credentials.TransportCredentials {
+	return &reloadingCredentials{
+		config:     func() *tls.Config { return r.ClientConfig("") },
+		serverName: serverName,
+	}
+}
+
+// reloadingCredentials performs each handshake with a freshly built TLS
+// configuration, so connections made after a reload use the new
+// certificates while established connections are left alone.
+type reloadingCredentials struct {
+	config     func() *tls.Config
+	serverName string
+}
+
+func (c *reloadingCredentials) tls() credentials.TransportCredentials {
+	cfg := c.config()
+	if c.serverName != "" {
+		cfg.ServerName = c.serverName
+	}
+	return credentials.NewTLS(cfg)
+}
+
+func (c *reloadingCredentials) ClientHandshake(ctx context.Context, addr string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return c.tls().ClientHandshake(ctx, addr, rawConn)
+}
+
+func (c *reloadingCredentials) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return c.tls().ServerHandshake(rawConn)
+}
+
+func (c *reloadingCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{
+		SecurityProtocol: "tls",
+		SecurityVersion:  "1.2",
+		ServerName:       c.serverName,
+	}
+}
+
+func (c *reloadingCredentials) Clone() credentials.TransportCredentials {
+	clone := *c
+	return &clone
+}
+
+func (c *reloadingCredentials) OverrideServerName(serverName string) error {
+	c.serverName = serverName
+	return nil
+}
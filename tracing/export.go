@@ -0,0 +1,214 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kelseyhightower/ping/logging"
+)
+
+const (
+	// batchSize is the number of spans that triggers an export.
+	batchSize = 100
+	// flushInterval is the longest a span waits to be exported.
+	flushInterval = time.Second
+	// queueSize is the number of spans that may wait for export. Spans
+	// beyond that are dropped rather than slowing down requests.
+	queueSize = 1000
+	// dropLogInterval is how often the number of dropped spans is logged.
+	dropLogInterval = 10 * time.Second
+)
+
+// Exporter sends finished spans to a tracing backend. Exporters that
+// implement io.Closer are closed when the tracer is.
+type Exporter interface {
+	Export(spans []*SpanModel) error
+}
+
+// HTTPExporter posts spans to a Zipkin collector, such as
+// http://zipkin:9411/api/v2/spans.
+type HTTPExporter struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewHTTPExporter returns an exporter for the collector at url.
+func NewHTTPExporter(url string) *HTTPExporter {
+	return &HTTPExporter{URL: url, Client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+// Export posts spans as a Zipkin v2 JSON list.
+func (e *HTTPExporter) Export(spans []*SpanModel) error {
+	data, err := json.Marshal(spans)
+	if err != nil {
+		return err
+	}
+	resp, err := e.Client.Post(e.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("zipkin collector %s returned %s", e.URL, resp.Status)
+	}
+	return nil
+}
+
+// FileExporter appends spans to a file. Each line is a Zipkin v2 JSON list
+// that can be posted to a collector as it is.
+type FileExporter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileExporter opens path for appending.
+func NewFileExporter(path string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{file: f}, nil
+}
+
+// Export writes spans as one line.
+func (e *FileExporter) Export(spans []*SpanModel) error {
+	data, err := json.Marshal(spans)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.file.Write(append(data, '\n'))
+	return err
+}
+
+// Close closes the file.
+func (e *FileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.file.Close()
+}
+
+// batcher queues spans and exports them in batches from a single
+// goroutine.
+type batcher struct {
+	// dropped counts the spans dropped since it was last logged. It is
+	// first for the alignment of atomic operations.
+	dropped uint64
+
+	exporter Exporter
+	queue    chan *SpanModel
+	done     chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newBatcher(exporter Exporter) *batcher {
+	b := &batcher{
+		exporter: exporter,
+		queue:    make(chan *SpanModel, queueSize),
+		done:     make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *batcher) enqueue(span *SpanModel) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return
+	}
+	select {
+	case b.queue <- span:
+	default:
+		atomic.AddUint64(&b.dropped, 1)
+	}
+}
+
+// logDropped logs the number of spans dropped since the last call, if any.
+func (b *batcher) logDropped() {
+	if n := atomic.SwapUint64(&b.dropped, 0); n > 0 {
+		logging.Warnf("Dropped %d spans: the export queue is full", n)
+	}
+}
+
+func (b *batcher) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var batch []*SpanModel
+	lastDropLog := time.Now()
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := b.exporter.Export(batch); err != nil {
+			logging.Errorf("Error exporting %d spans: %v", len(batch), err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case span, ok := <-b.queue:
+			if !ok {
+				flush()
+				b.logDropped()
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case now := <-ticker.C:
+			flush()
+			if now.Sub(lastDropLog) >= dropLogInterval {
+				b.logDropped()
+				lastDropLog = now
+			}
+		}
+	}
+}
+
+// close exports the queued spans, stops the batcher and closes the
+// exporter. Spans finished afterwards are dropped.
+func (b *batcher) close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		<-b.done
+		return nil
+	}
+	b.closed = true
+	close(b.queue)
+	b.mu.Unlock()
+	<-b.done
+	if c, ok := b.exporter.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
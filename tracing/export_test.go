@@ -0,0 +1,234 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kelseyhightower/ping/propagation"
+)
+
+// collector is a stub Zipkin collector that records the posted batches.
+type collector struct {
+	mu      sync.Mutex
+	batches [][]map[string]interface{}
+	status  int
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.URL.Path != "/api/v2/spans" {
+		http.Error(w, "unexpected request "+r.Method+" "+r.URL.Path, http.StatusNotFound)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+		http.Error(w, "unexpected content type "+ct, http.StatusUnsupportedMediaType)
+		return
+	}
+	var batch []map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	c.batches = append(c.batches, batch)
+	status := c.status
+	c.mu.Unlock()
+	if status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (c *collector) sizes() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var sizes []int
+	for _, b := range c.batches {
+		sizes = append(sizes, len(b))
+	}
+	return sizes
+}
+
+func newCollector() (*collector, *httptest.Server) {
+	c := &collector{}
+	return c, httptest.NewServer(c)
+}
+
+func TestHTTPExporterPostsZipkinV2(t *testing.T) {
+	c, srv := newCollector()
+	defer srv.Close()
+
+	tracer := NewTracer(NewEndpoint("frontend", "10.0.0.1:8080"), NewHTTPExporter(srv.URL+"/api/v2/spans"), 1)
+	sampled := true
+	parent := &propagation.Context{
+		TraceID: "463ac35c9f6413ad48485a3953bb6124",
+		SpanID:  "a2fb4a1d1a96d312",
+		Sampled: &sampled,
+	}
+	span := tracer.StartSpan("/ping.Ping/Ping", Client, parent)
+	span.SetRemoteEndpoint(NewEndpoint("bar", "[::1]:8081"))
+	span.SetTag("grpc.status_code", "OK")
+	span.Finish()
+	if err := tracer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.batches) != 1 || len(c.batches[0]) != 1 {
+		t.Fatalf("collector received batches of %v spans, want [1]", c.sizes())
+	}
+	got := c.batches[0][0]
+	for _, key := range []string{"timestamp", "duration", "id"} {
+		if _, ok := got[key]; !ok {
+			t.Errorf("span has no %s: %v", key, got)
+		}
+		delete(got, key)
+	}
+	want := map[string]interface{}{
+		"traceId":        "463ac35c9f6413ad48485a3953bb6124",
+		"parentId":       "a2fb4a1d1a96d312",
+		"name":           "/ping.Ping/Ping",
+		"kind":           "CLIENT",
+		"localEndpoint":  map[string]interface{}{"serviceName": "frontend", "ipv4": "10.0.0.1", "port": float64(8080)},
+		"remoteEndpoint": map[string]interface{}{"serviceName": "bar", "ipv6": "::1", "port": float64(8081)},
+		"tags":           map[string]interface{}{"grpc.status_code": "OK"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("posted span = %v, want %v", got, want)
+	}
+}
+
+func TestHTTPExporterError(t *testing.T) {
+	c, srv := newCollector()
+	defer srv.Close()
+	c.status = http.StatusServiceUnavailable
+
+	err := NewHTTPExporter(srv.URL + "/api/v2/spans").Export([]*SpanModel{{TraceID: "1", ID: "2", Name: "x"}})
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("Export returned %v, want an error with the status", err)
+	}
+}
+
+func TestBatching(t *testing.T) {
+	c, srv := newCollector()
+	defer srv.Close()
+
+	b := newBatcher(NewHTTPExporter(srv.URL + "/api/v2/spans"))
+	for i := 0; i < 2*batchSize+50; i++ {
+		b.enqueue(&SpanModel{TraceID: "1", ID: fmt.Sprint(i), Name: "x"})
+	}
+	if err := b.close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.sizes(), []int{batchSize, batchSize, 50}; !reflect.DeepEqual(got, want) {
+		t.Errorf("collector received batches of %v spans, want %v", got, want)
+	}
+}
+
+func TestFlushOnClose(t *testing.T) {
+	c, srv := newCollector()
+	defer srv.Close()
+
+	b := newBatcher(NewHTTPExporter(srv.URL + "/api/v2/spans"))
+	for i := 0; i < 3; i++ {
+		b.enqueue(&SpanModel{TraceID: "1", ID: fmt.Sprint(i), Name: "x"})
+	}
+	// The spans are exported by close, before the flush interval is over.
+	if err := b.close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.sizes(), []int{3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("collector received batches of %v spans, want %v", got, want)
+	}
+
+	// Spans finished after close are dropped.
+	b.enqueue(&SpanModel{TraceID: "1", ID: "4", Name: "x"})
+	if err := b.close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.sizes(), []int{3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("collector received batches of %v spans after close, want %v", got, want)
+	}
+}
+
+// blockingExporter blocks every export until release is closed.
+type blockingExporter struct {
+	release chan struct{}
+}
+
+func (e *blockingExporter) Export(spans []*SpanModel) error {
+	<-e.release
+	return nil
+}
+
+func TestDroppedSpansAreCounted(t *testing.T) {
+	e := &blockingExporter{release: make(chan struct{})}
+	b := newBatcher(e)
+	// One batch is taken from the queue and blocks in Export, the queue
+	// fills up and the rest are dropped.
+	total := batchSize + queueSize + 25
+	for i := 0; i < total; i++ {
+		b.enqueue(&SpanModel{TraceID: "1", ID: fmt.Sprint(i), Name: "x"})
+	}
+	if dropped := atomic.LoadUint64(&b.dropped); dropped == 0 || dropped > 25+batchSize {
+		t.Errorf("dropped %d spans, want between 1 and %d", dropped, 25+batchSize)
+	}
+	close(e.release)
+	b.close()
+	if dropped := atomic.LoadUint64(&b.dropped); dropped != 0 {
+		t.Errorf("%d dropped spans were not logged on close", dropped)
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tracing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spans.json")
+
+	e, err := NewFileExporter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newBatcher(e)
+	b.enqueue(&SpanModel{TraceID: "1", ID: "2", Name: "x"})
+	if err := b.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), `[{"traceId":"1","id":"2","name":"x","timestamp":0,"duration":0}]`+"\n"; got != want {
+		t.Errorf("file = %q, want %q", got, want)
+	}
+	// Closing the batcher closed the file.
+	if err := e.Export([]*SpanModel{{TraceID: "1", ID: "3", Name: "x"}}); err == nil {
+		t.Error("Export after close succeeded, want an error for the closed file")
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"github.com/kelseyhightower/ping/middleware"
+	"github.com/kelseyhightower/ping/propagation"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// startServerSpan starts the span of an incoming call, continuing the
+// trace in its context or, without the propagation interceptors, in its
+// metadata.
+func (t *Tracer) startServerSpan(ctx context.Context, method string) *Span {
+	parent := propagation.FromContext(ctx)
+	if parent == nil {
+		md, _ := metadata.FromIncomingContext(ctx)
+		parent = propagation.ExtractMetadata(md)
+	}
+	span := t.StartSpan(method, Server, parent)
+	span.SetTag("grpc.method", method)
+	if p, ok := peer.FromContext(ctx); ok {
+		span.SetRemoteEndpoint(NewEndpoint("", p.Addr.String()))
+	}
+	return span
+}
+
+func finishRPC(span *Span, err error) {
+	span.SetTag("grpc.status_code", grpc.Code(err).String())
+	span.SetError(err)
+	span.Finish()
+}
+
+// UnaryServerInterceptor returns an interceptor that records a server span
+// for every unary call.
+func (t *Tracer) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		span := t.startServerSpan(ctx, info.FullMethod)
+		resp, err := handler(NewContext(ctx, span), req)
+		finishRPC(span, err)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor returns an interceptor that records a server
+// span for every streaming call.
+func (t *Tracer) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		span := t.startServerSpan(ss.Context(), info.FullMethod)
+		err := handler(srv, middleware.WrapServerStream(ss, NewContext(ss.Context(), span)))
+		finishRPC(span, err)
+		return err
+	}
+}
+
+// UnaryClientInterceptor returns an interceptor that records a client span
+// for every call to the service named remoteService. The span is a child
+// of the trace context of the call and replaces it, so it must come before
+// the interceptor of a propagation.Propagator.
+func (t *Tracer) UnaryClientInterceptor(remoteService string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		span := t.StartSpan(method, Client, propagation.FromContext(ctx))
+		span.SetTag("grpc.method", method)
+		span.SetRemoteEndpoint(&Endpoint{ServiceName: remoteService})
+
+		err := invoker(NewContext(ctx, span), method, req, reply, cc, opts...)
+		finishRPC(span, err)
+		return err
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/kelseyhightower/ping/middleware"
+	"github.com/kelseyhightower/ping/propagation"
+)
+
+// Handler returns h wrapped so that every request records a server span,
+// continuing the trace in the request's context or headers. The span is in
+// the context of the request.
+func (t *Tracer) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parent := propagation.FromContext(r.Context())
+		if parent == nil {
+			parent = propagation.ExtractHTTP(r.Header)
+		}
+		span := t.StartSpan(r.Method+" "+r.URL.Path, Server, parent)
+		span.SetTag("http.method", r.Method)
+		span.SetTag("http.path", r.URL.Path)
+		span.SetRemoteEndpoint(NewEndpoint("", r.RemoteAddr))
+
+		rec := middleware.NewResponseRecorder(w)
+		h.ServeHTTP(rec, r.WithContext(NewContext(r.Context(), span)))
+
+		span.SetTag("http.status_code", strconv.Itoa(rec.Status))
+		if rec.Status >= 500 {
+			span.SetTag("error", http.StatusText(rec.Status))
+		}
+		span.Finish()
+	})
+}
@@ -0,0 +1,237 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracing records spans for RPCs and HTTP requests and exports
+// them to Zipkin in the v2 JSON format, so that traces work without an
+// Envoy sidecar.
+//
+// Servers start a span for every call they handle, continuing the trace
+// extracted by the propagation package. Clients start a child span for
+// every call they make, whose context the propagation package passes on.
+package tracing
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kelseyhightower/ping/internal/random"
+	"github.com/kelseyhightower/ping/propagation"
+
+	"golang.org/x/net/context"
+)
+
+// Span kinds.
+const (
+	Server = "SERVER"
+	Client = "CLIENT"
+)
+
+// Endpoint is a Zipkin endpoint.
+type Endpoint struct {
+	ServiceName string `json:"serviceName,omitempty"`
+	IPv4        string `json:"ipv4,omitempty"`
+	IPv6        string `json:"ipv6,omitempty"`
+	Port        int    `json:"port,omitempty"`
+}
+
+// NewEndpoint returns the endpoint of a service at a host:port address.
+func NewEndpoint(serviceName, addr string) *Endpoint {
+	e := &Endpoint{ServiceName: serviceName}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return e
+	}
+	e.Port, _ = strconv.Atoi(port)
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			e.IPv4 = ip.String()
+		} else {
+			e.IPv6 = ip.String()
+		}
+	}
+	return e
+}
+
+// SpanModel is a finished span in the Zipkin v2 JSON format. Timestamps and
+// durations are in microseconds.
+type SpanModel struct {
+	TraceID        string            `json:"traceId"`
+	ID             string            `json:"id"`
+	ParentID       string            `json:"parentId,omitempty"`
+	Name           string            `json:"name"`
+	Kind           string            `json:"kind,omitempty"`
+	Timestamp      int64             `json:"timestamp"`
+	Duration       int64             `json:"duration"`
+	LocalEndpoint  *Endpoint         `json:"localEndpoint,omitempty"`
+	RemoteEndpoint *Endpoint         `json:"remoteEndpoint,omitempty"`
+	Tags           map[string]string `json:"tags,omitempty"`
+	Debug          bool              `json:"debug,omitempty"`
+}
+
+// Span is a timed operation within a trace.
+type Span struct {
+	tracer  *Tracer
+	context *propagation.Context
+	name    string
+	kind    string
+	start   time.Time
+
+	mu     sync.Mutex
+	remote *Endpoint
+	tags   map[string]string
+	done   bool
+}
+
+// Context returns the trace context of the span.
+func (s *Span) Context() *propagation.Context {
+	return s.context
+}
+
+// SetTag sets a tag on the span.
+func (s *Span) SetTag(key, value string) {
+	s.mu.Lock()
+	s.tags[key] = value
+	s.mu.Unlock()
+}
+
+// SetError tags the span with err, if it is not nil.
+func (s *Span) SetError(err error) {
+	if err != nil {
+		s.SetTag("error", err.Error())
+	}
+}
+
+// SetRemoteEndpoint records the other side of the operation.
+func (s *Span) SetRemoteEndpoint(e *Endpoint) {
+	s.mu.Lock()
+	s.remote = e
+	s.mu.Unlock()
+}
+
+// Finish ends the span and queues it for export if it is sampled. Only the
+// first call has an effect.
+func (s *Span) Finish() {
+	end := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return
+	}
+	s.done = true
+	if s.context.Sampled == nil || !*s.context.Sampled {
+		return
+	}
+
+	duration := end.Sub(s.start).Nanoseconds() / 1000
+	if duration < 1 {
+		duration = 1
+	}
+	m := &SpanModel{
+		TraceID:        s.context.TraceID,
+		ID:             s.context.SpanID,
+		ParentID:       s.context.ParentID,
+		Name:           s.name,
+		Kind:           s.kind,
+		Timestamp:      s.start.UnixNano() / 1000,
+		Duration:       duration,
+		LocalEndpoint:  s.tracer.local,
+		RemoteEndpoint: s.remote,
+		Debug:          s.context.Debug,
+	}
+	if len(s.tags) > 0 {
+		m.Tags = make(map[string]string, len(s.tags))
+		for k, v := range s.tags {
+			m.Tags[k] = v
+		}
+	}
+	s.tracer.exporter.enqueue(m)
+}
+
+// Tracer starts spans for a service and exports them.
+type Tracer struct {
+	local      *Endpoint
+	sampleRate float64
+	exporter   *batcher
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// NewTracer returns a tracer for the service at local that exports the
+// sampled spans with exporter. New traces are sampled with probability
+// sampleRate; callers that made a sampling decision are obeyed.
+func NewTracer(local *Endpoint, exporter Exporter, sampleRate float64) *Tracer {
+	return &Tracer{
+		local:      local,
+		sampleRate: sampleRate,
+		exporter:   newBatcher(exporter),
+		rnd:        random.New(),
+	}
+}
+
+// Close exports the spans that are still queued and closes the exporter.
+func (t *Tracer) Close() error {
+	return t.exporter.close()
+}
+
+func (t *Tracer) sample() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rnd.Float64() < t.sampleRate
+}
+
+// StartSpan starts a span named name. If parent is not nil the span
+// becomes its child, or the root of its trace if parent was generated,
+// otherwise it starts a new trace.
+func (t *Tracer) StartSpan(name, kind string, parent *propagation.Context) *Span {
+	var sc *propagation.Context
+	if parent != nil && parent.TraceID != "" {
+		sc = parent.Child()
+	} else {
+		sc = &propagation.Context{TraceID: propagation.NewTraceID(), SpanID: propagation.NewSpanID()}
+	}
+	if sc.Debug {
+		sampled := true
+		sc.Sampled = &sampled
+	}
+	if sc.Sampled == nil {
+		sampled := t.sample()
+		sc.Sampled = &sampled
+	}
+	return &Span{
+		tracer:  t,
+		context: sc,
+		name:    name,
+		kind:    kind,
+		start:   time.Now(),
+		tags:    make(map[string]string),
+	}
+}
+
+type spanKey struct{}
+
+// NewContext returns a context that carries span, and its trace context
+// for the calls made with ctx.
+func NewContext(ctx context.Context, span *Span) context.Context {
+	ctx = propagation.NewContext(ctx, span.Context())
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// FromContext returns the span in ctx, or nil.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}